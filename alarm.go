@@ -0,0 +1,399 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ALARM_OK    = "ok"
+	ALARM_ALARM = "alarm"
+)
+
+// Causes of alarm
+const (
+	ALARM_HIGH  = "high"
+	ALARM_LOW   = "low"
+	ALARM_STALE = "stale"
+	ALARM_ERROR = "error"
+)
+
+// Actions on change of alarm state
+const (
+	ALARM_LOG    = "log"
+	ALARM_SCRIPT = "script"
+	ALARM_HTTP   = "http"
+)
+
+type AlarmOpts struct {
+	Value       string    // name of monitor value
+	High        *float64  `json:",omitempty"`  // alarm if reading is above
+	Low         *float64  `json:",omitempty"`  // alarm if reading is below
+	Hysteresis  float64   // distance back inside limit to clear high or low alarm
+	Stale       uint      // seconds without valid readings to alarm, 0 to disable
+	SensorError bool      // alarm on sensor error
+	Actions     []string  // "log" (default), "script" or "http"
+}
+
+type AlarmSetOpts struct {
+	UUID   string
+	Alarms []AlarmOpts
+}
+
+type APIAlarm struct {
+	UUID    string
+	AlarmOpts
+	State   string
+	Cause   string     // empty if state is ok
+	Since   time.Time  // time of last change of state or cause
+	Reading *float64   `json:",omitempty"`  // reading at Since, if valid
+}
+
+// alarm checks readings of monitor value by alarm rule.
+type alarm struct {
+	APIAlarm
+	valid time.Time  // time of last valid reading
+}
+
+// alarmRegistry keeps alarms by monitor uuid, safe for concurrent use.
+type alarmRegistry struct {
+	mu      sync.Mutex
+	m       map[string][]*alarm
+	actions map[string]*alarmActions
+}
+
+// alarmActions runs actions of changes of alarms of monitor
+// one by one in order of changes.
+type alarmActions struct {
+	mu      sync.Mutex
+	pending []APIAlarm
+	running bool
+}
+
+var alarms = newAlarmRegistry()
+
+// checkAlarms checks alarm rules for monitor values.
+func checkAlarms(list []AlarmOpts, values []MonValue) error {
+	names := make(map[string]bool)
+	for _, opts := range list {
+		found := false
+		for _, v := range values {
+			if v.Name == opts.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("no value '" + opts.Value + "' in monitor for alarm")
+		}
+		if names[opts.Value] {
+			return errors.New("duplicate alarm of value '" + opts.Value + "'")
+		}
+		names[opts.Value] = true
+
+		if opts.High == nil && opts.Low == nil && opts.Stale == 0 && !opts.SensorError {
+			return errors.New("alarm of value '" + opts.Value + "' has no conditions")
+		}
+		if opts.High != nil && opts.Low != nil && *opts.Low >= *opts.High {
+			return errors.New("low limit of alarm must be below high limit")
+		}
+		if opts.Hysteresis < 0 {
+			return errors.New("alarm hysteresis can not be negative")
+		}
+		for _, action := range opts.Actions {
+			switch action {
+			case ALARM_LOG:
+			case ALARM_SCRIPT:
+				if config.Alarm.Script == "" {
+					return errors.New("alarm script is not configured")
+				}
+			case ALARM_HTTP:
+				if config.Alarm.URL == "" {
+					return errors.New("alarm URL is not configured")
+				}
+			default:
+				return errors.New("wrong alarm action: '" + action + "'")
+			}
+		}
+	}
+	return nil
+}
+
+// update checks reading v of value detected at time tm.
+// It returns true if state or cause of alarm is changed.
+func (a *alarm) update(tm time.Time, v float64) bool {
+	if a.valid.IsZero() {
+		a.valid = tm
+	}
+
+	cause := ""
+	if math.IsNaN(v) {
+		if a.SensorError {
+			cause = ALARM_ERROR
+		} else if a.Cause == ALARM_HIGH || a.Cause == ALARM_LOW {
+			// level is unknown, alarm is kept
+			cause = a.Cause
+		}
+	} else {
+		a.valid = tm
+		switch {
+		case a.High != nil && (v > *a.High || (a.Cause == ALARM_HIGH && v >= *a.High - a.Hysteresis)):
+			cause = ALARM_HIGH
+		case a.Low != nil && (v < *a.Low || (a.Cause == ALARM_LOW && v <= *a.Low + a.Hysteresis)):
+			cause = ALARM_LOW
+		}
+	}
+	if a.Stale > 0 && tm.Sub(a.valid) >= time.Duration(a.Stale) * time.Second {
+		cause = ALARM_STALE
+	}
+
+	if cause == a.Cause {
+		return false
+	}
+	a.Cause = cause
+	a.State = ALARM_OK
+	if cause != "" {
+		a.State = ALARM_ALARM
+	}
+	a.Since = tm
+	a.Reading = nil
+	if !math.IsNaN(v) {
+		a.Reading = &v
+	}
+	return true
+}
+
+func newAlarmRegistry() *alarmRegistry {
+	return &alarmRegistry{
+		m:       make(map[string][]*alarm),
+		actions: make(map[string]*alarmActions),
+	}
+}
+
+// add queues actions of alarm change.
+func (q *alarmActions) add(a APIAlarm) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending = append(q.pending, a)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+// run runs queued actions until queue is empty.
+func (q *alarmActions) run() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		a := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+
+		runAlarmActions(a)
+	}
+}
+
+// Set replaces alarms of monitor with uuid u by new rules
+// for monitor values and stores them. Alarm state is reset.
+func (r *alarmRegistry) Set(u string, list []AlarmOpts, values []MonValue) error {
+	err := checkAlarms(list, values)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	set := make([]*alarm, len(list))
+	for i, opts := range list {
+		set[i] = &alarm{APIAlarm: APIAlarm{u, opts, ALARM_OK, "", now, nil}}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err = store.RemoveAlarms(u)
+	if err != nil {
+		return err
+	}
+	for _, a := range set {
+		err = store.SaveAlarm(a.APIAlarm)
+		if err != nil {
+			return err
+		}
+	}
+	if len(set) == 0 {
+		delete(r.m, u)
+	} else {
+		r.m[u] = set
+	}
+	return nil
+}
+
+// Check updates alarms of monitor with uuid u by readings of values
+// detected at time tm. Changes of alarm state are stored and their
+// actions are run in background in order of changes.
+func (r *alarmRegistry) Check(u string, tm time.Time, values []MonValue, readings []float64) {
+	changed := make([]APIAlarm, 0)
+	r.mu.Lock()
+	for _, a := range r.m[u] {
+		for i, v := range values {
+			if v.Name == a.Value && i < len(readings) {
+				if a.update(tm, readings[i]) {
+					changed = append(changed, a.APIAlarm)
+				}
+				break
+			}
+		}
+	}
+	if len(changed) > 0 {
+		q, ok := r.actions[u]
+		if !ok {
+			q = &alarmActions{}
+			r.actions[u] = q
+		}
+		for _, a := range changed {
+			q.add(a)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, a := range changed {
+		err := store.SaveAlarm(a)
+		if err != nil {
+			logger.Print("error saving alarm of monitor " + u + ": " + err.Error())
+		}
+	}
+}
+
+// Remove deletes alarms of monitor with uuid u.
+func (r *alarmRegistry) Remove(u string) {
+	r.mu.Lock()
+	delete(r.m, u)
+	delete(r.actions, u)
+	r.mu.Unlock()
+
+	err := store.RemoveAlarms(u)
+	if err != nil {
+		logger.Print("error removing alarms of monitor " + u + ": " + err.Error())
+	}
+}
+
+// List returns alarms of all monitors.
+func (r *alarmRegistry) List() []APIAlarm {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]APIAlarm, 0)
+	for _, set := range r.m {
+		for _, a := range set {
+			list = append(list, a.APIAlarm)
+		}
+	}
+	return list
+}
+
+// loadAlarms restores stored alarms with their state.
+func loadAlarms() error {
+	saved, err := store.Alarms()
+	if err != nil {
+		return err
+	}
+
+	alarms.mu.Lock()
+	for _, a := range saved {
+		alarms.m[a.UUID] = append(alarms.m[a.UUID], &alarm{APIAlarm: a})
+	}
+	alarms.mu.Unlock()
+	logger.Printf("Found %d monitor alarms\n", len(saved))
+
+	return nil
+}
+
+// runAlarmActions runs actions of alarm on change of its state.
+func runAlarmActions(a APIAlarm) {
+	actions := a.Actions
+	if len(actions) == 0 {
+		actions = []string{ALARM_LOG}
+	}
+	for _, action := range actions {
+		var err error
+		switch action {
+		case ALARM_LOG:
+			logger.Printf("Alarm of monitor %s value '%s': %s %s\n", a.UUID, a.Value, a.State, a.Cause)
+		case ALARM_SCRIPT:
+			err = runAlarmScript(a)
+		case ALARM_HTTP:
+			err = postAlarm(a)
+		}
+		if err != nil {
+			logger.Printf("error running %s action of alarm of monitor %s: %s\n", action, a.UUID, err)
+		}
+	}
+}
+
+// runAlarmScript runs configured script with arguments:
+// monitor uuid, value name, state, cause and reading.
+func runAlarmScript(a APIAlarm) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Alarm.Timeout) * time.Second)
+	defer cancel()
+
+	reading := ""
+	if a.Reading != nil {
+		reading = strconv.FormatFloat(*a.Reading, 'g', -1, 64)
+	}
+	out, err := exec.CommandContext(ctx, config.Alarm.Script, a.UUID, a.Value, a.State, a.Cause, reading).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// postAlarm posts alarm as JSON object to configured URL.
+func postAlarm(a APIAlarm) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: time.Duration(config.Alarm.Timeout) * time.Second}
+	resp, err := client.Post(config.Alarm.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("alarm URL returned " + resp.Status)
+	}
+	return nil
+}
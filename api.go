@@ -32,16 +32,42 @@ import (
 	"os/exec"
 	"strings"
 	"bytes"
+	"sync"
 )
 
 type Lab struct {
-	series map[string]*SeriesRecord
+	series *seriesPool
+	conn   *apiConn
+}
+
+// seriesPool is a set of series shared by API connections.
+type seriesPool struct {
+	mu sync.Mutex
+	m  map[string]*SeriesRecord
+}
+
+// closeConn forgets GetSeries cursors of closed connection c.
+func (p *seriesPool) closeConn(c *apiConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, s := range p.m {
+		delete(s.cursors, c)
+	}
 }
 
 type SeriesRecord struct {
-	data     *<-chan *SerData
+	data     *serBuffer
 	stop       *chan<- int
 	finished *<-chan int
+	sampler  *sampler
+	opts     SeriesOpts
+	trigger  *trigger
+	monitor  *Monitor
+	cursors  map[*apiConn]uint64  // sequence numbers of the next rows returned by GetSeries to connections
+	created  time.Time
+	owner    string
+	accessed time.Time
 }
 
 type ValueId struct {
@@ -57,6 +83,7 @@ type APIValue struct {
 	Name       string
 	Range      DataRange
 	Resolution time.Duration
+	Unit       string
 }
 
 type APISensors map[string]APISensor
@@ -67,27 +94,60 @@ type Data struct {
 }
 
 type SeriesOpts struct {
-	Values []ValueId
-	Period time.Duration
-	Count  int
+	Values  []ValueId
+	Period  time.Duration
+	Count   int
+	Persist bool  // save data to monitor of Exp_id experiment
+	Exp_id  int
+	Trigger *TriggerOpts  `json:",omitempty"`  // oscilloscope mode
+}
+
+type SeriesCursorOpts struct {
+	UUID string
+	Seq  uint64
+}
+
+type SeriesChunk struct {
+	Rows        []*SerData
+	Next        uint64  // cursor for the next request
+	Overwritten bool    // some rows after requested cursor were lost
+}
+
+type SeriesSaveOpts struct {
+	UUID   string
+	Exp_id int
 }
 
 type APISeriesRecord struct {
-	UUID     string
-	Stop     bool
-	Finished bool
-	Len      uint
-	//Created time.Time
+	UUID       string
+	Stop       bool
+	Finished   bool
+	Len        uint
+	Created    time.Time
+	Status     SeriesStatus
+	Opts       SeriesOpts
+	Owner      string
+	LastAccess time.Time
+}
+
+type SubscribeOpts struct {
+	UUID string
 }
 
 type MonitorOpts struct {
 	Exp_id   int
 	Setup_id int
-	Step     uint         // Interval
+	Step     uint         // Interval, seconds
+	StepMs   uint         // Interval, milliseconds, overrides Step if set
 	Count    uint         // Amount
 	Duration uint         // Duration / time_det
 	StopAt   time.Time
 	Values   []ValueId
+	Archives []uint       // Steps of consolidated archives, seconds
+	StartAt  time.Time    // start paused monitor later
+	Schedule string       // cron-like spec of recurring starts
+	Window   uint         // seconds monitor runs after each scheduled start
+	Alarms   []AlarmOpts  // alarms of values
 }
 
 type APIMonValue struct {
@@ -97,6 +157,7 @@ type APIMonValue struct {
 
 type APIMonitor struct {
 	Active  bool
+	Paused  bool
 	UUID    string
 	Created time.Time
 	StopAt  time.Time
@@ -108,6 +169,27 @@ type MonFetchOpts struct {
 	Start time.Time  `json:",omitempty"`
 	End   time.Time  `json:",omitempty"`
 	Step  time.Duration
+	Archive   uint    // step of consolidated archive, 0 for raw detections
+	Cf        string  // consolidation function, AVERAGE by default, not used for raw detections without Step
+	MaxPoints uint    // max number of rows to return, 0 for unlimited
+	Gaps      bool    // add rows of NaN readings at gaps of monitor data
+	Limit     uint    // max number of rows of page, 0 for unlimited
+	Cursor    string  // continuation token of previous page
+}
+
+type MonDataPage struct {
+	Rows []*SerData
+	Next string  // continuation token, empty on last page
+}
+
+type MonUpdateOpts struct {
+	UUID         string
+	Step         *uint       `json:",omitempty"`  // Interval, seconds
+	StepMs       *uint       `json:",omitempty"`  // Interval, milliseconds, overrides Step if set
+	Amount       *uint       `json:",omitempty"`
+	StopAt       *time.Time  `json:",omitempty"`
+	AddValues    []ValueId
+	RemoveValues []string    // names of values to remove
 }
 
 type MonRemoveOpts struct {
@@ -168,7 +250,25 @@ func (sd SerData) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		return []byte("{}"), err
 	}
-	j := "{\"Time\":" + string(t) + ",\"Readings\":" + r + "}"
+	j := "{\"Time\":" + string(t) + ",\"Readings\":" + r
+	if !sd.Scheduled.IsZero() {
+		st, err := json.Marshal(sd.Scheduled)
+		if err != nil {
+			return []byte("{}"), err
+		}
+		j += ",\"Scheduled\":" + string(st)
+	}
+	if sd.Gap != "" {
+		j += ",\"Gap\":\"" + sd.Gap + "\""
+	}
+	if sd.Errors != nil {
+		e, err := json.Marshal(sd.Errors)
+		if err != nil {
+			return []byte("{}"), err
+		}
+		j += ",\"Errors\":" + string(e)
+	}
+	j += "}"
 	return []byte(j), nil
 }
 
@@ -177,7 +277,9 @@ func (lab *Lab) GetData(valueId *ValueId, value *Data) (err error) {
 	if ok, _ := valueAvailable((*valueId).Sensor, (*valueId).ValueIdx); !ok {
 		return errors.New("Wrong sensor spec")
 	}
-	(*value).Reading, err = pluggedSensors[(*valueId).Sensor].GetData((*valueId).ValueIdx)
+	ctx, cancel := sensorContext()
+	defer cancel()
+	(*value).Reading, err = pluggedSensors[(*valueId).Sensor].GetData(ctx, (*valueId).ValueIdx)
 	return err
 }
 
@@ -198,6 +300,7 @@ func (lab *Lab) ListSensors(rescan *bool, sensors *APISensors) error {
 					val.Name,
 					val.Range,
 					val.Resolution,
+					val.Unit,
 				},
 			)
 		}
@@ -207,43 +310,84 @@ func (lab *Lab) ListSensors(rescan *bool, sensors *APISensors) error {
 }
 
 func (lab *Lab) StartSeries(opts *SeriesOpts, u *string) error {
-	// Check pool size and cleanup?
-	if len(lab.series) >= int(config.Series.Pool) {
-		/*
-		// XXX: skip cleanup now because unknown rule of series deletion (when and which of them)? just return busy
+	lab.series.mu.Lock()
+	defer lab.series.mu.Unlock()
+
+	lab.expireSeries()
+
+	// Check pool size and cleanup
+	if len(lab.series.m) >= int(config.Series.Pool) {
 		err := lab.cleanupSeries()
 		if err != nil {
 			*u = ""
 			return err
 		}
-		*/
-		*u = ""
-		return errors.New("series is busy")
 	}
 
-	data, stop, finished, err := startSeries(opts.Values, opts.Period, opts.Count)
+	var tr *trigger
+	if opts.Trigger != nil {
+		var err error
+		tr, err = newTrigger(opts.Trigger, len(opts.Values))
+		if err != nil {
+			*u = ""
+			return err
+		}
+	}
+
+	var mon *Monitor
+	if opts.Persist {
+		var err error
+		mon, err = createSeriesMonitor(opts.Exp_id, opts.Values, opts.Period, time.Now())
+		if err != nil {
+			*u = ""
+			return err
+		}
+	}
+
+	id := uuid.NewRandom().String()
+	data, stop, finished, sm, err := startSeries(id, opts.Values, opts.Period, opts.Count, mon, tr)
 	if err != nil {
+		if mon != nil {
+			mon.Remove(true)
+		}
 		*u = ""
 		return err
 	}
 
-	*u = uuid.NewRandom().String()
-	lab.series[*u] = &SeriesRecord{
-		data:     &data,
+	owner := ""
+	if lab.conn != nil {
+		owner = lab.conn.Name()
+	}
+	now := time.Now()
+
+	*u = id
+	lab.series.m[*u] = &SeriesRecord{
+		data:     data,
 		stop:     &stop,
 		finished: &finished,
+		sampler:  sm,
+		opts:     *opts,
+		trigger:  tr,
+		monitor:  mon,
+		cursors:  make(map[*apiConn]uint64),
+		created:  now,
+		owner:    owner,
+		accessed: now,
 	}
 
 	return nil
 }
 
 func (lab *Lab) StopSeries(u *string, ok *bool) error {
+	lab.series.mu.Lock()
+	defer lab.series.mu.Unlock()
+
 	if *u == "" {
 		*ok = false
 		return errors.New("wrong series uuid")
 	}
 
-	s, exists := lab.series[*u]
+	s, exists := lab.series.m[*u]
 	if !exists {
 		*ok = false
 		return errors.New("series is not running")
@@ -262,11 +406,14 @@ func (lab *Lab) StopSeries(u *string, ok *bool) error {
 }
 
 func (lab *Lab) GetSeries(u *string, data *[]*SerData) error {
+	lab.series.mu.Lock()
+	defer lab.series.mu.Unlock()
+
 	if *u == "" {
 		return errors.New("wrong series uuid")
 	}
 
-	s, exists := lab.series[*u]
+	s, exists := lab.series.m[*u]
 	if !exists {
 		return errors.New("series is not running")
 	}
@@ -274,17 +421,126 @@ func (lab *Lab) GetSeries(u *string, data *[]*SerData) error {
 	if s.data == nil {
 		return errors.New("no series ever run")
 	}
-	*data = make([]*SerData, len(*s.data))
-	for i := range *data {
-		(*data)[i] = <-*s.data
+	s.accessed = time.Now()
+	*data, s.cursors[lab.conn], _ = s.data.Since(s.cursors[lab.conn])
+	return nil
+}
+
+func (lab *Lab) GetSeriesSince(opts *SeriesCursorOpts, chunk *SeriesChunk) error {
+	lab.series.mu.Lock()
+	defer lab.series.mu.Unlock()
+
+	if opts.UUID == "" {
+		return errors.New("wrong series uuid")
+	}
+
+	s, exists := lab.series.m[opts.UUID]
+	if !exists {
+		return errors.New("series is not running")
+	}
+
+	if s.data == nil {
+		return errors.New("no series ever run")
+	}
+	s.accessed = time.Now()
+	chunk.Rows, chunk.Next, chunk.Overwritten = s.data.Since(opts.Seq)
+	return nil
+}
+
+func (lab *Lab) TriggerSeries(u *string, ok *bool) error {
+	lab.series.mu.Lock()
+	defer lab.series.mu.Unlock()
+
+	*ok = false
+	s, exists := lab.series.m[*u]
+	if !exists {
+		return errors.New("series is not exists")
+	}
+	if s.trigger == nil {
+		return errors.New("series has no trigger")
+	}
+	if s.ended() {
+		return errors.New("series is not running")
+	}
+	if !s.trigger.Fire() {
+		return errors.New("series is triggered already")
 	}
+
+	*ok = true
+	return nil
+}
+
+func (lab *Lab) GetCapture(u *string, capture *Capture) error {
+	lab.series.mu.Lock()
+	defer lab.series.mu.Unlock()
+
+	s, exists := lab.series.m[*u]
+	if !exists {
+		return errors.New("series is not exists")
+	}
+	if s.trigger == nil {
+		return errors.New("series has no trigger")
+	}
+
+	s.accessed = time.Now()
+	*capture = s.trigger.Capture()
+	return nil
+}
+
+func (lab *Lab) SaveSeries(opts *SeriesSaveOpts, monUUID *string) error {
+	lab.series.mu.Lock()
+	defer lab.series.mu.Unlock()
+
+	*monUUID = ""
+
+	s, exists := lab.series.m[opts.UUID]
+	if !exists {
+		return errors.New("series is not exists")
+	}
+
+	// Persisted already
+	if s.monitor != nil {
+		*monUUID = s.monitor.UUID.String()
+		return nil
+	}
+
+	s.accessed = time.Now()
+	// Rows in buffer are saved at once, rows of running series
+	// made later are saved as with Persist option
+	mon, err := s.data.Persist(func(rows []*SerData) (*Monitor, error) {
+		if len(rows) == 0 {
+			return nil, errors.New("no series data to save")
+		}
+		mon, err := createSeriesMonitor(opts.Exp_id, s.opts.Values, s.opts.Period, rows[0].Time)
+		if err != nil {
+			return nil, err
+		}
+		err = mon.Append(rows)
+		if err != nil {
+			mon.Remove(true)
+			return nil, err
+		}
+		return mon, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.monitor = mon
+
+	*monUUID = mon.UUID.String()
+	logger.Printf("SaveSeries: series %s saved to monitor %s", opts.UUID, *monUUID)
 	return nil
 }
 
 func (lab *Lab) ListSeries(ptr uintptr, result *[]APISeriesRecord) error {
+	lab.series.mu.Lock()
+	defer lab.series.mu.Unlock()
+
+	lab.expireSeries()
+
 	*result = make([]APISeriesRecord, 0)
 
-	for k, s := range lab.series {
+	for k, s := range lab.series.m {
 		st, finished := false, false
 		if s.stop == nil {
 			st = true
@@ -296,8 +552,12 @@ func (lab *Lab) ListSeries(ptr uintptr, result *[]APISeriesRecord) error {
 			k,
 			st,
 			finished,
-			uint(len(*s.data)),
-			//s.Created,
+			s.data.Len(),
+			s.created,
+			s.sampler.Status(),
+			s.opts,
+			s.owner,
+			s.accessed,
 		}
 
 		*result = append(*result, sr)
@@ -307,12 +567,15 @@ func (lab *Lab) ListSeries(ptr uintptr, result *[]APISeriesRecord) error {
 }
 
 func (lab *Lab) RemoveSeries(u *string, ok *bool) error {
+	lab.series.mu.Lock()
+	defer lab.series.mu.Unlock()
+
 	if *u == "" {
 		*ok = false
 		return errors.New("wrong series uuid")
 	}
 
-	s, exists := lab.series[*u]
+	s, exists := lab.series.m[*u]
 	if !exists {
 		*ok = false
 		return errors.New("series is not exists")
@@ -324,7 +587,7 @@ func (lab *Lab) RemoveSeries(u *string, ok *bool) error {
 		s.stop = nil
 	}
 
-	delete(lab.series, *u)
+	delete(lab.series.m, *u)
 	//logger.Print("series " + *u + " removed")
 
 	*ok = true
@@ -332,15 +595,18 @@ func (lab *Lab) RemoveSeries(u *string, ok *bool) error {
 }
 
 func (lab *Lab) CleanSeries(ptr uintptr, ok *bool) error {
+	lab.series.mu.Lock()
+	defer lab.series.mu.Unlock()
+
 	// Warning! Will be removed ALL series!
-	for k, s := range lab.series {
+	for k, s := range lab.series.m {
 		// stop if not stopped
 		if s.stop != nil {
 			*s.stop <- 1
 			s.stop = nil
 		}
 
-		delete(lab.series, k)
+		delete(lab.series.m, k)
 	}
 
 	logger.Print("series removed")
@@ -349,44 +615,114 @@ func (lab *Lab) CleanSeries(ptr uintptr, ok *bool) error {
 	return nil
 }
 
+// ended reports if series is stopped or finished.
+func (s *SeriesRecord) ended() bool {
+	if s.stop == nil {
+		// if channel not initialized, removed or nil`ed
+		return true
+	}
+	// already finished himself
+	return len(*s.finished) > 0
+}
+
+// removeSeries stops series if running and removes it from pool.
+// Pool must be locked.
+func (lab *Lab) removeSeries(u string) {
+	s := lab.series.m[u]
+	if s.stop != nil {
+		select {
+		case *s.stop <- 1:
+		default:
+		}
+		s.stop = nil
+	}
+	delete(lab.series.m, u)
+}
+
+// expireSeries removes series ended and not accessed for config.Series.TTL
+// seconds and running series not accessed for config.Series.IdleTTL seconds.
+// Pool must be locked.
+func (lab *Lab) expireSeries() {
+	now := time.Now()
+	for k, s := range lab.series.m {
+		idle := now.Sub(s.accessed)
+		if s.ended() {
+			if config.Series.TTL == 0 || idle < time.Duration(config.Series.TTL)*time.Second {
+				continue
+			}
+		} else {
+			if config.Series.IdleTTL == 0 || idle < time.Duration(config.Series.IdleTTL)*time.Second {
+				continue
+			}
+		}
+		lab.removeSeries(k)
+		logger.Print("series " + k + " expired")
+	}
+}
+
+// cleanupSeries removes least recently accessed series from pool,
+// ended series are removed first. Pool must be locked.
 func (lab *Lab) cleanupSeries() error {
-	// search stopped/old series and delete one
-	deleted := false
-	
-	for k, s := range lab.series {
-		found := false
-		if s.stop == nil {
-			// if channel not initialized, removed or nil`ed
-			found = true
-		} else if len(*s.stop) > 0 {
-			// already stopped
-			found = true
-		} else if len(*s.finished) > 0 {
-			// already finished himself
-			found = true
-		}
-
-		// Delete from list
-		if found {
-			delete(lab.series, k)
-			deleted = true
-			logger.Print("series " + k + " purged")
-			break
+	lru, lruEnded := "", ""
+	for k, s := range lab.series.m {
+		if s.ended() {
+			if lruEnded == "" || s.accessed.Before(lab.series.m[lruEnded].accessed) {
+				lruEnded = k
+			}
+		} else if lru == "" || s.accessed.Before(lab.series.m[lru].accessed) {
+			lru = k
 		}
 	}
+	if lruEnded != "" {
+		lru = lruEnded
+	}
+	if lru == "" {
+		return errors.New("series is busy")
+	}
 
-	if !deleted {
-		// TODO: try stop older series, need creation time
+	lab.removeSeries(lru)
+	logger.Print("series " + lru + " purged")
 
-		//old := ""
-		//if lab.series[old].stop != nil {
-		//	*lab.series[old].stop <- 1
-		//	lab.series[old].stop = nil
-		//}
+	return nil
+}
 
-		return errors.New("series is busy")
+func (lab *Lab) Subscribe(opts *SubscribeOpts, id *string) error {
+	*id = ""
+	if lab.conn == nil {
+		return errors.New("subscriptions are not supported by connection")
 	}
 
+	// Series or monitor
+	u := uuid.Parse(opts.UUID)
+	if u == nil {
+		return errors.New("Wrong UUID: " + opts.UUID)
+	}
+	lab.series.mu.Lock()
+	s, exists := lab.series.m[u.String()]
+	ended := exists && s.ended()
+	lab.series.mu.Unlock()
+	if exists {
+		if ended {
+			return errors.New("series is not running")
+		}
+	} else if mon, exists := monitors.Get(u.String()); exists {
+		if !mon.IsActive() {
+			return errors.New("monitor is not active")
+		}
+	} else {
+		return errors.New("Wrong UUID: " + opts.UUID)
+	}
+
+	*id = streams.Subscribe(u.String(), lab.conn)
+	return nil
+}
+
+func (lab *Lab) Unsubscribe(id *string, ok *bool) error {
+	*ok = false
+	if streams.Owner(*id) != lab.conn {
+		return errors.New("Wrong subscription id: " + *id)
+	}
+	*ok = streams.Unsubscribe(*id)
 	return nil
 }
 
@@ -403,7 +739,7 @@ func (lab *Lab) StartMonitor(opts *MonitorOpts, uuid *string) error {
 }
 
 func (lab *Lab) StopMonitor(u *string, ok *bool) error {
-	mon, exist := monitors[uuid.Parse(*u).String()]
+	mon, exist := monitors.Get(uuid.Parse(*u).String())
 	if !exist {
 		*ok = false
 		return errors.New("Wrong monitor UUID: " + *u)
@@ -418,14 +754,108 @@ func (lab *Lab) StopMonitor(u *string, ok *bool) error {
 	return err
 }
 
+func (lab *Lab) PauseMonitor(u *string, ok *bool) error {
+	mon, exist := monitors.Get(uuid.Parse(*u).String())
+	if !exist {
+		*ok = false
+		return errors.New("Wrong monitor UUID: " + *u)
+	}
+
+	*ok = false
+	err := mon.Pause()
+	if err == nil {
+		*ok = true
+	}
+
+	return err
+}
+
+func (lab *Lab) ResumeMonitor(u *string, ok *bool) error {
+	mon, exist := monitors.Get(uuid.Parse(*u).String())
+	if !exist {
+		*ok = false
+		return errors.New("Wrong monitor UUID: " + *u)
+	}
+
+	*ok = false
+	err := mon.Resume()
+	if err == nil {
+		*ok = true
+	}
+
+	return err
+}
+
+func (lab *Lab) UpdateMonitor(opts *MonUpdateOpts, ok *bool) error {
+	mon, exist := monitors.Get(uuid.Parse(opts.UUID).String())
+	if !exist {
+		*ok = false
+		return errors.New("Wrong monitor UUID: " + opts.UUID)
+	}
+
+	*ok = false
+	err := mon.Change(opts)
+	if err == nil {
+		*ok = true
+	}
+
+	return err
+}
+
+func (lab *Lab) ListSchedules(ptr uintptr, result *[]APISchedule) error {
+	*result = schedules.List()
+	return nil
+}
+
+func (lab *Lab) CancelSchedule(u *string, ok *bool) error {
+	*ok = schedules.Cancel(uuid.Parse(*u).String())
+	if !*ok {
+		return errors.New("No schedule for monitor UUID: " + *u)
+	}
+	return nil
+}
+
+func (lab *Lab) SetAlarms(opts *AlarmSetOpts, ok *bool) error {
+	mon, exist := monitors.Get(uuid.Parse(opts.UUID).String())
+	if !exist {
+		*ok = false
+		return errors.New("Wrong monitor UUID: " + opts.UUID)
+	}
+
+	monDBi, err := monitorToDB(mon)
+	if err != nil {
+		*ok = false
+		return err
+	}
+	err = alarms.Set(monDBi.UUID, opts.Alarms, monDBi.Values)
+	*ok = err == nil
+	return err
+}
+
+func (lab *Lab) ListAlarms(ptr uintptr, result *[]APIAlarm) error {
+	*result = alarms.List()
+	return nil
+}
+
+func (lab *Lab) RetentionReport(ptr uintptr, report *RetentionReport) error {
+	r, err := retentionPlan()
+	if err != nil {
+		return err
+	}
+	*report = *r
+	return nil
+}
+
 func (lab *Lab) ListMonitors(ptr uintptr, result *[]APIMonitor) error {
 	*result = make([]APIMonitor, 0)
 
 	// TODO: sync list monitors with monitor info
 
-	for _, v := range monitors {
+	for _, v := range monitors.List() {
+		v.mu.RLock()
 		m := APIMonitor{
 			v.Active,
+			v.Paused,
 			v.UUID.String(),
 			v.Created,
 			v.StopAt,
@@ -440,13 +870,14 @@ func (lab *Lab) ListMonitors(ptr uintptr, result *[]APIMonitor) error {
 				},
 			}
 		}
+		v.mu.RUnlock()
 		*result = append(*result, m)
 	}
 	return nil
 }
 
 func (lab *Lab) GetMonInfo(u *string, info *MonitorInfo) error {
-	mon, exist := monitors[uuid.Parse(*u).String()]
+	mon, exist := monitors.Get(uuid.Parse(*u).String())
 	if !exist {
 		return errors.New("Wrong monitor UUID: " + *u)
 	}
@@ -463,7 +894,7 @@ func (lab *Lab) GetMonInfo(u *string, info *MonitorInfo) error {
 
 func (lab *Lab) RemoveMonitor(opts *MonRemoveOpts, ok *bool) error {
 	*ok = true
-	mon, exist := monitors[uuid.Parse(opts.UUID).String()]
+	mon, exist := monitors.Get(uuid.Parse(opts.UUID).String())
 	if !exist {
 		*ok = false
 		return errors.New("Wrong monitor UUID: " + opts.UUID)
@@ -483,7 +914,7 @@ func (lab *Lab) StrobeMonitor(opts *MonStrobeOpts, ok *bool) error {
 	*ok = true
 	if opts.UUID != "" {
 		// Monitor sensors values
-		mon, exist := monitors[uuid.Parse(opts.UUID).String()]
+		mon, exist := monitors.Get(uuid.Parse(opts.UUID).String())
 		if !exist {
 			*ok = false
 			return errors.New("Wrong monitor UUID: " + opts.UUID)
@@ -526,49 +957,204 @@ func (lab *Lab) StrobeMonitor(opts *MonStrobeOpts, ok *bool) error {
 }
 
 func (lab *Lab) GetMonData(opts *MonFetchOpts, data *[]*SerData) error {
-	mon, exist := monitors[uuid.Parse(opts.UUID).String()]
+	mon, exist := monitors.Get(uuid.Parse(opts.UUID).String())
 	if !exist {
 		return errors.New("Wrong monitor UUID: " + opts.UUID)
 	}
 
-	fr, err := mon.Fetch(opts.Start, opts.End, opts.Step)
+	rows := make([]*SerData, 0)
+	_, _, err := fetchMonData(mon, opts, func(row *SerData) error {
+		rows = append(rows, row)
+		return nil
+	})
+	*data = rows
+	return err
+}
+
+func (lab *Lab) GetMonDataPage(opts *MonFetchOpts, page *MonDataPage) error {
+	mon, exist := monitors.Get(uuid.Parse(opts.UUID).String())
+	if !exist {
+		return errors.New("Wrong monitor UUID: " + opts.UUID)
+	}
+
+	rows := make([]*SerData, 0)
+	_, next, err := fetchMonData(mon, opts, func(row *SerData) error {
+		rows = append(rows, row)
+		return nil
+	})
+	page.Rows, page.Next = rows, next
+	return err
+}
+
+func (lab *Lab) GetMonStats(opts *MonStatsOpts, stats *MonStats) error {
+	mon, exist := monitors.Get(uuid.Parse(opts.UUID).String())
+	if !exist {
+		return errors.New("Wrong monitor UUID: " + opts.UUID)
+	}
+
+	s, err := monitorStats(mon, opts)
 	if err != nil {
 		return err
 	}
+	*stats = *s
+	return nil
+}
 
-	// collect plain fetched results to series rows
-	*data = make([]*SerData, 0, fr.RowCnt)
-	nvals := len(fr.DsNames)
-	var pasttm time.Time
-	var d *SerData
-	added := false
-	for i, _ := range fr.DsData {
-		tm := fr.DsData[i].Time
-
-		// new series data on new time
-		if i == 0 || !tm.Equal(pasttm) {
-			d = &SerData{
-				tm,
-				make([]float64, nvals),
-			}
-			pasttm = tm
-			added = false
+func (lab *Lab) ExportMonitor(opts *ExportOpts, result *ExportResult) error {
+	opts.UUID = uuid.Parse(opts.UUID).String()
+	r, err := exportMonitor(opts)
+	if err != nil {
+		return err
+	}
+	*result = *r
+	return nil
+}
+
+func (lab *Lab) GetExportChunk(opts *ExportChunkOpts, chunk *ExportChunk) error {
+	c, err := exportChunk(opts)
+	if err != nil {
+		return err
+	}
+	*chunk = *c
+	return nil
+}
+
+func (lab *Lab) ImportData(opts *ImportOpts, result *ImportResult) error {
+	r, err := importData(opts)
+	if r != nil {
+		*result = *r
+	}
+	return err
+}
+
+// fetchMonData passes monitor data rows by fetch options to fn ordered
+// by time. Rows are passed while they are read from storage, unless
+// they are consolidated by Step or downsampled to MaxPoints, then all
+// fetched rows are loaded first. It returns names of values
+// and continuation token if rows are limited.
+func fetchMonData(mon *Monitor, opts *MonFetchOpts, fn func(*SerData) error) ([]string, string, error) {
+	cf := opts.Cf
+	if cf == "" {
+		cf = "AVERAGE"
+	}
+	err := checkCf(cf, fetchCfs)
+	if err != nil {
+		return nil, "", err
+	}
+	if opts.Limit != 0 && opts.MaxPoints != 0 {
+		return nil, "", errors.New("MaxPoints can not be used with Limit")
+	}
+
+	// continue from the first row of next page
+	start := opts.Start
+	if opts.Cursor != "" {
+		start, err = time.Parse(time.RFC3339Nano, opts.Cursor)
+		if err != nil {
+			return nil, "", errors.New("Wrong cursor: " + opts.Cursor)
 		}
+	}
 
-		// copy found reading
-		for j, dn := range fr.DsNames {
-			if fr.DsData[i].Name == dn {
-				d.Readings[j] = fr.DsData[i].Detection
+	monDBi, err := monitorToDB(mon)
+	if err != nil {
+		return nil, "", err
+	}
+	step := time.Duration(monDBi.StepMs) * time.Millisecond
+	if opts.Archive != 0 {
+		step = time.Duration(opts.Archive) * time.Second
+	}
+	consolidated := opts.Step > step
+	whole := consolidated || opts.MaxPoints != 0
+
+	// break data lines at gaps
+	gi := &gapInserter{fn: fn}
+	if opts.Gaps {
+		gi.gaps, err = monDBi.gaps()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	// rows processed as whole are collected,
+	// gaps are inserted after rows are aggregated
+	data := make([]*SerData, 0)
+	add := gi.add
+	if whole {
+		add = func(row *SerData) error {
+			data = append(data, row)
+			return nil
+		}
+	}
+
+	// Limit counts rows or buckets of Step, first row of the next page
+	// is fetched too to break data lines at pauses between pages
+	var next, last time.Time
+	var cnt uint
+	fr, err := mon.Fetch(start, opts.End, opts.Archive, cf, func(row *SerData) error {
+		if opts.Limit != 0 {
+			tm := row.Time
+			if consolidated {
+				tm = tm.Truncate(opts.Step)
+			}
+			if cnt == 0 || !tm.Equal(last) {
+				cnt++
+				last = tm
 			}
+			if cnt > opts.Limit {
+				next = tm
+				// the row is needed only to aggregate data as whole
+				var err error
+				if whole {
+					err = add(row)
+				} else {
+					err = gi.before(row.Time, len(row.Readings))
+				}
+				if err == nil {
+					err = errStopScan
+				}
+				return err
+			}
+		}
+		return add(row)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	cursor := ""
+	if !next.IsZero() {
+		cursor = next.UTC().Format(time.RFC3339Nano)
+	}
+	if !whole {
+		return fr.DsNames, cursor, nil
+	}
+
+	// aggregate rows by Step coarser than fetched data
+	if consolidated {
+		scf := cf
+		if fr.Cf == "COUNT" {
+			// sum detections counts of archive buckets
+			scf = "SUM"
 		}
+		data = consolidate(data, opts.Step, scf)
+	}
 
-		// add collected row
-		if !added {
-			*data = append(*data, d)
-			added = true
+	data = downsample(data, opts.MaxPoints)
+
+	for _, row := range data {
+		if !next.IsZero() && !row.Time.Before(next) {
+			break
+		}
+		err = gi.add(row)
+		if err != nil {
+			break
 		}
 	}
-	return nil
+	if err == nil && !next.IsZero() {
+		err = gi.before(next, len(fr.DsNames))
+	}
+	if err != nil && err != errStopScan {
+		return nil, "", err
+	}
+	return fr.DsNames, cursor, nil
 }
 
 func (lab *Lab) SetDatetime(opts *TimeSetOpts, ok *bool) error {
@@ -958,9 +1544,8 @@ func listenTCP(addr string) (listener *net.TCPListener, err error) {
 }
 
 func startAPI() (listeners []net.Listener, err error) {
-	lab := &Lab{series: make(map[string]*SeriesRecord)}
+	series := &seriesPool{m: make(map[string]*SeriesRecord)}
 
-	rpc.Register(lab)
 	listeners = make([]net.Listener, 0, 2)
 	if config.Socket.Enable {
 		l, err := listenUnix(
@@ -993,9 +1578,26 @@ func startAPI() (listeners []net.Listener, err error) {
 					logger.Print(err)
 					continue
 				}
-				go jsonrpc.ServeConn(conn)
+				go serveConn(conn, series)
 			}
 		}(i)
 	}
 	return listeners, nil
 }
+
+// serveConn runs JSON-RPC server on connection. Each connection has own
+// Lab receiver sharing series with others, so API methods can
+// send notifications to the client.
+func serveConn(conn net.Conn, series *seriesPool) {
+	c := newAPIConn(conn)
+	srv := rpc.NewServer()
+	err := srv.Register(&Lab{series: series, conn: c})
+	if err != nil {
+		logger.Print(err)
+		conn.Close()
+		return
+	}
+	srv.ServeCodec(jsonrpc.NewServerCodec(c))
+	streams.CloseConn(c)
+	series.closeConn(c)
+}
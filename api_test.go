@@ -0,0 +1,2218 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupTest prepares configuration, database in temporary directory
+// and single FILE sensor "test-file:0" reading constant value.
+// It returns function to cleanup.
+func setupTest(t *testing.T) func() {
+	return setupStorageTest(t, "sqlite")
+}
+
+// setupStorageTest works like setupTest with storage of given type,
+// sqlite storage is replaced by mysql if SDLAB_TEST_MYSQL is set.
+func setupStorageTest(t *testing.T, dbtype string) func() {
+	dir, err := ioutil.TempDir("", "sdlab")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger = log.New(ioutil.Discard, "", log.LstdFlags)
+	config = Config{}
+	config.Series.Buffer = 100
+	config.Series.Pool = 50
+	config.Stream.Buffer = 10
+	config.Database.Type = dbtype
+	config.Database.Dsn = "file:" + filepath.Join(dir, "sdlab.db") + "?_busy_timeout=50000"
+	config.Database.Batch.Latency = 100
+	config.Database.Batch.Rows = 100
+	config.Export.Path = filepath.Join(dir, "export")
+	config.Export.Chunk = 64
+	if dsn := os.Getenv("SDLAB_TEST_MYSQL"); dsn != "" && dbtype == "sqlite" {
+		config.Database.Type = "mysql"
+		config.Database.Dsn = dsn
+		config.Database.MaxOpen = 10
+		config.Database.MaxIdle = 5
+	}
+
+	if config.Database.Type == "mysql" {
+		db, err = initDB(config.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropTestTables(t)
+		db.Close()
+	}
+	store, err = openStorage(config.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitors = newMonitorRegistry()
+	alarms = newAlarmRegistry()
+
+	file := filepath.Join(dir, "value")
+	err = ioutil.WriteFile(file, []byte("21.5\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pluggedSensors = PluggedSensors{
+		"test-file:0": &PluggedSensor{0, &Sensor{
+			"test",
+			[]Value{{
+				Name:       "value",
+				Range:      DataRange{-100, 100},
+				File:       file,
+				Re:         regexp.MustCompile(".*"),
+				Multiplier: 1,
+			}},
+			Device{FILE, 0, ""},
+		}},
+	}
+
+	return func() {
+		for _, mon := range monitors.List() {
+			mon.Stop()
+		}
+		// rows of series are left in write queue
+		writes.Flush()
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// dropTestTables removes tables created by mysql migrations,
+// so every test starts with empty schema. Other tables of test
+// database are kept.
+func dropTestTables(t *testing.T) {
+	sch := schemas["mysql"]
+	re := regexp.MustCompile(`CREATE TABLE IF NOT EXISTS (\w+)`)
+	tables := make([]string, 0)
+	for _, m := range sch.Migrations {
+		for _, query := range m.SQL {
+			for _, match := range re.FindAllStringSubmatch(query, -1) {
+				tables = append(tables, match[1])
+			}
+		}
+	}
+	tables = append(tables, "schema_version")
+	for _, name := range tables {
+		_, err := db.Exec("DROP TABLE IF EXISTS `" + name + "`")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentAPI(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	values := []ValueId{{"test-file:0", 0}, {"test-file:0", 0}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		// monitors lifecycle
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var u string
+			var ok bool
+			err := lab.StartMonitor(&MonitorOpts{Exp_id: 1, Step: 1, Values: values}, &u)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			var rwg sync.WaitGroup
+			deadline := time.Now().Add(1500 * time.Millisecond)
+			for j := 0; j < 4; j++ {
+				rwg.Add(1)
+				go func() {
+					defer rwg.Done()
+					for time.Now().Before(deadline) {
+						var info MonitorInfo
+						var data []*SerData
+						var list []APIMonitor
+						var strobed bool
+						lab.GetMonInfo(&u, &info)
+						lab.GetMonData(&MonFetchOpts{UUID: u}, &data)
+						lab.ListMonitors(0, &list)
+						lab.StrobeMonitor(&MonStrobeOpts{UUID: u}, &strobed)
+						time.Sleep(10 * time.Millisecond)
+					}
+				}()
+			}
+			rwg.Wait()
+
+			lab.StopMonitor(&u, &ok)
+			err = lab.RemoveMonitor(&MonRemoveOpts{u, true}, &ok)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+
+		// series lifecycle
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var u string
+			var ok bool
+			err := lab.StartSeries(&SeriesOpts{Values: values, Period: 10 * time.Millisecond, Count: 50}, &u)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			deadline := time.Now().Add(500 * time.Millisecond)
+			for time.Now().Before(deadline) {
+				var data []*SerData
+				var chunk SeriesChunk
+				var list []APISeriesRecord
+				lab.GetSeries(&u, &data)
+				lab.GetSeriesSince(&SeriesCursorOpts{u, 0}, &chunk)
+				lab.ListSeries(0, &list)
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			lab.StopSeries(&u, &ok)
+			lab.RemoveSeries(&u, &ok)
+		}()
+	}
+	wg.Wait()
+
+	if n := len(monitors.List()); n != 0 {
+		t.Errorf("%d monitors left after removing", n)
+	}
+	if n := len(lab.series.m); n != 0 {
+		t.Errorf("%d series left after removing", n)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	defer setupStorageTest(t, "memory")()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	values := []ValueId{{"test-file:0", 0}}
+
+	var u string
+	var ok bool
+	err := lab.StartMonitor(&MonitorOpts{Exp_id: 1, StepMs: 100, Values: values}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(550 * time.Millisecond)
+	err = lab.StopMonitor(&u, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var info MonitorInfo
+	err = lab.GetMonInfo(&u, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Counters.Done == 0 || info.Counters.Done != info.Values[0].Len {
+		t.Errorf("counters %+v do not match %d stored detections", info.Counters, info.Values[0].Len)
+	}
+
+	var data []*SerData
+	err = lab.GetMonData(&MonFetchOpts{UUID: u}, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint(len(data)) != info.Values[0].Len {
+		t.Errorf("got %d rows, want %d", len(data), info.Values[0].Len)
+	}
+	for i, row := range data {
+		if len(row.Readings) != 1 || row.Readings[0] != 21.5 {
+			t.Errorf("row %d: got %v, want [21.5]", i, row.Readings)
+		}
+		if i > 0 && row.Time.Before(data[i-1].Time) {
+			t.Errorf("row %d is not ordered by time", i)
+		}
+	}
+
+	err = lab.RemoveMonitor(&MonRemoveOpts{u, true}, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := store.MonitorIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("%d monitors left in storage after removing", len(ids))
+	}
+}
+
+func TestExportMonitor(t *testing.T) {
+	defer setupTest(t)()
+	pluggedSensors["test-file:0"].Sensor.Values[0].Unit = "°C"
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	values := []ValueId{{"test-file:0", 0}}
+
+	var u string
+	var ok bool
+	err := lab.StartMonitor(&MonitorOpts{Exp_id: 1, StepMs: 100, Values: values}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(350 * time.Millisecond)
+	err = lab.StopMonitor(&u, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CSV with decimal comma streamed by chunks
+	var res ExportResult
+	err = lab.ExportMonitor(&ExportOpts{MonFetchOpts: MonFetchOpts{UUID: u}, Format: "csv", DecimalComma: true, Stream: true}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 0)
+	chunk := ExportChunk{}
+	for !chunk.EOF {
+		err = lab.GetExportChunk(&ExportChunkOpts{res.Name, chunk.Next}, &chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = append(content, chunk.Data...)
+	}
+	if int64(len(content)) != res.Size {
+		t.Errorf("got %d bytes, want %d", len(content), res.Size)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if lines[0] != "Time;value0, °C" {
+		t.Errorf("wrong header: %q", lines[0])
+	}
+	if uint(len(lines)) != res.Rows+1 || res.Rows == 0 {
+		t.Errorf("got %d lines for %d rows", len(lines), res.Rows)
+	}
+	if !regexp.MustCompile(`^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\.\d{3};21,5$`).MatchString(lines[1]) {
+		t.Errorf("wrong row: %q", lines[1])
+	}
+	_, err = os.Stat(filepath.Join(config.Export.Path, res.Name))
+	if !os.IsNotExist(err) {
+		t.Error("streamed export file is not removed")
+	}
+
+	// XLSX is kept in export directory
+	err = lab.ExportMonitor(&ExportOpts{MonFetchOpts: MonFetchOpts{UUID: u}, Format: "xlsx"}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(filepath.Join(config.Export.Path, res.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, ".xml") && !strings.HasSuffix(f.Name, ".rels") {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := xml.NewDecoder(r)
+		for {
+			_, err = d.Token()
+			if err != nil {
+				break
+			}
+		}
+		r.Close()
+		if err != io.EOF {
+			t.Errorf("%s: %v", f.Name, err)
+		}
+	}
+
+	err = lab.ExportMonitor(&ExportOpts{MonFetchOpts: MonFetchOpts{UUID: u}, Format: "ods"}, &res)
+	if err == nil {
+		t.Error("unknown format is exported")
+	}
+
+	// Expired files are removed on next export
+	config.Export.TTL = 60
+	old := filepath.Join(config.Export.Path, res.Name)
+	err = os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lab.ExportMonitor(&ExportOpts{MonFetchOpts: MonFetchOpts{UUID: u}, Format: "jsonl"}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(old)
+	if !os.IsNotExist(err) {
+		t.Error("expired export file is not removed")
+	}
+	_, err = os.Stat(filepath.Join(config.Export.Path, res.Name))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImportData(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	data := "time;temperature;light\n" +
+		"2015-04-01 10:00:00;21,5;100\n" +
+		"2015-04-01 10:00:10;21,7;\n" +
+		"2015-04-01 10:00:05;22,0;90\n" +  // not increasing
+		"bad time;22,1;90\n" +
+		"2015-04-01 10:00:20;warm;80\n" +
+		"2015-04-01 10:00:30;22,4;70\n"
+	opts := &ImportOpts{
+		Exp_id:       2,
+		Data:         data,
+		Header:       true,
+		DecimalComma: true,
+		TimeFormat:   "2006-01-02 15:04:05",
+		TimeZone:     "UTC",
+		Columns:      []ImportColumn{{Column: 1}, {Column: 2, Name: "lux"}},
+	}
+
+	var res ImportResult
+	err := lab.ImportData(opts, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rows != 3 || res.Rejected != 3 {
+		t.Errorf("got %d rows and %d rejected, want 3 and 3", res.Rows, res.Rejected)
+	}
+	if len(res.Errors) != 3 || res.Errors[0].Line != 4 || res.Errors[2].Line != 6 {
+		t.Errorf("wrong rejected rows: %+v", res.Errors)
+	}
+
+	var info MonitorInfo
+	err = lab.GetMonInfo(&res.UUID, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Active || info.StepMs != 10000 || info.Values[0].Name != "temperature" || info.Values[1].Name != "lux" {
+		t.Errorf("wrong imported monitor: %+v", info)
+	}
+
+	var rows []*SerData
+	err = lab.GetMonData(&MonFetchOpts{UUID: res.UUID}, &rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[1].Readings[0] != 21.7 || !math.IsNaN(rows[1].Readings[1]) ||
+		!rows[2].Time.Equal(time.Date(2015, 4, 1, 10, 0, 30, 0, time.UTC)) {
+		t.Errorf("wrong imported data: %v", rows)
+	}
+
+	opts.Data = "time;temperature;light\n"
+	err = lab.ImportData(opts, &res)
+	if err == nil {
+		t.Error("monitor without rows is imported")
+	}
+}
+
+func TestImportTime(t *testing.T) {
+	tests := []struct {
+		s      string
+		layout string
+		want   time.Time
+		err    bool
+	}{
+		{"1420070400", "unix", time.Unix(1420070400, 0), false},
+		{"1420070400.25", "unix", time.Unix(1420070400, 250000000), false},
+		{"1420070400123", "unixms", time.Unix(1420070400, 123000000), false},
+		{" 1420070400001 ", "unixms", time.Unix(1420070400, 1000000), false},
+		{"1420070400123.5", "unixms", time.Time{}, true},
+		{"2015-01-01T00:00:00.5Z", "", time.Date(2015, 1, 1, 0, 0, 0, 500000000, time.UTC), false},
+		{"2015-01-01 03:00:00", "2006-01-02 15:04:05", time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC), false},
+	}
+	loc := time.FixedZone("MSK", 3 * 3600)
+	for _, tt := range tests {
+		tm, err := importTime(tt.s, tt.layout, loc)
+		if (err != nil) != tt.err || !tm.Equal(tt.want) {
+			t.Errorf("importTime(%q, %q) = %v, %v, want %v", tt.s, tt.layout, tm, err, tt.want)
+		}
+	}
+}
+
+func TestGetMonDataPage(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	data := ""
+	for i := 0; i < 7; i++ {
+		data += fmt.Sprintf("%d,%d\n", 1420070400+i*10, i)
+	}
+	var res ImportResult
+	err := lab.ImportData(&ImportOpts{Data: data, TimeFormat: "unix", Columns: []ImportColumn{{Column: 1}}}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// raw rows by pages of 3
+	opts := &MonFetchOpts{UUID: res.UUID, Limit: 3}
+	rows := make([]*SerData, 0)
+	pages := 0
+	for {
+		var page MonDataPage
+		err = lab.GetMonDataPage(opts, &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		rows = append(rows, page.Rows...)
+		if page.Next == "" {
+			break
+		}
+		opts.Cursor = page.Next
+	}
+	if pages != 3 || len(rows) != 7 {
+		t.Fatalf("got %d rows in %d pages, want 7 in 3", len(rows), pages)
+	}
+	for i, row := range rows {
+		if row.Readings[0] != float64(i) {
+			t.Errorf("wrong row %d: %v", i, row)
+		}
+	}
+
+	// buckets of Step are not split between pages
+	opts = &MonFetchOpts{UUID: res.UUID, Limit: 2, Step: 20 * time.Second, Cf: "COUNT"}
+	var page MonDataPage
+	err = lab.GetMonDataPage(opts, &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Rows) != 2 || page.Rows[0].Readings[0] != 2 || page.Rows[1].Readings[0] != 2 ||
+		page.Next != time.Unix(1420070440, 0).UTC().Format(time.RFC3339Nano) {
+		t.Errorf("wrong page of buckets: %v, next %s", page.Rows, page.Next)
+	}
+
+	opts = &MonFetchOpts{UUID: res.UUID, Cursor: "yesterday"}
+	err = lab.GetMonDataPage(opts, &page)
+	if err == nil {
+		t.Error("wrong cursor is accepted")
+	}
+}
+
+func TestAlarms(t *testing.T) {
+	defer setupTest(t)()
+
+	posted := make(chan APIAlarm, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a APIAlarm
+		json.NewDecoder(r.Body).Decode(&a)
+		posted <- a
+	}))
+	defer srv.Close()
+	config.Alarm.URL = srv.URL
+	config.Alarm.Timeout = 5
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	high := 20.0
+	opts := &MonitorOpts{
+		Exp_id: 1,
+		StepMs: 100,
+		Values: []ValueId{{"test-file:0", 0}},
+		Alarms: []AlarmOpts{{Value: "wrong", High: &high}},
+	}
+	var u string
+	err := lab.StartMonitor(opts, &u)
+	if err == nil {
+		t.Fatal("alarm of wrong value is accepted")
+	}
+
+	opts.Alarms = nil
+	err = lab.StartMonitor(opts, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info MonitorInfo
+	err = lab.GetMonInfo(&u, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ok bool
+	set := &AlarmSetOpts{UUID: u, Alarms: []AlarmOpts{{Value: info.Values[0].Name, High: &high, Actions: []string{"log", "http"}}}}
+	err = lab.SetAlarms(set, &ok)
+	if err != nil || !ok {
+		t.Fatal(err)
+	}
+
+	// sensor reads 21.5
+	select {
+	case a := <-posted:
+		if a.UUID != u || a.State != ALARM_ALARM || a.Cause != ALARM_HIGH || a.Reading == nil || *a.Reading != 21.5 {
+			t.Errorf("wrong posted alarm: %+v", a)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("alarm is not posted")
+	}
+
+	var list []APIAlarm
+	lab.ListAlarms(0, &list)
+	if len(list) != 1 || list[0].State != ALARM_ALARM {
+		t.Errorf("wrong alarms: %+v", list)
+	}
+	saved, err := store.Alarms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Cause != ALARM_HIGH || *saved[0].High != high {
+		t.Errorf("wrong saved alarms: %+v", saved)
+	}
+
+	// hysteresis and stale readings
+	low := 10.0
+	a := &alarm{APIAlarm: APIAlarm{AlarmOpts: AlarmOpts{High: &high, Low: &low, Hysteresis: 1, Stale: 5}, State: ALARM_OK}}
+	tm := time.Now()
+	steps := []struct {
+		v     float64
+		cause string
+	}{
+		{15, ""}, {20.5, ALARM_HIGH}, {19.5, ALARM_HIGH}, {18.9, ""}, {9, ALARM_LOW},
+		{10.5, ALARM_LOW}, {math.NaN(), ALARM_LOW}, {11.5, ""}, {math.NaN(), ""},
+	}
+	for i, s := range steps {
+		tm = tm.Add(time.Second)
+		a.update(tm, s.v)
+		if a.Cause != s.cause {
+			t.Errorf("step %d: got cause %q, want %q", i, a.Cause, s.cause)
+		}
+	}
+	a.update(tm.Add(5 * time.Second), math.NaN())
+	if a.Cause != ALARM_STALE || a.State != ALARM_ALARM {
+		t.Errorf("got cause %q, want stale", a.Cause)
+	}
+
+	// actions of changes are run in order
+	for len(posted) > 0 {
+		<-posted
+	}
+	values := []MonValue{{Name: "v"}}
+	err = alarms.Set("order", []AlarmOpts{{Value: "v", High: &high, Actions: []string{"http"}}}, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm = time.Now()
+	for i := 0; i < 10; i++ {
+		v := 25.0
+		if i%2 == 1 {
+			v = 15
+		}
+		alarms.Check("order", tm.Add(time.Duration(i) * time.Second), values, []float64{v})
+	}
+	for i := 0; i < 10; i++ {
+		a := <-posted
+		want := ALARM_ALARM
+		if i%2 == 1 {
+			want = ALARM_OK
+		}
+		if a.State != want || !a.Since.Equal(tm.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("change %d is posted out of order: %+v", i, a)
+		}
+	}
+	alarms.Remove("order")
+}
+
+// failingAlarmStorage fails saving alarms.
+type failingAlarmStorage struct {
+	Storage
+}
+
+func (s failingAlarmStorage) SaveAlarm(a APIAlarm) error {
+	return errors.New("disk full")
+}
+
+func TestStartMonitorAlarmFailure(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	high := 20.0
+	opts := &MonitorOpts{
+		Exp_id: 1,
+		StepMs: 100,
+		Values: []ValueId{{"test-file:0", 0}},
+	}
+	mon, err := newMonitor(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Alarms = []AlarmOpts{{Value: mon.Values[0].Name, High: &high}}
+
+	ok := store
+	store = failingAlarmStorage{ok}
+	var u string
+	err = lab.StartMonitor(opts, &u)
+	store = ok
+	if err == nil {
+		t.Fatal("monitor is started without alarms")
+	}
+	ids, err := store.MonitorIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 || len(monitors.List()) != 0 {
+		t.Errorf("monitor failed to start is left: %v", ids)
+	}
+}
+
+func TestGetMonStats(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	data := "1420070400,2,10\n" +
+		"1420070410,4,\n" +
+		"1420070420,4,30\n" +
+		"1420070430,4,\n" +
+		"1420070440,5,\n" +
+		"1420070450,5,\n" +
+		"1420070460,7,\n" +
+		"1420070470,9,\n"
+	var res ImportResult
+	err := lab.ImportData(&ImportOpts{Data: data, TimeFormat: "unix", Columns: []ImportColumn{{Column: 1}, {Column: 2}}}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats MonStats
+	err = lab.GetMonStats(&MonStatsOpts{UUID: res.UUID}, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1420070400, 0)
+	v := stats.Values[0]
+	if v.Count != 8 || v.Errors != 0 || v.Min != 2 || !v.MinTime.Equal(start) ||
+		v.Max != 9 || !v.MaxTime.Equal(start.Add(70 * time.Second)) ||
+		v.Mean != 5 || v.StdDev != 2 || v.First != 2 || v.Last != 9 || v.Duration != 70 * time.Second {
+		t.Errorf("wrong stats: %+v", v)
+	}
+	v = stats.Values[1]
+	if v.Count != 2 || v.Errors != 6 || v.Mean != 20 || v.Last != 30 || v.Duration != 20 * time.Second {
+		t.Errorf("wrong stats: %+v", v)
+	}
+
+	err = lab.GetMonStats(&MonStatsOpts{UUID: res.UUID, Start: start.Add(10 * time.Second), Step: 40 * time.Second}, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Values[0].Count != 7 || len(stats.Buckets) != 2 ||
+		stats.Buckets[0].Values[0].Count != 3 || stats.Buckets[0].Values[0].Mean != 4 ||
+		stats.Buckets[1].Values[0].Count != 4 || stats.Buckets[1].Values[1].Count != 0 {
+		t.Errorf("wrong stats by buckets: %+v", stats)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	defer setupTest(t)()
+
+	config.SensorsTimeout = 200
+	file := pluggedSensors["test-file:0"].Values[0].File
+	err := ioutil.WriteFile(file, []byte("500\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pluggedSensors["test-err:0"] = &PluggedSensor{0, &Sensor{
+		"test",
+		[]Value{{
+			Name:       "missing",
+			Range:      DataRange{-100, 100},
+			File:       filepath.Join(filepath.Dir(file), "missing"),
+			Re:         regexp.MustCompile(".*"),
+			Multiplier: 1,
+		}, {
+			Name:       "slow",
+			Range:      DataRange{-100, 100},
+			Command:    "sleep 2; echo 1",
+			Re:         regexp.MustCompile(".*"),
+			Multiplier: 1,
+		}},
+		Device{FILE, 0, ""},
+	}}
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	var u string
+	err = lab.StartMonitor(&MonitorOpts{Exp_id: 1, StepMs: 500, Values: []ValueId{{"test-file:0", 0}, {"test-err:0", 0}, {"test-err:0", 1}}}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	var ok bool
+	err = lab.StopMonitor(&u, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []*SerData
+	err = lab.GetMonData(&MonFetchOpts{UUID: u}, &rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 {
+		t.Fatal("no rows")
+	}
+	want := []string{READ_RANGE, READ_IO, READ_TIMEOUT}
+	for _, row := range rows {
+		if len(row.Errors) != len(want) {
+			t.Fatalf("wrong errors of row: %v", row.Errors)
+		}
+		for i := range want {
+			if row.Errors[i] != want[i] || !math.IsNaN(row.Readings[i]) {
+				t.Errorf("got error %q of value %d, want %q", row.Errors[i], i, want[i])
+			}
+		}
+	}
+	b, err := json.Marshal(rows[0])
+	if err != nil || !strings.Contains(string(b), `"Errors":["range","io","timeout"]`) {
+		t.Errorf("wrong JSON of row: %s", b)
+	}
+
+	// Slow command is killed on timeout
+	deadline := time.Now().Add(time.Second)
+	for {
+		readsInFlight.mu.Lock()
+		n := len(readsInFlight.m)
+		readsInFlight.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slow reading is not killed on timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c := make(chan readResult, 1)
+	getSerData("unknown", 0, c)
+	if r := <-c; r.Cause != READ_MISSING {
+		t.Errorf("got cause %q of unknown sensor, want %q", r.Cause, READ_MISSING)
+	}
+
+	// Value which reading timed out and is still running is not read again
+	vid := ValueId{"test-file:0", 0}
+	readsInFlight.mu.Lock()
+	readsInFlight.m[vid] = &sensorRead{done: make(chan struct{}), timedOut: true}
+	readsInFlight.mu.Unlock()
+	getSerData("test-file:0", 0, c)
+	readsInFlight.mu.Lock()
+	delete(readsInFlight.m, vid)
+	readsInFlight.mu.Unlock()
+	if r := <-c; r.Cause != READ_TIMEOUT {
+		t.Errorf("got cause %q of value being read, want %q", r.Cause, READ_TIMEOUT)
+	}
+
+	// Reading of value being read is shared
+	config.SensorsTimeout = 2000
+	runs := filepath.Join(filepath.Dir(file), "runs")
+	pluggedSensors["test-shared:0"] = &PluggedSensor{0, &Sensor{
+		"test",
+		[]Value{{
+			Name:       "shared",
+			Range:      DataRange{-100, 100},
+			Command:    "echo run >> " + runs + "; sleep 0.3; echo 7",
+			Re:         regexp.MustCompile(".*"),
+			Multiplier: 1,
+		}},
+		Device{FILE, 0, ""},
+	}}
+	c2 := make(chan readResult, 1)
+	go getSerData("test-shared:0", 0, c)
+	time.Sleep(50 * time.Millisecond)
+	go getSerData("test-shared:0", 0, c2)
+	for _, r := range []readResult{<-c, <-c2} {
+		if r.Value != 7 || r.Cause != "" {
+			t.Errorf("got reading %+v of value being read, want shared reading 7", r)
+		}
+	}
+	b, err = ioutil.ReadFile(runs)
+	if err != nil || strings.Count(string(b), "run") != 1 {
+		t.Errorf("value being read is read again: %q, %v", b, err)
+	}
+}
+
+func TestDuplicateValues(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	values := []ValueId{{"test-file:0", 0}, {"test-file:0", 0}}
+	var u1, u2 string
+	err := lab.StartSeries(&SeriesOpts{Values: values, Period: 10 * time.Millisecond, Count: 20}, &u1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lab.StartSeries(&SeriesOpts{Values: values, Period: 10 * time.Millisecond, Count: 20}, &u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{u1, u2} {
+		<-*lab.series.m[u].finished
+		var chunk SeriesChunk
+		err = lab.GetSeriesSince(&SeriesCursorOpts{u, 0}, &chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk.Rows) != 20 {
+			t.Errorf("got %d rows, want 20", len(chunk.Rows))
+		}
+		for _, row := range chunk.Rows {
+			if row.Readings[0] != 21.5 || row.Readings[1] != 21.5 || len(row.Errors) != 0 {
+				t.Errorf("wrong row of duplicate values: %v %v", row.Readings, row.Errors)
+			}
+		}
+	}
+}
+
+func TestMonitorGaps(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	var u string
+	err := lab.StartMonitor(&MonitorOpts{Exp_id: 1, StepMs: 100, Values: []ValueId{{"test-file:0", 0}}}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ok bool
+	time.Sleep(350 * time.Millisecond)
+	lab.PauseMonitor(&u, &ok)
+	time.Sleep(300 * time.Millisecond)
+	lab.ResumeMonitor(&u, &ok)
+	time.Sleep(350 * time.Millisecond)
+
+	// daemon is down
+	mon, _ := monitors.Get(u)
+	mon.halt()
+	time.Sleep(500 * time.Millisecond)
+	monitors = newMonitorRegistry()
+	err = loadRunMonitors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(350 * time.Millisecond)
+	err = lab.StopMonitor(&u, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var info MonitorInfo
+	err = lab.GetMonInfo(&u, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ticks may be missed on slow test machine
+	gaps := make([]MonGap, 0)
+	for _, g := range info.Gaps {
+		if g.Cause != GAP_MISSED {
+			gaps = append(gaps, g)
+		}
+	}
+	if len(gaps) != 2 || gaps[0].Cause != GAP_PAUSED || gaps[1].Cause != GAP_DOWN ||
+		gaps[1].End.Sub(gaps[1].Start) < 300 * time.Millisecond {
+		t.Fatalf("wrong gaps: %+v", info.Gaps)
+	}
+
+	var rows []*SerData
+	err = lab.GetMonData(&MonFetchOpts{UUID: u, Gaps: true}, &rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	causes := make([]string, 0)
+	for _, row := range rows {
+		if row.Gap != "" && row.Gap != GAP_MISSED {
+			causes = append(causes, row.Gap)
+			if !math.IsNaN(row.Readings[0]) {
+				t.Errorf("gap row has reading: %v", row.Readings)
+			}
+		}
+	}
+	if len(causes) != 2 || causes[0] != GAP_PAUSED || causes[1] != GAP_DOWN {
+		t.Errorf("wrong gap rows: %v", causes)
+	}
+
+	// ticks are missed by slow readings
+	mon, _ = monitors.Get(u)
+	last := time.Now()
+	mon.addGap(last, last.Add(120 * time.Millisecond), 100 * time.Millisecond, GAP_MISSED)
+	mon.addGap(last, last.Add(300 * time.Millisecond), 100 * time.Millisecond, GAP_MISSED)
+	n := len(info.Gaps)
+	gaps, err = store.Gaps(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := gaps[len(gaps) - 1]
+	if len(gaps) != n + 1 || g.Cause != GAP_MISSED || !g.Start.Equal(last.Add(100 * time.Millisecond)) {
+		t.Errorf("wrong missed ticks gap: %+v", gaps)
+	}
+}
+
+// failingStorage fails writing detections.
+type failingStorage struct {
+	Storage
+}
+
+func (s failingStorage) AppendDetections(batch []MonitorRows, count bool) ([]MonCounters, error) {
+	return nil, errors.New("disk full")
+}
+
+func TestWriteQueue(t *testing.T) {
+	defer setupTest(t)()
+	saved := writes
+	writes = newWriteQueue()
+	defer func() { writes = saved }()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	var res ImportResult
+	err := lab.ImportData(&ImportOpts{Data: "1420070400,2\n1420070410,4\n", TimeFormat: "unix", Columns: []ImportColumn{{Column: 1}}}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon, _ := monitors.Get(res.UUID)
+
+	// Queued rows are read without being written
+	writes.pending = append(writes.pending,
+		writeItem{mon, &SerData{Time: time.Unix(1420070420, 0), Readings: []float64{6}}},
+		writeItem{mon, &SerData{Time: time.Unix(1420070430, 0), Readings: []float64{math.NaN()}}})
+	var data []*SerData
+	err = lab.GetMonData(&MonFetchOpts{UUID: res.UUID}, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4 || data[2].Readings[0] != 6 || data[3].readingError(0) != READ_NODATA {
+		t.Errorf("queued rows are not fetched: %v", data)
+	}
+	data = nil
+	err = lab.GetMonData(&MonFetchOpts{UUID: res.UUID, End: time.Unix(1420070420, 0)}, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 3 {
+		t.Errorf("expected 3 rows up to end, got %d", len(data))
+	}
+	var info MonitorInfo
+	err = lab.GetMonInfo(&res.UUID, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Archives[0].Len != 4 || info.Values[0].Len != 4 || info.Counters.Done != 4 || info.Counters.Err != 1 ||
+		!info.Last.Equal(time.Unix(1420070430, 0)) {
+		t.Errorf("queued rows are not counted: %+v", info)
+	}
+	var stats MonStats
+	err = lab.GetMonStats(&MonStatsOpts{UUID: res.UUID}, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Values[0].Count != 3 || stats.Values[0].Errors != 1 || stats.Values[0].Max != 6 {
+		t.Errorf("queued rows are not in stats: %+v", stats.Values[0])
+	}
+	if len(writes.pending) != 2 {
+		t.Errorf("reads flushed write queue")
+	}
+
+	// Failed rows are retried, then dropped
+	ok := store
+	store = failingStorage{ok}
+	if writes.Flush() == nil || len(writes.pending) != 2 {
+		t.Fatal("failed rows are not requeued")
+	}
+	store = ok
+	if err = writes.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(writes.pending) != 0 {
+		t.Errorf("queue is not flushed")
+	}
+	err = lab.GetMonInfo(&res.UUID, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Archives[0].Len != 4 || info.Counters.Done != 4 {
+		t.Errorf("rows are not written after retry: %+v", info)
+	}
+
+	writes.pending = append(writes.pending, writeItem{mon, &SerData{Time: time.Unix(1420070440, 0), Readings: []float64{8}}})
+	store = failingStorage{ok}
+	for i := 0; i <= WRITE_MAX_RETRIES; i++ {
+		writes.Flush()
+	}
+	store = ok
+	if len(writes.pending) != 0 {
+		t.Errorf("rows are not dropped after %d retries", WRITE_MAX_RETRIES)
+	}
+
+	// Queue is flushed while rows are read, flushed rows are read once
+	writes.pending = append(writes.pending,
+		writeItem{mon, &SerData{Time: time.Unix(1420070450, 0), Readings: []float64{10}}},
+		writeItem{mon, &SerData{Time: time.Unix(1420070460, 0), Readings: []float64{12}}})
+	flushed := false
+	data = nil
+	_, err = mon.Fetch(time.Time{}, time.Time{}, 0, "", func(row *SerData) error {
+		if !flushed {
+			flushed = true
+			done := make(chan error, 1)
+			go func() { done <- writes.Flush() }()
+			select {
+			case err := <-done:
+				if err != nil {
+					return err
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("write queue is not flushed while rows are read")
+			}
+		}
+		data = append(data, row)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 6 || data[5].Readings[0] != 12 {
+		t.Errorf("got %d rows read while queue is flushed, want 6", len(data))
+	}
+	data = nil
+	err = lab.GetMonData(&MonFetchOpts{UUID: res.UUID}, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lab.GetMonInfo(&res.UUID, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 6 || info.Archives[0].Len != 6 || info.Counters.Done != 6 {
+		t.Errorf("flushed rows are read twice: %d rows, info %+v", len(data), info)
+	}
+}
+
+func TestSaveSeries(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	var u string
+	err := lab.StartSeries(&SeriesOpts{Values: []ValueId{{"test-file:0", 0}}, Period: 10 * time.Millisecond, Count: 30}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Running series keeps being saved
+	var monUUID, again string
+	err = lab.SaveSeries(&SeriesSaveOpts{UUID: u, Exp_id: 1}, &monUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-*lab.series.m[u].finished
+	err = lab.SaveSeries(&SeriesSaveOpts{UUID: u, Exp_id: 1}, &again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != monUUID {
+		t.Errorf("series saved twice: %s and %s", monUUID, again)
+	}
+
+	var data []*SerData
+	err = lab.GetMonData(&MonFetchOpts{UUID: monUUID}, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 30 {
+		t.Errorf("expected 30 saved rows, got %d", len(data))
+	}
+	for i := 1; i < len(data); i++ {
+		if !data[i].Time.After(data[i-1].Time) {
+			t.Fatalf("saved rows are not ordered or duplicated at %d", i)
+		}
+	}
+	var info MonitorInfo
+	err = lab.GetMonInfo(&monUUID, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Counters.Done != 30 {
+		t.Errorf("expected 30 counted rows, got %d", info.Counters.Done)
+	}
+}
+
+func TestPersistSeries(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	b := newSerBuffer(4)
+	row := func(i int) *SerData {
+		return &SerData{Time: start.Add(time.Duration(i) * time.Second), Readings: []float64{float64(i)}}
+	}
+	for i := 0; i < 3; i++ {
+		b.Push(row(i))
+	}
+
+	// Rows pushed while buffer is saved overflow it and are saved after it
+	mon, err := b.Persist(func(rows []*SerData) (*Monitor, error) {
+		if len(rows) != 3 {
+			t.Errorf("got %d rows to save, want 3", len(rows))
+		}
+		mon, err := createSeriesMonitor(1, []ValueId{{"test-file:0", 0}}, time.Second, rows[0].Time)
+		if err != nil {
+			return nil, err
+		}
+		done := make(chan struct{})
+		go func() {
+			for i := 3; i < 13; i++ {
+				b.Push(row(i))
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("push is blocked while series is saved")
+		}
+		return mon, mon.Append(rows)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Push(row(13))
+	writes.Flush()
+
+	monUUID := mon.UUID.String()
+	var data []*SerData
+	err = lab.GetMonData(&MonFetchOpts{UUID: monUUID}, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 14 {
+		t.Fatalf("got %d saved rows, want 14", len(data))
+	}
+	for i, d := range data {
+		if !d.Time.Equal(row(i).Time) {
+			t.Fatalf("got saved row %d at %v, want %v", i, d.Time, row(i).Time)
+		}
+	}
+	var info MonitorInfo
+	err = lab.GetMonInfo(&monUUID, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Counters.Done != 14 {
+		t.Errorf("got %d counted rows, want 14", info.Counters.Done)
+	}
+}
+
+func TestExpireSeries(t *testing.T) {
+	defer setupTest(t)()
+	config.Series.TTL = 60
+	config.Series.IdleTTL = 120
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	defer func() {
+		lab.series.mu.Lock()
+		for k := range lab.series.m {
+			lab.removeSeries(k)
+		}
+		lab.series.mu.Unlock()
+	}()
+	start := func(stopped bool) string {
+		var u string
+		err := lab.StartSeries(&SeriesOpts{Values: []ValueId{{"test-file:0", 0}}, Period: 100 * time.Millisecond, Count: 1000}, &u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stopped {
+			var ok bool
+			err = lab.StopSeries(&u, &ok)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return u
+	}
+	endedOld, endedNew := start(true), start(true)
+	idleOld, idleNew := start(false), start(false)
+	lab.series.m[endedOld].accessed = time.Now().Add(-61 * time.Second)
+	lab.series.m[idleOld].accessed = time.Now().Add(-121 * time.Second)
+	lab.series.m[idleNew].accessed = time.Now().Add(-61 * time.Second)
+	stop := *lab.series.m[idleOld].stop
+
+	var list []APISeriesRecord
+	err := lab.ListSeries(0, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for u, want := range map[string]bool{endedOld: false, endedNew: true, idleOld: false, idleNew: true} {
+		if _, ok := lab.series.m[u]; ok != want {
+			t.Errorf("series %s is kept: %v, want %v", u, ok, want)
+		}
+	}
+	if len(list) != 2 {
+		t.Errorf("got %d listed series, want 2", len(list))
+	}
+	select {
+	case stop <- 1:
+		t.Error("expired running series is not stopped")
+	default:
+	}
+
+	// Full pool drops ended series before running one
+	config.Series.Pool = 2
+	u := start(false)
+	for u, want := range map[string]bool{endedNew: false, idleNew: true, u: true} {
+		if _, ok := lab.series.m[u]; ok != want {
+			t.Errorf("series %s is kept in full pool: %v, want %v", u, ok, want)
+		}
+	}
+}
+
+func TestConcurrentResume(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	var u string
+	err := lab.StartMonitor(&MonitorOpts{Exp_id: 1, StepMs: 100, Values: []ValueId{{"test-file:0", 0}}}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ok bool
+	err = lab.PauseMonitor(&u, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	resumed := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var ok bool
+			if lab.ResumeMonitor(&u, &ok) == nil {
+				mu.Lock()
+				resumed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if resumed != 1 {
+		t.Errorf("monitor resumed %d times", resumed)
+	}
+	err = lab.StopMonitor(&u, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingChangeStorage fails saving changes of monitors.
+type failingChangeStorage struct {
+	Storage
+}
+
+func (s failingChangeStorage) ChangeMonitor(monDBi *MonitorDBItem, changes []MonChange) error {
+	return errors.New("disk full")
+}
+
+func TestUpdateMonitorValues(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	var u string
+	err := lab.StartMonitor(&MonitorOpts{Exp_id: 1, Step: 1, Values: []ValueId{{"test-file:0", 0}, {"test-file:0", 0}}}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info MonitorInfo
+	err = lab.GetMonInfo(&u, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := info.Values[0].Name
+
+	// Change is not applied if it is not saved
+	ok := store
+	store = failingChangeStorage{ok}
+	var updated bool
+	step := uint(2)
+	err = lab.UpdateMonitor(&MonUpdateOpts{UUID: u, Step: &step}, &updated)
+	store = ok
+	if err == nil {
+		t.Fatal("failed change is applied")
+	}
+	err = lab.GetMonInfo(&u, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Step != 1 || len(info.Changes) != 0 || !info.Active {
+		t.Errorf("monitor is changed by failed change: %+v", info)
+	}
+
+	err = lab.UpdateMonitor(&MonUpdateOpts{UUID: u, RemoveValues: []string{first, first}}, &updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lab.GetMonInfo(&u, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Values) != 1 || info.Values[0].Name == first || len(info.Changes) != 2 {
+		t.Errorf("wrong monitor after removing value: %+v", info)
+	}
+}
+
+// testRows returns rows of single value with readings vals
+// made each second since start.
+func testRows(start time.Time, vals ...float64) []*SerData {
+	rows := make([]*SerData, len(vals))
+	for i, v := range vals {
+		rows[i] = &SerData{Time: start.Add(time.Duration(i) * time.Second), Readings: []float64{v}}
+	}
+	return rows
+}
+
+func readingsOf(rows []*SerData) []float64 {
+	vals := make([]float64, len(rows))
+	for i, row := range rows {
+		vals[i] = row.Readings[0]
+	}
+	return vals
+}
+
+// sameReadings compares readings, NaN equals NaN.
+func sameReadings(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestConsolidate(t *testing.T) {
+	start := time.Unix(1420070400, 0)
+	nan := math.NaN()
+	weighted := testRows(start, 10, 20)
+	weighted[0].counts = []uint{3}
+	weighted[1].counts = []uint{1}
+	tests := []struct {
+		name string
+		rows []*SerData
+		step time.Duration
+		cf   string
+		want []float64
+	}{
+		{"average", testRows(start, 1, 2, 3, nan, 5, 7), 2 * time.Second, "AVERAGE", []float64{1.5, 3, 6}},
+		{"min", testRows(start, 4, 2, 3, 1), 2 * time.Second, "MIN", []float64{2, 1}},
+		{"max", testRows(start, 4, 2, 3, 1), 2 * time.Second, "MAX", []float64{4, 3}},
+		{"last", testRows(start, 4, 2, 3, nan), 2 * time.Second, "LAST", []float64{2, 3}},
+		{"count", testRows(start, 4, nan, nan, nan), 2 * time.Second, "COUNT", []float64{1, 0}},
+		{"sum", testRows(start, 4, 2, 3, 1), 4 * time.Second, "SUM", []float64{10}},
+		{"empty bucket", testRows(start, nan, nan, 1), 2 * time.Second, "AVERAGE", []float64{nan, 1}},
+		{"weighted average", weighted, 2 * time.Second, "AVERAGE", []float64{12.5}},
+		{"no rows", nil, time.Second, "AVERAGE", []float64{}},
+	}
+	for _, tt := range tests {
+		got := consolidate(tt.rows, tt.step, tt.cf)
+		if !sameReadings(readingsOf(got), tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, readingsOf(got), tt.want)
+		}
+	}
+}
+
+func TestLttb(t *testing.T) {
+	start := time.Unix(1420070400, 0)
+	nan := math.NaN()
+	tests := []struct {
+		name      string
+		vals      []float64
+		threshold int
+		want      []int
+	}{
+		{"threshold above length", []float64{1, 2, 3}, 5, []int{0, 1, 2}},
+		{"peak is kept", []float64{0, 0, 9, 0, 0, 0, 0}, 3, []int{0, 2, 6}},
+		{"valley is kept", []float64{5, 5, 5, 5, -9, 5, 5}, 3, []int{0, 4, 6}},
+		{"NaN is skipped", []float64{0, nan, 1, 0, 0}, 3, []int{0, 2, 4}},
+		{"bucket of NaN", []float64{0, nan, nan, nan, 4, 5, 6, 0}, 4, []int{0, 6, 7}},
+	}
+	for _, tt := range tests {
+		got := lttb(testRows(start, tt.vals...), 0, tt.threshold)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	start := time.Unix(1420070400, 0)
+	rows := testRows(start, 0, 1, 8, 1, 0, 1, -7, 1, 0, 1)
+	tests := []struct {
+		name      string
+		maxPoints uint
+		want      []float64
+	}{
+		{"unlimited", 0, readingsOf(rows)},
+		{"enough points", 10, readingsOf(rows)},
+		{"extremes are kept", 4, []float64{0, 8, -7, 1}},
+	}
+	for _, tt := range tests {
+		got := downsample(rows, tt.maxPoints)
+		if !sameReadings(readingsOf(got), tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, readingsOf(got), tt.want)
+		}
+	}
+
+	// points of each value are selected
+	two := testRows(start, 0, 9, 0, 0, 0, 0, 0, 0)
+	for i, row := range two {
+		row.Readings = append(row.Readings, 0)
+		if i == 5 {
+			row.Readings[1] = 9
+		}
+	}
+	got := downsample(two, 6)
+	if len(got) != 4 || got[1].Readings[0] != 9 || got[2].Readings[1] != 9 {
+		t.Errorf("got %d rows, want rows of peaks of both values", len(got))
+	}
+}
+
+func TestRetention(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	now := time.Now().Unix()
+	data := ""
+	for _, row := range []struct {
+		tm    int64
+		value string
+	}{
+		{now - 3 * 86400, "1"},
+		{now - 3 * 86400 + 10, ""},
+		{now - 20, "2"},
+		{now - 10, ""},
+		{now, "3"},
+	} {
+		data += fmt.Sprintf("%d,%s\n", row.tm, row.value)
+	}
+	var res ImportResult
+	err := lab.ImportData(&ImportOpts{Exp_id: 1, Data: data, TimeFormat: "unix", Columns: []ImportColumn{{Column: 1}}}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Retention.MaxAge = 86400
+	config.Retention.Action = RETENTION_DOWNSAMPLE
+	r, err := retentionPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// monitor has no archives to keep
+	if len(r.Actions) != 1 || r.Actions[0].UUID != res.UUID || r.Actions[0].Rows != 2 ||
+		r.Actions[0].Action != RETENTION_DELETE {
+		t.Fatalf("wrong retention plan: %+v", r.Actions)
+	}
+	err = applyRetention(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var info MonitorInfo
+	err = lab.GetMonInfo(&res.UUID, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MonCounters{3, 1}
+	if info.Counters != want {
+		t.Errorf("got counters %+v after retention, want %+v", info.Counters, want)
+	}
+	mon, _ := monitors.Get(res.UUID)
+	if mon.Counters != want {
+		t.Errorf("got monitor counters %+v after retention, want %+v", mon.Counters, want)
+	}
+	var rows []*SerData
+	err = lab.GetMonData(&MonFetchOpts{UUID: res.UUID}, &rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0].Readings[0] != 2 {
+		t.Errorf("wrong data after retention: %v", rows)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	defer setupTest(t)()
+
+	period := 20 * time.Millisecond
+	sm := newSampler(period)
+	stop := make(chan int, 1)
+	sched, ok := sm.wait(stop)
+	if !ok || !sched.Equal(sm.start) || time.Now().Before(sched) {
+		t.Fatalf("wrong first tick %v of sampler started at %v", sched, sm.start)
+	}
+
+	// slow reading skips ticks
+	time.Sleep(3 * period + period / 2)
+	sched, ok = sm.wait(stop)
+	if !ok || sched.Sub(sm.start) % period != 0 || sm.Status().Missed < 2 {
+		t.Errorf("wrong tick %v after slow reading, status %+v", sched, sm.Status())
+	}
+
+	stop <- 1
+	_, ok = sm.wait(stop)
+	if ok {
+		t.Error("sampler is not stopped")
+	}
+
+	sm = newSampler(period)
+	sm.done(sched, sched.Add(period / 8))
+	sm.done(sched, sched.Add(period / 2))
+	sm.done(sched, sched.Add(period / 4))
+	want := SeriesStatus{Done: 3, Late: 1, MaxLag: period / 2, Drift: period / 4}
+	if sm.Status() != want {
+		t.Errorf("got status %+v, want %+v", sm.Status(), want)
+	}
+
+	// lag includes time of reading
+	pluggedSensors["test-slow:0"] = &PluggedSensor{0, &Sensor{
+		"test",
+		[]Value{{
+			Name:       "slow",
+			Range:      DataRange{-100, 100},
+			Command:    "sleep 0.1; echo 1",
+			Re:         regexp.MustCompile(".*"),
+			Multiplier: 1,
+		}},
+		Device{FILE, 0, ""},
+	}}
+	_, _, finished, sm, err := startSeries("test-slow", []ValueId{{"test-slow:0", 0}}, 200 * time.Millisecond, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-finished
+	st := sm.Status()
+	if st.Done != 2 || st.Late != 2 || st.Drift < 100 * time.Millisecond {
+		t.Errorf("wrong status of series with slow reading: %+v", st)
+	}
+}
+
+func TestGetSeriesCursors(t *testing.T) {
+	defer setupTest(t)()
+
+	series := &seriesPool{m: make(map[string]*SeriesRecord)}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn1, conn2 := newAPIConn(c1), newAPIConn(c2)
+	lab1, lab2 := &Lab{series: series, conn: conn1}, &Lab{series: series, conn: conn2}
+
+	var u string
+	err := lab1.StartSeries(&SeriesOpts{Values: []ValueId{{"test-file:0", 0}}, Period: 10 * time.Millisecond, Count: 5}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-*series.m[u].finished
+
+	var data []*SerData
+	for _, tt := range []struct {
+		lab  *Lab
+		want int
+	}{
+		{lab1, 5},
+		{lab1, 0},
+		{lab2, 5},  // rows are not taken by other connection
+		{lab2, 0},
+	} {
+		err = tt.lab.GetSeries(&u, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != tt.want {
+			t.Errorf("got %d rows of series, want %d", len(data), tt.want)
+		}
+	}
+
+	// cursor of closed connection is forgotten
+	series.closeConn(conn1)
+	err = lab1.GetSeries(&u, &data)
+	if err != nil || len(data) != 5 {
+		t.Errorf("got %d rows of series after closing connection, want 5: %v", len(data), err)
+	}
+}
+
+func TestTriggerFired(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		mode string
+		edge string
+		prev float64
+		v    float64
+		want bool
+	}{
+		{"level", "rising", nan, 5, true},
+		{"level", "rising", nan, 4.9, false},
+		{"level", "falling", nan, 5, true},
+		{"level", "falling", nan, 5.1, false},
+		{"level", "any", nan, 4, true},
+		{"level", "rising", nan, nan, false},
+		{"edge", "rising", 4, 5, true},
+		{"edge", "rising", 5, 6, false},  // already above level
+		{"edge", "rising", 6, 4, false},
+		{"edge", "rising", nan, 6, false},  // no previous sample
+		{"edge", "falling", 6, 5, true},
+		{"edge", "falling", 4, 6, false},
+		{"edge", "any", 4, 6, true},
+		{"edge", "any", 6, 4, true},
+		{"edge", "any", 4, nan, false},
+		{"manual", "rising", 4, 6, false},
+	}
+	config.Series.Buffer = 10
+	for _, tt := range tests {
+		tr, err := newTrigger(&TriggerOpts{Mode: tt.mode, Edge: tt.edge, Level: 5}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.prev = tt.prev
+		cause, ok := tr.fired(tt.v)
+		if ok != tt.want || (ok && cause != tt.mode) {
+			t.Errorf("%s %s trigger from %v to %v: got %q, %v, want %v", tt.edge, tt.mode, tt.prev, tt.v, cause, ok, tt.want)
+		}
+	}
+}
+
+func TestTriggerCapture(t *testing.T) {
+	config.Series.Buffer = 10
+	start := time.Date(2016, 8, 15, 13, 0, 0, 0, time.UTC)
+	tests := []struct {
+		opts   TriggerOpts
+		vals   []float64
+		manual int  // index of sample after manual fire, -1 for none
+		done   int  // index of sample completing capture, -1 if not complete
+		cause  string
+		pre    uint
+		rows   []float64
+	}{
+		{TriggerOpts{Mode: "level", Level: 5, Pre: 2, Post: 2}, []float64{1, 2, 3, 6, 7, 8, 9}, -1, 5, "level", 2, []float64{2, 3, 6, 7, 8}},
+		{TriggerOpts{Mode: "level", Level: 5, Pre: 3, Post: 1}, []float64{1, 6, 7}, -1, 2, "level", 1, []float64{1, 6, 7}},
+		{TriggerOpts{Mode: "edge", Level: 5, Post: 0}, []float64{6, 7, 4, 5, 6}, -1, 3, "edge", 0, []float64{5}},
+		{TriggerOpts{Mode: "edge", Edge: "falling", Level: 5, Pre: 1, Post: 3}, []float64{6, 4, 3}, -1, -1, "edge", 1, []float64{6, 4, 3}},
+		{TriggerOpts{Mode: "manual", Pre: 1, Post: 1}, []float64{1, 2, 3, 4}, 2, 3, "manual", 1, []float64{2, 3, 4}},
+	}
+	for i, tt := range tests {
+		tr, err := newTrigger(&tt.opts, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := -1
+		for j, row := range testRows(start, tt.vals...) {
+			if j == tt.manual && !tr.Fire() {
+				t.Errorf("%d: armed trigger is not fired", i)
+			}
+			if tr.add(row) && done < 0 {
+				done = j
+			}
+		}
+		c := tr.Capture()
+		state := TRIGGER_CAPTURED
+		if tt.done < 0 {
+			state = TRIGGER_TRIGGERED
+		}
+		if done != tt.done || c.State != state || c.Cause != tt.cause || c.Pre != tt.pre ||
+			!sameReadings(readingsOf(c.Rows), tt.rows) {
+			t.Errorf("%d: got capture %s %s of %d pre and %v completed at %d, want %s %s of %d pre and %v completed at %d",
+				i, c.State, c.Cause, c.Pre, readingsOf(c.Rows), done, state, tt.cause, tt.pre, tt.rows, tt.done)
+		}
+		if tr.Fire() {
+			t.Errorf("%d: fired trigger is fired again", i)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	for _, spec := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+	} {
+		_, err := parseCron(spec)
+		if err == nil {
+			t.Errorf("wrong schedule '%s' is parsed", spec)
+		}
+	}
+
+	c, err := parseCron("1,5-7,*/20 * * * 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	minutes := make([]int, 0)
+	for m, ok := range c.minute {
+		if ok {
+			minutes = append(minutes, m)
+		}
+	}
+	if fmt.Sprint(minutes) != "[0 1 5 6 7 20 40]" {
+		t.Errorf("got minutes %v", minutes)
+	}
+	if !c.dow[0] || c.dow[1] || c.anyDow || !c.anyDom {
+		t.Errorf("wrong days of week %v", c.dow)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		spec string
+		from string
+		want string  // empty if there is no next time
+	}{
+		{"* * * * *", "2016-08-15 10:00:30", "2016-08-15 10:01:00"},
+		{"0 * * * *", "2016-08-15 10:00:00", "2016-08-15 11:00:00"},
+		{"*/15 9-10 * * *", "2016-08-15 10:50:00", "2016-08-16 09:00:00"},
+		{"30 6 * * 1-5", "2016-08-20 12:00:00", "2016-08-22 06:30:00"},  // Saturday to Monday
+		{"0 12 * * 7", "2016-08-15 12:00:00", "2016-08-21 12:00:00"},   // 7 is Sunday
+		{"0 0 1 * 0", "2016-08-15 00:00:00", "2016-08-21 00:00:00"},   // 1st day or Sunday
+		{"0 0 1 * *", "2016-08-15 00:00:00", "2016-09-01 00:00:00"},
+		{"59 23 31 12 *", "2016-12-31 23:59:00", "2017-12-31 23:59:00"},
+		{"0 0 29 2 *", "2017-01-01 00:00:00", "2020-02-29 00:00:00"},
+		{"0 0 31 2 *", "2016-08-15 00:00:00", ""},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want time.Time
+		if tt.want != "" {
+			want = at(tt.want)
+		}
+		if got := c.Next(at(tt.from)); !got.Equal(want) {
+			t.Errorf("next time of '%s' after %s: got %v, want %v", tt.spec, tt.from, got, want)
+		}
+	}
+}
+
+func TestArchiveTimeLayout(t *testing.T) {
+	defer setupTest(t)()
+	// times are compared as text stored in mysql layout
+	layout := dbTimeLayout
+	dbTimeLayout = RFC3339Nano_Fixed
+	defer func() { dbTimeLayout = layout }()
+
+	config.Monitor.Archives = []uint{10}
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	start := time.Unix(1420070400, 0).UTC()
+	data := ""
+	for i := 0; i < 8; i++ {
+		data += fmt.Sprintf("%d,%d\n", start.Unix() + int64(i) * 5, i)
+	}
+	var res ImportResult
+	err := lab.ImportData(&ImportOpts{Exp_id: 1, Data: data, TimeFormat: "unix", Columns: []ImportColumn{{Column: 1}}}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon, _ := monitors.Get(res.UUID)
+	monDBi, err := monitorToDB(mon)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buckets := func(from, to time.Time) uint {
+		var n uint
+		err := db.QueryRow("SELECT COUNT(*) FROM detections_archives WHERE mon_id = ? AND time BETWEEN ? AND ?",
+			monDBi.Id, from.Format(dbTimeLayout), to.Format(dbTimeLayout)).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := buckets(start.Add(10 * time.Second), start.Add(20 * time.Second)); n != 2 {
+		t.Errorf("got %d archive buckets from 10 to 20 s, want 2", n)
+	}
+
+	rows := make([]*ArchiveRow, 0)
+	err = store.ScanArchive(monDBi.Id, 10, start.Add(10 * time.Second), start.Add(20 * time.Second), func(a *ArchiveRow) error {
+		rows = append(rows, a)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || !rows[0].Time.Equal(start.Add(10 * time.Second)) || rows[1].Cnt != 2 {
+		t.Errorf("wrong archive range: %+v", rows)
+	}
+
+	_, err = store.DeleteDetections(monDBi, start.Add(20 * time.Second), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := buckets(start, start.Add(30 * time.Second)); n != 2 {
+		t.Errorf("got %d archive buckets after removing old data, want 2", n)
+	}
+}
+
+func TestAggregatedGaps(t *testing.T) {
+	defer setupTest(t)()
+
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}}
+	start := time.Unix(1420070400, 0)
+	data := ""
+	for i := 0; i < 30; i++ {
+		if i < 10 || i >= 20 {
+			data += fmt.Sprintf("%d,%d\n", start.Unix() + int64(i), i)
+		}
+	}
+	var res ImportResult
+	err := lab.ImportData(&ImportOpts{Data: data, TimeFormat: "unix", StepMs: 1000, Columns: []ImportColumn{{Column: 1}}}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.AddGap(res.UUID, MonGap{start.Add(10 * time.Second), start.Add(20 * time.Second), GAP_PAUSED})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gapsOf := func(rows []*SerData) []int {
+		idx := make([]int, 0)
+		for i, row := range rows {
+			if row.Gap != "" {
+				if row.Gap != GAP_PAUSED || !row.Time.Equal(start.Add(10 * time.Second)) || !math.IsNaN(row.Readings[0]) {
+					t.Errorf("wrong gap row: %+v", row)
+				}
+				idx = append(idx, i)
+			}
+		}
+		return idx
+	}
+	tests := []struct {
+		name string
+		opts MonFetchOpts
+		rows int
+		gap  int  // index of gap row
+	}{
+		{"step", MonFetchOpts{Step: 5 * time.Second}, 5, 2},
+		{"max points", MonFetchOpts{MaxPoints: 6}, 7, 3},
+		{"step and max points", MonFetchOpts{Step: 2 * time.Second, MaxPoints: 6}, 7, 3},
+	}
+	for _, tt := range tests {
+		tt.opts.UUID = res.UUID
+		tt.opts.Gaps = true
+		var rows []*SerData
+		err = lab.GetMonData(&tt.opts, &rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gaps := gapsOf(rows)
+		if len(rows) != tt.rows || len(gaps) != 1 || gaps[0] != tt.gap {
+			t.Errorf("%s: got %d rows with gaps at %v, want %d rows with gap at %d", tt.name, len(rows), gaps, tt.rows, tt.gap)
+		}
+	}
+
+	// gap before the next page ends page
+	var page MonDataPage
+	err = lab.GetMonDataPage(&MonFetchOpts{UUID: res.UUID, Step: 5 * time.Second, Limit: 2, Gaps: true}, &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Rows) != 3 || page.Rows[2].Gap != GAP_PAUSED || page.Next != start.Add(20 * time.Second).UTC().Format(time.RFC3339Nano) {
+		t.Errorf("wrong page with gap: %d rows, next %s", len(page.Rows), page.Next)
+	}
+}
+
+// readNotification reads JSON-RPC notification line sent to connection.
+func readNotification(t *testing.T, r *bufio.Reader) (string, map[string]interface{}) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n map[string]json.RawMessage
+	err = json.Unmarshal(line, &n)
+	if err != nil {
+		t.Fatalf("wrong notification %q: %v", line, err)
+	}
+	var method string
+	var params []map[string]interface{}
+	_, hasId := n["id"]
+	if string(n["jsonrpc"]) != `"2.0"` || hasId || json.Unmarshal(n["method"], &method) != nil ||
+		json.Unmarshal(n["params"], &params) != nil || len(params) != 1 {
+		t.Fatalf("wrong notification %q", line)
+	}
+	return method, params[0]
+}
+
+func TestStreams(t *testing.T) {
+	defer setupTest(t)()
+	config.Stream.Buffer = 2
+
+	pipe := func() (*apiConn, *bufio.Reader, net.Conn) {
+		server, client := net.Pipe()
+		return newAPIConn(server), bufio.NewReader(client), client
+	}
+	conn1, r1, c1 := pipe()
+	defer c1.Close()
+	conn2, r2, c2 := pipe()
+	defer c2.Close()
+
+	// rows are sent to every subscriber, slow one loses the oldest rows
+	id1 := streams.Subscribe("test-source", conn1)
+	id2 := streams.Subscribe("test-source", conn2)
+	for i := 0; i < 10; i++ {
+		streams.Publish("test-source", &SerData{Readings: []float64{float64(i)}})
+		method, p := readNotification(t, r1)
+		data, _ := p["Data"].(map[string]interface{})
+		if method != "Lab.StreamData" || p["Subscription"] != id1 || p["UUID"] != "test-source" ||
+			data == nil || fmt.Sprint(data["Readings"]) != fmt.Sprintf("[%d]", i) {
+			t.Fatalf("wrong notification of row %d: %s %v", i, method, p)
+		}
+	}
+	streams.Close("test-source")
+	if method, p := readNotification(t, r1); method != "Lab.StreamEnd" || p["Subscription"] != id1 || p["UUID"] != "test-source" {
+		t.Errorf("wrong end of stream: %s %v", method, p)
+	}
+	rows := 0
+	for {
+		method, p := readNotification(t, r2)
+		if method == "Lab.StreamEnd" {
+			if p["Subscription"] != id2 {
+				t.Errorf("wrong end of stream of slow subscriber: %v", p)
+			}
+			break
+		}
+		rows++
+		if data, _ := p["Data"].(map[string]interface{}); rows > 3 || (rows == 3 && fmt.Sprint(data["Readings"]) != "[9]") {
+			t.Fatalf("slow subscriber got row %d: %v", rows, p)
+		}
+	}
+
+	// subscriber is dropped when client does not receive rows
+	conn3, _, c3 := pipe()
+	id3 := streams.Subscribe("test-source", conn3)
+	c3.Close()
+	streams.Publish("test-source", &SerData{Readings: []float64{1}})
+	deadline := time.Now().Add(time.Second)
+	for streams.Owner(id3) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber of closed connection is not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// subscriptions of closed connection are removed
+	id4 := streams.Subscribe("test-source", conn1)
+	id5 := streams.Subscribe("test-other", conn1)
+	id6 := streams.Subscribe("test-other", conn2)
+	streams.CloseConn(conn1)
+	if streams.Owner(id4) != nil || streams.Owner(id5) != nil || streams.Owner(id6) != conn2 || streams.Unsubscribe(id4) {
+		t.Error("subscriptions of closed connection are not removed")
+	}
+	streams.mu.Lock()
+	_, found := streams.sources["test-source"]
+	streams.mu.Unlock()
+	if found {
+		t.Error("source without subscribers is kept")
+	}
+	streams.Unsubscribe(id6)
+
+	// series data are streamed to API client until series end
+	lab := &Lab{series: &seriesPool{m: make(map[string]*SeriesRecord)}, conn: conn2}
+	var u, id string
+	err := lab.StartSeries(&SeriesOpts{Values: []ValueId{{"test-file:0", 0}}, Period: 50 * time.Millisecond, Count: 3}, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lab.Subscribe(&SubscribeOpts{u}, &id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows = 0
+	for {
+		method, p := readNotification(t, r2)
+		if p["Subscription"] != id || p["UUID"] != u {
+			t.Fatalf("wrong notification of series: %v", p)
+		}
+		if method == "Lab.StreamEnd" {
+			break
+		}
+		rows++
+		if data, _ := p["Data"].(map[string]interface{}); method != "Lab.StreamData" || fmt.Sprint(data["Readings"]) != "[21.5]" {
+			t.Fatalf("wrong series data notification: %s %v", method, p)
+		}
+	}
+	if rows == 0 || rows > 3 {
+		t.Errorf("got %d rows of series stream, want up to 3", rows)
+	}
+}
+
+func TestSensorsTimeoutConfig(t *testing.T) {
+	defer setupTest(t)()
+	defer func(c Config) { config = c }(config)
+
+	dir := filepath.Dir(config.Export.Path)
+	for _, tt := range []struct {
+		yml  string
+		want uint
+	}{
+		{"log: /dev/null\n", 5000},
+		{"sensorstimeout: 0\n", 0},
+		{"sensorstimeout: 200\n", 200},
+	} {
+		path := filepath.Join(dir, "sdlab.conf")
+		err := ioutil.WriteFile(path, []byte(tt.yml), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config = Config{}
+		err = loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.SensorsTimeout != tt.want {
+			t.Errorf("got sensors timeout %d of config %q, want %d", config.SensorsTimeout, tt.yml, tt.want)
+		}
+		ctx, cancel := sensorContext()
+		_, hasDeadline := ctx.Deadline()
+		cancel()
+		if hasDeadline != (tt.want != 0) {
+			t.Errorf("sensor reading of config %q has deadline: %v", tt.yml, hasDeadline)
+		}
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	defer setupTest(t)()
+	defer func(d *sql.DB) { db = d }(db)
+
+	var err error
+	path := filepath.Join(filepath.Dir(config.Export.Path), "old.db")
+	db, err = initDB(DatabaseConf{Type: "sqlite", Dsn: "file:" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Database of schema version 2 with data
+	sch := schemas["sqlite"]
+	_, err = db.Exec(sch.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range sch.Migrations[:2] {
+		err = applyMigration(sch, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, query := range []string{
+		"INSERT INTO monitors (uuid, exp_id, interval, created, stopat, active) VALUES ('old', 1, 10, 'c', 's', 1);",
+		"INSERT INTO monitors_counters (uuid, done, err) VALUES ('old', 2, 1);",
+		"INSERT INTO detections (exp_id, mon_id, time, sensor_id, sensor_val_id, detection) VALUES (1, 1, 't1', 'test-file:0', 0, 21.5), (1, 1, 't2', 'test-file:0', 0, 22.5);",
+	} {
+		_, err = db.Exec(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last := sch.Migrations[len(sch.Migrations)-1].Version
+	pending, err := migrateDB("sqlite", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(sch.Migrations)-2 || pending[0].Version != 3 {
+		t.Fatalf("got %d pending migrations of version 2 database, want %d since version 3", len(pending), len(sch.Migrations)-2)
+	}
+	if version, _ := schemaVersion(sch); version != 2 {
+		t.Fatalf("dry run changed schema version to %d", version)
+	}
+
+	_, err = migrateDB("sqlite", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := schemaVersion(sch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != last {
+		t.Errorf("got schema version %d after migration, want %d", version, last)
+	}
+
+	// Rows are kept, added columns get defaults
+	var interval, intervalMs, paused, done int
+	err = db.QueryRow("SELECT interval, interval_ms, paused FROM monitors WHERE uuid = 'old';").Scan(&interval, &intervalMs, &paused)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval != 10 || intervalMs != 0 || paused != 0 {
+		t.Errorf("got monitor interval %d, interval_ms %d, paused %d, want 10, 0, 0", interval, intervalMs, paused)
+	}
+	err = db.QueryRow("SELECT done FROM monitors_counters WHERE uuid = 'old';").Scan(&done)
+	if err != nil || done != 2 {
+		t.Errorf("got monitor counter %d (%v), want 2", done, err)
+	}
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM detections WHERE mon_id = 1;").Scan(&n)
+	if err != nil || n != 2 {
+		t.Errorf("got %d detections (%v), want 2", n, err)
+	}
+
+	pending, err = migrateDB("sqlite", false)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("got %d pending migrations (%v) of migrated database, want none", len(pending), err)
+	}
+}
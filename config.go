@@ -52,27 +52,70 @@ type I2CConf struct {
 }
 
 type SeriesConf struct {
+	Buffer  uint
+	Pool    uint
+	TTL     uint  // seconds to keep ended series since last access, 0 to keep forever
+	IdleTTL uint  // seconds to keep running series since last access, 0 to keep forever
+}
+
+type StreamConf struct {
 	Buffer uint
-	Pool   uint
 }
 
 type MonitorConf struct {
-	Path string
+	Path     string
+	Archives []uint  // default steps of consolidated archives, seconds
+}
+
+type ExportConf struct {
+	Path  string  // directory of exported files
+	Chunk uint    // max size of chunk of exported file, bytes
+	TTL   uint    // seconds to keep exported files, 0 to keep forever
+}
+
+type AlarmConf struct {
+	Script  string  // script run by "script" action of alarms
+	URL     string  // local HTTP endpoint for "http" action of alarms
+	Timeout uint    // seconds to wait for script or endpoint
+}
+
+type RetentionConf struct {
+	MaxAge      uint            // seconds to keep detections, 0 to keep forever
+	Experiments map[int]uint    // max age of detections by experiment id
+	Monitors    map[string]uint // max age of detections by monitor uuid
+	MaxSize     uint            // max used database size, megabytes
+	MinFree     uint            // min free space for database, megabytes
+	Action      string          // "delete" (default) or "downsample"
+	Interval    uint            // seconds between retention runs
+}
+
+type BatchConf struct {
+	Latency uint  // max time detections wait to be written, milliseconds
+	Rows    uint  // max number of detections waiting to be written
 }
 
 type DatabaseConf struct {
-	Type string
-	Dsn  string
+	Type        string
+	Dsn         string
+	Batch       BatchConf
+	MaxOpen     uint  // max open connections, mysql only
+	MaxIdle     uint  // max idle connections, mysql only
+	MaxLifetime uint  // seconds to reuse connection, mysql only
 }
 
 type Config struct {
 	Socket      SocketConf
 	TCP         TCPConf
 	SensorsPath string
+	SensorsTimeout uint  // milliseconds to wait for sensor reading, 0 to wait forever
 	I2C         I2CConf
 	Series      SeriesConf
+	Stream      StreamConf
 	Monitor     MonitorConf
 	Database    DatabaseConf
+	Retention   RetentionConf
+	Export      ExportConf
+	Alarm       AlarmConf
 	Log         string
 }
 
@@ -92,6 +135,7 @@ type ValueYAML struct {
 	Multiplier float64
 	Addend     float64 `yaml:",omitempty"`
 	Type       ValueType
+	Unit       string `yaml:",omitempty"`
 }
 
 type SensorYAML struct {
@@ -168,6 +212,7 @@ func valueFromYAML(valueYAML ValueYAML) (value *Value, err error) {
 		multiplier,
 		valueYAML.Addend,
 		valueYAML.Type,
+		valueYAML.Unit,
 	}
 	return value, err
 }
@@ -235,6 +280,8 @@ func loadConfig(path string) (err error) {
 			return errf
 		}
 	}
+	// default of option which may be set to 0
+	config.SensorsTimeout = 5000
 	err = yaml.Unmarshal(yml, &config)
 	if config.Socket.Path == "" {
 		config.Socket.Path = "/run/sdlab.sock"
@@ -251,12 +298,52 @@ func loadConfig(path string) (err error) {
 	if config.Series.Pool == 0 {
 		config.Series.Pool = 50
 	}
+	if config.Stream.Buffer == 0 {
+		config.Stream.Buffer = 100
+	}
 	if config.Monitor.Path == "" {
 		config.Monitor.Path = "/var/lib/sdlab/monitor"
 	}
+	if config.Database.Batch.Latency == 0 {
+		config.Database.Batch.Latency = 2000
+	}
+	if config.Database.Batch.Rows == 0 {
+		config.Database.Batch.Rows = 1000
+	}
+	if config.Retention.Interval == 0 {
+		config.Retention.Interval = 3600
+	}
+	switch config.Retention.Action {
+	case "", RETENTION_DELETE, RETENTION_DOWNSAMPLE:
+	default:
+		return fmt.Errorf("wrong retention action: '%s'", config.Retention.Action)
+	}
+	if config.Export.Path == "" {
+		config.Export.Path = "/var/lib/sdlab/export"
+	}
+	if config.Export.Chunk == 0 {
+		config.Export.Chunk = 65536
+	}
+	if config.Alarm.Timeout == 0 {
+		config.Alarm.Timeout = 10
+	}
+	if config.Monitor.Archives == nil {
+		config.Monitor.Archives = []uint{60, 600, 3600}
+	}
 	if config.Database.Type == "" {
 		config.Database.Type = "sqlite"
 	}
+	if config.Database.Type == "mysql" {
+		if config.Database.MaxOpen == 0 {
+			config.Database.MaxOpen = 10
+		}
+		if config.Database.MaxIdle == 0 {
+			config.Database.MaxIdle = 5
+		}
+		if config.Database.MaxLifetime == 0 {
+			config.Database.MaxLifetime = 3600
+		}
+	}
 	if config.Database.Dsn == "" {
 		switch config.Database.Type {
 		case "sqlite":
@@ -0,0 +1,274 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// Consolidation functions of fetched data
+var fetchCfs = []string{"AVERAGE", "MIN", "MAX", "LAST", "COUNT"}
+
+func checkCf(cf string, cfs []string) error {
+	for _, c := range cfs {
+		if c == cf {
+			return nil
+		}
+	}
+	return errors.New("wrong consolidation function: '" + cf + "'")
+}
+
+// consolidate aggregates data rows into time buckets of step
+// by consolidation function cf. NaN readings are skipped,
+// bucket without readings gets NaN (0 for COUNT). Average of rows
+// of archive buckets is weighted by numbers of their detections.
+// Rows must be sorted by time.
+func consolidate(rows []*SerData, step time.Duration, cf string) []*SerData {
+	res := make([]*SerData, 0)
+	if len(rows) == 0 || step <= 0 {
+		return res
+	}
+	nvals := len(rows[0].Readings)
+
+	var cur *SerData
+	var cnt []uint
+	var weight []float64
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		for j := range cur.Readings {
+			switch cf {
+			case "AVERAGE":
+				if weight[j] > 0 {
+					cur.Readings[j] /= weight[j]
+				}
+			case "COUNT":
+				cur.Readings[j] = float64(cnt[j])
+			}
+			if cnt[j] == 0 && cf != "COUNT" {
+				cur.Readings[j] = math.NaN()
+			}
+		}
+		res = append(res, cur)
+	}
+
+	for _, row := range rows {
+		bucket := row.Time.Truncate(step)
+		if cur == nil || !bucket.Equal(cur.Time) {
+			flush()
+			cur = &SerData{Time: bucket, Readings: make([]float64, nvals)}
+			cnt = make([]uint, nvals)
+			weight = make([]float64, nvals)
+		}
+		for j := 0; j < nvals && j < len(row.Readings); j++ {
+			v := row.Readings[j]
+			if math.IsNaN(v) {
+				continue
+			}
+			switch cf {
+			case "AVERAGE":
+				w := 1.0
+				if j < len(row.counts) {
+					w = float64(row.counts[j])
+				}
+				cur.Readings[j] += v * w
+				weight[j] += w
+			case "SUM":
+				cur.Readings[j] += v
+			case "MIN":
+				if cnt[j] == 0 || v < cur.Readings[j] {
+					cur.Readings[j] = v
+				}
+			case "MAX":
+				if cnt[j] == 0 || v > cur.Readings[j] {
+					cur.Readings[j] = v
+				}
+			case "LAST":
+				cur.Readings[j] = v
+			}
+			cnt[j]++
+		}
+	}
+	flush()
+
+	return res
+}
+
+// gapInserter passes data rows to fn adding rows with NaN readings
+// at start of gaps within time range of rows, so charts show gaps there.
+// Rows and gaps must be sorted by time.
+type gapInserter struct {
+	gaps  []MonGap
+	first time.Time  // time of first row
+	fn    func(*SerData) error
+}
+
+// add passes rows of gaps started before row and then row to fn.
+func (g *gapInserter) add(row *SerData) error {
+	if g.first.IsZero() {
+		g.first = row.Time
+	}
+	err := g.before(row.Time, len(row.Readings))
+	if err != nil {
+		return err
+	}
+	return g.fn(row)
+}
+
+// before passes rows of gaps started after first row and before tm to fn.
+func (g *gapInserter) before(tm time.Time, nvals int) error {
+	for len(g.gaps) > 0 && g.gaps[0].Start.Before(tm) {
+		gap := g.gaps[0]
+		g.gaps = g.gaps[1:]
+		if g.first.IsZero() || gap.Start.Before(g.first) {
+			continue
+		}
+		row := &SerData{Time: gap.Start, Readings: make([]float64, nvals), Gap: gap.Cause}
+		for j := range row.Readings {
+			row.Readings[j] = math.NaN()
+		}
+		err := g.fn(row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downsample reduces number of data rows to about maxPoints
+// by Largest-Triangle-Three-Buckets algorithm keeping shape of chart.
+// Points are selected for each value separately with equal share
+// of maxPoints, result has rows selected for any value.
+func downsample(rows []*SerData, maxPoints uint) []*SerData {
+	if maxPoints == 0 || uint(len(rows)) <= maxPoints {
+		return rows
+	}
+	nvals := 1
+	if len(rows[0].Readings) > 1 {
+		nvals = len(rows[0].Readings)
+	}
+	threshold := int(maxPoints) / nvals
+	if threshold < 3 {
+		threshold = 3
+	}
+
+	selected := make(map[int]bool)
+	for j := 0; j < nvals; j++ {
+		for _, i := range lttb(rows, j, threshold) {
+			selected[i] = true
+		}
+	}
+
+	idx := make([]int, 0, len(selected))
+	for i := range selected {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+
+	res := make([]*SerData, len(idx))
+	for k, i := range idx {
+		res[k] = rows[i]
+	}
+	return res
+}
+
+// lttb returns indexes of rows selected by Largest-Triangle-Three-Buckets
+// algorithm for value j. NaN readings are never selected except first and last,
+// nothing is selected from bucket without readings.
+func lttb(rows []*SerData, j int, threshold int) []int {
+	x := func(i int) float64 {
+		return float64(rows[i].Time.UnixNano())
+	}
+	y := func(i int) float64 {
+		if j < len(rows[i].Readings) {
+			return rows[i].Readings[j]
+		}
+		return math.NaN()
+	}
+
+	n := len(rows)
+	if threshold >= n || threshold < 3 {
+		idx := make([]int, n)
+		for i := range idx {
+			idx[i] = i
+		}
+		return idx
+	}
+
+	idx := make([]int, 0, threshold)
+	idx = append(idx, 0)
+
+	every := float64(n-2) / float64(threshold-2)
+	a := 0
+	for b := 0; b < threshold-2; b++ {
+		// average point of next bucket
+		avgStart := int(float64(b+1)*every) + 1
+		avgEnd := int(float64(b+2)*every) + 1
+		if avgEnd > n {
+			avgEnd = n
+		}
+		var avgX, avgY float64
+		var avgN int
+		for i := avgStart; i < avgEnd; i++ {
+			if math.IsNaN(y(i)) {
+				continue
+			}
+			avgX += x(i)
+			avgY += y(i)
+			avgN++
+		}
+		if avgN > 0 {
+			avgX /= float64(avgN)
+			avgY /= float64(avgN)
+		}
+
+		// point of current bucket forming largest triangle
+		start := int(float64(b)*every) + 1
+		end := int(float64(b+1)*every) + 1
+		ax, ay := x(a), y(a)
+		maxArea := -1.0
+		next := -1
+		for i := start; i < end; i++ {
+			if math.IsNaN(y(i)) {
+				continue
+			}
+			area := math.Abs((ax-avgX)*(y(i)-ay) - (ax-x(i))*(avgY-ay))
+			if math.IsNaN(area) {
+				area = 0
+			}
+			if area > maxArea {
+				maxArea = area
+				next = i
+			}
+		}
+		if next < 0 {
+			// no readings in bucket
+			continue
+		}
+		idx = append(idx, next)
+		a = next
+	}
+
+	idx = append(idx, n-1)
+	return idx
+}
@@ -0,0 +1,470 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EXPORT_CSV   = "csv"
+	EXPORT_JSONL = "jsonl"
+	EXPORT_XLSX  = "xlsx"
+)
+
+type ExportOpts struct {
+	MonFetchOpts         // monitor, time range and downsampling
+	Format       string  // "csv", "jsonl" or "xlsx"
+	Delimiter    string  // CSV field delimiter, "," by default (";" with decimal comma)
+	DecimalComma bool    // CSV numbers with decimal comma
+	Stream       bool    // remove file after its last chunk is read by GetExportChunk
+}
+
+type ExportResult struct {
+	Name string  // file name in export directory
+	Size int64   // bytes
+	Rows uint
+}
+
+type ExportChunkOpts struct {
+	Name   string
+	Offset int64
+}
+
+type ExportChunk struct {
+	Data []byte  // base64 encoded in JSON
+	Next int64   // offset of the next chunk
+	EOF  bool
+}
+
+// exportRegistry keeps names of streamed export files
+// to remove them after reading.
+type exportRegistry struct {
+	mu sync.Mutex
+	m  map[string]bool
+}
+
+var exports = &exportRegistry{m: make(map[string]bool)}
+
+func (r *exportRegistry) Add(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[name] = true
+}
+
+// Remove unregisters streamed file, it reports if file was registered.
+func (r *exportRegistry) Remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := r.m[name]
+	delete(r.m, name)
+	return found
+}
+
+// exportHeader returns column names of exported monitor data,
+// unit of value is added to its name if known.
+func exportHeader(mon *Monitor) ([]string, error) {
+	monDBi, err := monitorToDB(mon)
+	if err != nil {
+		return nil, err
+	}
+	values, err := monDBi.allValues()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]string, len(values)+1)
+	header[0] = "Time"
+	for i, v := range values {
+		header[i+1] = v.Name
+		ps, ok := pluggedSensors[v.Sensor]
+		if ok && v.ValueIdx < len(ps.Values) && ps.Values[v.ValueIdx].Unit != "" {
+			header[i+1] = v.Name + ", " + ps.Values[v.ValueIdx].Unit
+		}
+	}
+	return header, nil
+}
+
+// expireExports removes exported files older than `export: ttl:` seconds.
+func expireExports() {
+	if config.Export.TTL == 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(config.Export.Path)
+	if err != nil {
+		return
+	}
+	ttl := time.Duration(config.Export.TTL) * time.Second
+	for _, fi := range files {
+		if fi.IsDir() || time.Since(fi.ModTime()) < ttl {
+			continue
+		}
+		err = os.Remove(filepath.Join(config.Export.Path, fi.Name()))
+		if err != nil {
+			logger.Print("error removing expired exported file: " + err.Error())
+			continue
+		}
+		exports.Remove(fi.Name())
+		logger.Print("exported file " + fi.Name() + " expired")
+	}
+}
+
+// exportMonitor writes monitor data to file in export directory.
+func exportMonitor(opts *ExportOpts) (*ExportResult, error) {
+	mon, exist := monitors.Get(opts.UUID)
+	if !exist {
+		return nil, errors.New("Wrong monitor UUID: " + opts.UUID)
+	}
+
+	switch opts.Format {
+	case EXPORT_CSV, EXPORT_JSONL, EXPORT_XLSX:
+	case "":
+		opts.Format = EXPORT_CSV
+	default:
+		return nil, fmt.Errorf("unknown export format: '%s'", opts.Format)
+	}
+	if opts.Format == EXPORT_CSV && len([]rune(opts.Delimiter)) > 1 {
+		return nil, errors.New("CSV delimiter must be single character")
+	}
+	if opts.Format == EXPORT_CSV && opts.DecimalComma && opts.Delimiter == "," {
+		return nil, errors.New("CSV delimiter can not be comma with decimal comma")
+	}
+
+	header, err := exportHeader(mon)
+	if err != nil {
+		return nil, err
+	}
+
+	expireExports()
+	err = os.MkdirAll(config.Export.Path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s.%s", opts.UUID, time.Now().Format("20060102T150405.000"), opts.Format)
+	path := filepath.Join(config.Export.Path, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows are written while they are fetched
+	w := bufio.NewWriter(f)
+	var rw rowWriter
+	switch opts.Format {
+	case EXPORT_CSV:
+		rw, err = newCSVWriter(w, header, opts.Delimiter, opts.DecimalComma)
+	case EXPORT_JSONL:
+		rw, err = newJSONLWriter(w, header)
+	case EXPORT_XLSX:
+		rw, err = newXLSXWriter(w, header)
+	}
+	var rows uint
+	if err == nil {
+		_, _, err = fetchMonData(mon, &opts.MonFetchOpts, func(row *SerData) error {
+			rows++
+			return rw.Write(row)
+		})
+	}
+	if err == nil {
+		err = rw.Close()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Stream {
+		exports.Add(name)
+	}
+
+	return &ExportResult{name, st.Size(), rows}, nil
+}
+
+// exportChunk reads chunk of exported file from offset,
+// streamed file is removed when its last chunk is read.
+func exportChunk(opts *ExportChunkOpts) (*ExportChunk, error) {
+	if opts.Name == "" || filepath.Base(opts.Name) != opts.Name {
+		return nil, errors.New("wrong export file name")
+	}
+	path := filepath.Join(config.Export.Path, opts.Name)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, config.Export.Chunk)
+	n, err := f.ReadAt(buf, opts.Offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	chunk := &ExportChunk{buf[:n], opts.Offset + int64(n), err == io.EOF}
+	if !chunk.EOF {
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		chunk.EOF = chunk.Next >= st.Size()
+	}
+
+	if chunk.EOF && exports.Remove(opts.Name) {
+		err = os.Remove(path)
+		if err != nil {
+			logger.Print("error removing exported file: " + err.Error())
+		}
+	}
+	return chunk, nil
+}
+
+// formatReading formats reading for text export, NaN is empty string.
+func formatReading(r float64, decimalComma bool) string {
+	if math.IsNaN(r) {
+		return ""
+	}
+	s := strconv.FormatFloat(r, 'f', -1, 64)
+	if decimalComma {
+		s = strings.Replace(s, ".", ",", 1)
+	}
+	return s
+}
+
+// Layout of times in CSV files, local time
+const csvTimeLayout = "2006-01-02 15:04:05.000"
+
+// rowWriter writes exported data rows one by one.
+type rowWriter interface {
+	Write(row *SerData) error
+	// Close completes written data, underlying writer is not closed.
+	Close() error
+}
+
+type csvWriter struct {
+	cw           *csv.Writer
+	record       []string
+	decimalComma bool
+}
+
+// newCSVWriter writes header of CSV data to w.
+func newCSVWriter(w io.Writer, header []string, delimiter string, decimalComma bool) (*csvWriter, error) {
+	cw := csv.NewWriter(w)
+	cw.Comma = ','
+	if decimalComma {
+		cw.Comma = ';'
+	}
+	if delimiter != "" {
+		cw.Comma = []rune(delimiter)[0]
+	}
+
+	err := cw.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &csvWriter{cw, make([]string, len(header)), decimalComma}, nil
+}
+
+func (w *csvWriter) Write(row *SerData) error {
+	w.record[0] = row.Time.Local().Format(csvTimeLayout)
+	for i := range w.record[1:] {
+		w.record[i+1] = ""
+		if i < len(row.Readings) {
+			w.record[i+1] = formatReading(row.Readings[i], w.decimalComma)
+		}
+	}
+	return w.cw.Write(w.record)
+}
+
+func (w *csvWriter) Close() error {
+	w.cw.Flush()
+	return w.cw.Error()
+}
+
+// jsonlWriter writes a JSON object per row with readings by column names,
+// NaN readings are null.
+type jsonlWriter struct {
+	w    io.Writer
+	keys []string  // JSON encoded column names
+}
+
+func newJSONLWriter(w io.Writer, header []string) (*jsonlWriter, error) {
+	keys := make([]string, len(header)-1)
+	for i, col := range header[1:] {
+		k, err := json.Marshal(col)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = string(k)
+	}
+	return &jsonlWriter{w, keys}, nil
+}
+
+func (w *jsonlWriter) Write(row *SerData) error {
+	t, err := json.Marshal(row.Time.Local())
+	if err != nil {
+		return err
+	}
+	line := `{"Time":` + string(t)
+	for i, k := range w.keys {
+		v := "null"
+		if i < len(row.Readings) && !math.IsNaN(row.Readings[i]) && !math.IsInf(row.Readings[i], 0) {
+			v = strconv.FormatFloat(row.Readings[i], 'f', -1, 64)
+		}
+		line += "," + k + ":" + v
+	}
+	_, err = io.WriteString(w.w, line+"}\n")
+	return err
+}
+
+func (w *jsonlWriter) Close() error {
+	return nil
+}
+
+// Minimal Office Open XML workbook with single sheet,
+// times are date cells of style 1.
+const (
+	xlsxContentTypes = xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`
+	xlsxRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+	xlsxWorkbook = xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Data" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`
+	xlsxWorkbookRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`
+	xlsxStyles = xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy\-mm\-dd\ hh:mm:ss.000"/></numFmts>` +
+		`<fonts count="1"><font/></fonts>` +
+		`<fills count="1"><fill/></fills>` +
+		`<borders count="1"><border/></borders>` +
+		`<cellStyleXfs count="1"><xf/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf/><xf numFmtId="164" applyNumberFormat="1"/></cellXfs>` +
+		`</styleSheet>`
+)
+
+// xlsxTime converts time to spreadsheet serial date of local wall clock.
+func xlsxTime(t time.Time) float64 {
+	t = t.Local()
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	return float64(wall.Sub(epoch)) / float64(24*time.Hour)
+}
+
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sw    *bufio.Writer
+	ncols int
+	n     int  // number of written rows with header
+}
+
+// newXLSXWriter writes workbook parts and header row to w.
+func newXLSXWriter(w io.Writer, header []string) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+	files := []struct{ name, body string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, file := range files {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(fw, file.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fw, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	sw := bufio.NewWriter(fw)
+	sw.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	// Header of inline strings
+	sw.WriteString(`<row r="1">`)
+	for _, col := range header {
+		sw.WriteString(`<c t="inlineStr"><is><t>`)
+		xml.EscapeText(sw, []byte(col))
+		sw.WriteString(`</t></is></c>`)
+	}
+	sw.WriteString(`</row>`)
+
+	return &xlsxWriter{zw, sw, len(header) - 1, 1}, nil
+}
+
+// Write writes data row, NaN readings are empty cells.
+func (w *xlsxWriter) Write(row *SerData) error {
+	w.n++
+	fmt.Fprintf(w.sw, `<row r="%d"><c s="1"><v>%s</v></c>`, w.n, strconv.FormatFloat(xlsxTime(row.Time), 'f', -1, 64))
+	for i := 0; i < w.ncols; i++ {
+		if i >= len(row.Readings) || math.IsNaN(row.Readings[i]) || math.IsInf(row.Readings[i], 0) {
+			w.sw.WriteString(`<c/>`)
+			continue
+		}
+		fmt.Fprintf(w.sw, `<c><v>%s</v></c>`, strconv.FormatFloat(row.Readings[i], 'f', -1, 64))
+	}
+	_, err := w.sw.WriteString(`</row>`)
+	return err
+}
+
+func (w *xlsxWriter) Close() error {
+	w.sw.WriteString(`</sheetData></worksheet>`)
+	err := w.sw.Flush()
+	if err != nil {
+		return err
+	}
+
+	return w.zw.Close()
+}
@@ -0,0 +1,311 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/pborman/uuid"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IMPORT_SENSOR     = "import"  // sensor of imported values without sensor
+	IMPORT_MAX_ERRORS = 100       // max number of rejected rows reported with errors
+)
+
+type ImportColumn struct {
+	Column   int     // index of CSV column, from 0
+	Name     string  // value name, CSV header by default
+	Sensor   string  // "import" by default
+	ValueIdx int     // index of CSV column by default
+}
+
+type ImportOpts struct {
+	Exp_id       int
+	Setup_id     int
+	Data         string  // CSV content
+	Header       bool    // first CSV row is header
+	Delimiter    string  // CSV field delimiter, "," by default (";" with decimal comma)
+	DecimalComma bool    // CSV numbers with decimal comma
+	TimeColumn   int     // index of CSV column with time
+	TimeFormat   string  // Go time layout, "unix" or "unixms", RFC3339 by default
+	TimeZone     string  // location of times without zone, local by default
+	Columns      []ImportColumn
+	StepMs       uint    // monitor step, min interval of rows by default
+}
+
+type ImportError struct {
+	Line  int
+	Error string
+}
+
+type ImportResult struct {
+	UUID     string
+	Rows     uint
+	Rejected uint
+	Errors   []ImportError  // first rejected rows
+}
+
+// importTime parses time of imported row.
+func importTime(s, layout string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	switch layout {
+	case "":
+		return time.Parse(time.RFC3339Nano, s)
+	case "unixms":
+		ms, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	case "unix":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e9))), nil
+	}
+	return time.ParseInLocation(layout, s, loc)
+}
+
+// importColumns checks column mapping and returns monitor values.
+func importColumns(opts *ImportOpts, header []string) ([]MonValue, error) {
+	if len(opts.Columns) == 0 {
+		return nil, errors.New("no columns to import")
+	}
+	values := make([]MonValue, len(opts.Columns))
+	names := make(map[string]bool)
+	ids := make(map[ValueId]bool)
+	for i, c := range opts.Columns {
+		if c.Column < 0 || c.Column == opts.TimeColumn {
+			return nil, fmt.Errorf("wrong column %d to import", c.Column)
+		}
+		v := MonValue{Name: c.Name, Sensor: c.Sensor, ValueIdx: c.ValueIdx, Type: GAUGE}
+		if v.Sensor == "" {
+			v.Sensor = IMPORT_SENSOR
+			v.ValueIdx = c.Column
+		}
+		if v.Name == "" && c.Column < len(header) {
+			v.Name = strings.TrimSpace(header[c.Column])
+		}
+		if v.Name == "" {
+			v.Name = "value" + strconv.Itoa(i)
+		}
+		if names[v.Name] {
+			return nil, fmt.Errorf("duplicate value name '%s'", v.Name)
+		}
+		id := ValueId{v.Sensor, v.ValueIdx}
+		if ids[id] {
+			return nil, fmt.Errorf("duplicate value %d of sensor '%s'", v.ValueIdx, v.Sensor)
+		}
+		names[v.Name] = true
+		ids[id] = true
+		values[i] = v
+	}
+	return values, nil
+}
+
+// importData creates inactive monitor with data rows of CSV.
+// Rows with wrong time or readings are rejected, times of rows
+// must increase and can not be in the future.
+func importData(opts *ImportOpts) (*ImportResult, error) {
+	if opts.TimeColumn < 0 {
+		return nil, errors.New("wrong time column")
+	}
+	if len([]rune(opts.Delimiter)) > 1 {
+		return nil, errors.New("CSV delimiter must be single character")
+	}
+	if opts.DecimalComma && opts.Delimiter == "," {
+		return nil, errors.New("CSV delimiter can not be comma with decimal comma")
+	}
+	loc := time.Local
+	if opts.TimeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(opts.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := csv.NewReader(strings.NewReader(opts.Data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	if opts.DecimalComma {
+		r.Comma = ';'
+	}
+	if opts.Delimiter != "" {
+		r.Comma = []rune(opts.Delimiter)[0]
+	}
+
+	var header []string
+	if opts.Header {
+		var err error
+		header, err = r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV header: %s", err)
+		}
+	}
+	values, err := importColumns(opts, header)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ImportResult{Errors: make([]ImportError, 0)}
+	reject := func(line int, err error) {
+		res.Rejected++
+		if len(res.Errors) < IMPORT_MAX_ERRORS {
+			res.Errors = append(res.Errors, ImportError{line, err.Error()})
+		}
+	}
+
+	now := time.Now()
+	rows := make([]*SerData, 0)
+	var step time.Duration
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if pe, ok := err.(*csv.ParseError); ok {
+				reject(pe.StartLine, err)
+				continue
+			}
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		if len(record) == 1 && record[0] == "" {
+			// empty line
+			continue
+		}
+
+		if opts.TimeColumn >= len(record) {
+			reject(line, errors.New("no time column"))
+			continue
+		}
+		tm, err := importTime(record[opts.TimeColumn], opts.TimeFormat, loc)
+		if err != nil {
+			reject(line, err)
+			continue
+		}
+		if tm.After(now) {
+			reject(line, errors.New("time is in the future"))
+			continue
+		}
+		if len(rows) > 0 && !tm.After(rows[len(rows)-1].Time) {
+			reject(line, errors.New("time is not increasing"))
+			continue
+		}
+
+		row := &SerData{Time: tm, Readings: make([]float64, len(values))}
+		for i, c := range opts.Columns {
+			if c.Column >= len(record) {
+				err = fmt.Errorf("no column %d", c.Column)
+				break
+			}
+			s := strings.TrimSpace(record[c.Column])
+			if s == "" {
+				// not detected
+				row.Readings[i] = math.NaN()
+				continue
+			}
+			if opts.DecimalComma {
+				s = strings.Replace(s, ",", ".", 1)
+			}
+			row.Readings[i], err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				err = fmt.Errorf("wrong reading in column %d: '%s'", c.Column, record[c.Column])
+				break
+			}
+		}
+		if err != nil {
+			reject(line, err)
+			continue
+		}
+
+		if len(rows) > 0 {
+			d := tm.Sub(rows[len(rows)-1].Time)
+			if step == 0 || d < step {
+				step = d
+			}
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return res, errors.New("no rows to import")
+	}
+
+	// Step of monitor is min interval of rows
+	stepMs := opts.StepMs
+	if stepMs == 0 {
+		stepMs = uint(math.Ceil(float64(step) / float64(time.Millisecond)))
+	}
+	if stepMs == 0 {
+		stepMs = 1000
+	}
+	archives, err := monitorArchives((stepMs+999)/1000, nil)
+	if err != nil {
+		return res, err
+	}
+
+	mon := &Monitor{
+		0,
+		uuid.NewRandom(),
+		opts.Exp_id,
+		opts.Setup_id,
+		(stepMs + 999) / 1000,
+		stepMs,
+		0,
+		0,
+		rows[0].Time,
+		time.Time{},
+		false,
+		false,
+		nil,
+		nil,
+		values,
+		MonCounters{0, 0},
+		archives,
+		sync.RWMutex{},
+	}
+	err = mon.SaveNew()
+	if err != nil {
+		return res, err
+	}
+	monitors.Add(mon)
+
+	err = mon.Append(rows)
+	if err != nil {
+		mon.Remove(true)
+		return res, err
+	}
+
+	res.UUID = mon.UUID.String()
+	res.Rows = uint(len(rows))
+	logger.Printf("ImportData: %d rows imported to monitor %s, %d rows rejected", res.Rows, res.UUID, res.Rejected)
+	return res, nil
+}
@@ -19,6 +19,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -26,13 +27,25 @@ import (
 )
 
 var configPath string
+var command string
+var dryRun bool
 var logger *log.Logger
 var sensors []Sensor
 var pluggedSensors PluggedSensors
 
+// Command line: sdlab [migrate [--dry-run]] [config]
 func init() {
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "migrate" {
+		command = args[0]
+		args = args[1:]
+		if len(args) > 0 && args[0] == "--dry-run" {
+			dryRun = true
+			args = args[1:]
+		}
+	}
+	if len(args) > 0 {
+		configPath = args[0]
 	} else {
 		configPath = "/etc/sdlab/sdlab.conf"
 	}
@@ -50,6 +63,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if command == "migrate" {
+		migrate()
+		return
+	}
 	err = loadSensors(config.SensorsPath)
 	if err != nil {
 		logger.Printf("Error loading sensors configuration: %s", err)
@@ -59,24 +76,13 @@ func main() {
 		logger.Fatal(err)
 	}
 
-	// Database prepare
+	// Storage prepare
 
-	db, err = initDB(config.Database)
-	if err != nil {
-		logger.Fatal(err)
-	}
-	defer db.Close()
-
-	err = initQueries(config.Database.Type)
-	defer cleanupQueries()
-	if err != nil {
-		logger.Fatal(err)
-	}
-
-	err = prepareDB()
+	store, err = openStorage(config.Database)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	defer store.Close()
 	logger.Print("Database connected")
 
 	// Run monitors
@@ -86,6 +92,10 @@ func main() {
 		logger.Print("Error running monitor: " + err.Error())
 	}
 
+	// Remove old data by retention limits
+
+	startRetention()
+
 	// Start API and listeners
 
 	listeners, err := startAPI()
@@ -105,6 +115,29 @@ func main() {
 		for i := range listeners {
 			listeners[i].Close()
 		}
+		writes.Flush()
 		os.Exit(0)
 	}
 }
+
+// migrate upgrades database schema or prints pending steps in dry run mode.
+func migrate() {
+	var err error
+
+	db, err = initDB(config.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	pending, err := migrateDB(config.Database.Type, dryRun)
+	if dryRun {
+		printMigrations(pending)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !dryRun {
+		fmt.Printf("Applied %d migrations\n", len(pending))
+	}
+}
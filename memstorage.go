@@ -0,0 +1,581 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// archiveKey identifies bucket of consolidated archive.
+type archiveKey struct {
+	Mon_id        int
+	Step          uint
+	Time          time.Time
+	Sensor_id     string
+	Sensor_val_id int
+}
+
+// memStorage keeps data in memory, it is used in tests.
+type memStorage struct {
+	mu         sync.RWMutex
+	lastId     int
+	monitors   map[int]*MonitorDBItem
+	counters   map[string]MonCounters
+	changes    map[string][]MonChange
+	pauses     map[string][]MonPause
+	gaps       map[string][]MonGap
+	schedules  map[string]APISchedule
+	alarms     map[string]map[string]APIAlarm
+	detections map[int][]DetectionItem
+	archives   map[archiveKey]*ArchiveRow
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		monitors:   make(map[int]*MonitorDBItem),
+		counters:   make(map[string]MonCounters),
+		changes:    make(map[string][]MonChange),
+		pauses:     make(map[string][]MonPause),
+		gaps:       make(map[string][]MonGap),
+		schedules:  make(map[string]APISchedule),
+		alarms:     make(map[string]map[string]APIAlarm),
+		detections: make(map[int][]DetectionItem),
+		archives:   make(map[archiveKey]*ArchiveRow),
+	}
+}
+
+// copyMonitor copies monitor item with its values and archives.
+func copyMonitor(monDBi *MonitorDBItem) *MonitorDBItem {
+	c := *monDBi
+	c.Values = make([]MonValue, len(monDBi.Values))
+	copy(c.Values, monDBi.Values)
+	c.Archives = make([]uint, len(monDBi.Archives))
+	copy(c.Archives, monDBi.Archives)
+	return &c
+}
+
+func (s *memStorage) Close() error {
+	return nil
+}
+
+func (s *memStorage) MonitorIds() ([]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]int, 0, len(s.monitors))
+	for id := range s.monitors {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (s *memStorage) LoadMonitor(id int) (*MonitorDBItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	monDBi, ok := s.monitors[id]
+	if !ok {
+		return nil, fmt.Errorf("no monitor with id %d", id)
+	}
+	c := copyMonitor(monDBi)
+	c.Counters = s.counters[c.UUID]
+	return c, nil
+}
+
+func (s *memStorage) InsertMonitor(monDBi *MonitorDBItem) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.monitors {
+		if m.UUID == monDBi.UUID {
+			return 0, errors.New("monitor " + monDBi.UUID + " already exists")
+		}
+	}
+	s.lastId++
+	c := copyMonitor(monDBi)
+	c.Id = s.lastId
+	s.monitors[c.Id] = c
+	s.counters[c.UUID] = MonCounters{}
+	return c.Id, nil
+}
+
+func (s *memStorage) UpdateMonitor(monDBi *MonitorDBItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.monitors[monDBi.Id]
+	if !ok {
+		return fmt.Errorf("no monitor with id %d", monDBi.Id)
+	}
+	// Values and archives are saved separately
+	c := *monDBi
+	c.Values = old.Values
+	c.Archives = old.Archives
+	s.monitors[c.Id] = &c
+	return nil
+}
+
+func (s *memStorage) ChangeMonitor(monDBi *MonitorDBItem, changes []MonChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.monitors[monDBi.Id]
+	if !ok {
+		return fmt.Errorf("no monitor with id %d", monDBi.Id)
+	}
+	c := *monDBi
+	c.Values = make([]MonValue, len(monDBi.Values))
+	copy(c.Values, monDBi.Values)
+	c.Archives = old.Archives
+	s.monitors[c.Id] = &c
+
+	for _, ch := range changes {
+		ch.Time = ch.Time.UTC()
+		ch.StopAt = ch.StopAt.UTC()
+		s.changes[c.UUID] = append(s.changes[c.UUID], ch)
+	}
+	sort.SliceStable(s.changes[c.UUID], func(i, j int) bool {
+		return s.changes[c.UUID][i].Time.Before(s.changes[c.UUID][j].Time)
+	})
+	return nil
+}
+
+func (s *memStorage) RemoveMonitor(monDBi *MonitorDBItem, wdata bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if wdata {
+		s.deleteDetections(monDBi.Id, time.Time{}, true)
+	}
+	delete(s.changes, monDBi.UUID)
+	delete(s.pauses, monDBi.UUID)
+	delete(s.gaps, monDBi.UUID)
+	delete(s.counters, monDBi.UUID)
+	delete(s.monitors, monDBi.Id)
+	return nil
+}
+
+func (s *memStorage) Counters(u string) (MonCounters, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.counters[u], nil
+}
+
+func (s *memStorage) Changes(u string) ([]MonChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	changes := make([]MonChange, len(s.changes[u]))
+	copy(changes, s.changes[u])
+	return changes, nil
+}
+
+func (s *memStorage) Pauses(u string) ([]MonPause, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pauses := make([]MonPause, len(s.pauses[u]))
+	copy(pauses, s.pauses[u])
+	return pauses, nil
+}
+
+func (s *memStorage) AddPause(u string, start time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pauses[u] = append(s.pauses[u], MonPause{Start: start.UTC()})
+	return nil
+}
+
+func (s *memStorage) ClosePause(u string, end time.Time) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pauses := s.pauses[u]
+	for i := len(pauses) - 1; i >= 0; i-- {
+		if pauses[i].End.IsZero() {
+			pauses[i].End = end.UTC()
+			return pauses[i].Start, true, nil
+		}
+	}
+	return time.Time{}, false, nil
+}
+
+func (s *memStorage) Gaps(u string) ([]MonGap, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	gaps := make([]MonGap, len(s.gaps[u]))
+	copy(gaps, s.gaps[u])
+	return gaps, nil
+}
+
+func (s *memStorage) AddGap(u string, g MonGap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g.Start = g.Start.UTC()
+	g.End = g.End.UTC()
+	for i := range s.gaps[u] {
+		if s.gaps[u][i].Start.Equal(g.Start) {
+			s.gaps[u][i] = g
+			return nil
+		}
+	}
+	s.gaps[u] = append(s.gaps[u], g)
+	sort.SliceStable(s.gaps[u], func(i, j int) bool {
+		return s.gaps[u][i].Start.Before(s.gaps[u][j].Start)
+	})
+	return nil
+}
+
+func (s *memStorage) Schedules() ([]APISchedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]APISchedule, 0, len(s.schedules))
+	for _, sch := range s.schedules {
+		list = append(list, sch)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UUID < list[j].UUID
+	})
+	return list, nil
+}
+
+func (s *memStorage) SaveSchedule(sch APISchedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sch.StartAt = sch.StartAt.UTC()
+	sch.Next = time.Time{}
+	s.schedules[sch.UUID] = sch
+	return nil
+}
+
+func (s *memStorage) RemoveSchedule(u string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.schedules, u)
+	return nil
+}
+
+func (s *memStorage) Alarms() ([]APIAlarm, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]APIAlarm, 0)
+	for _, m := range s.alarms {
+		for _, a := range m {
+			list = append(list, a)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].UUID != list[j].UUID {
+			return list[i].UUID < list[j].UUID
+		}
+		return list[i].Value < list[j].Value
+	})
+	return list, nil
+}
+
+func (s *memStorage) SaveAlarm(a APIAlarm) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a.Since = a.Since.UTC()
+	if s.alarms[a.UUID] == nil {
+		s.alarms[a.UUID] = make(map[string]APIAlarm)
+	}
+	s.alarms[a.UUID][a.Value] = a
+	return nil
+}
+
+func (s *memStorage) RemoveAlarms(u string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.alarms, u)
+	return nil
+}
+
+func (s *memStorage) AppendDetections(batch []MonitorRows, count bool) ([]MonCounters, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]MonCounters, len(batch))
+	for i, b := range batch {
+		monDBi := b.Monitor
+		if len(monDBi.Values) == 0 {
+			continue
+		}
+		for _, row := range b.Rows {
+			tm := row.Time.UTC()
+			is_err := false
+			for j, v := range monDBi.Values {
+				d := DetectionItem{
+					Exp_id:        monDBi.Exp_id,
+					Mon_id:        monDBi.Id,
+					Time:          tm,
+					Sensor_id:     v.Sensor,
+					Sensor_val_id: v.ValueIdx,
+					Detection:     math.NaN(),
+				}
+				if j < len(row.Readings) {
+					d.Detection = row.Readings[j]
+				}
+				if math.IsNaN(d.Detection) {
+					d.Error = row.readingError(j)
+					is_err = true
+				} else {
+					s.updateArchives(monDBi, tm, v, d.Detection)
+				}
+				s.detections[monDBi.Id] = append(s.detections[monDBi.Id], d)
+			}
+			res[i].Done++
+			if is_err {
+				res[i].Err++
+			}
+		}
+		if count {
+			c := s.counters[monDBi.UUID]
+			c.Done += res[i].Done
+			c.Err += res[i].Err
+			s.counters[monDBi.UUID] = c
+		}
+	}
+	return res, nil
+}
+
+// updateArchives adds reading r of value v made at time tm
+// to consolidated archives of monitor.
+func (s *memStorage) updateArchives(monDBi *MonitorDBItem, tm time.Time, v MonValue, r float64) {
+	for _, step := range monDBi.Archives {
+		key := archiveKey{monDBi.Id, step, tm.Truncate(time.Duration(step) * time.Second), v.Sensor, v.ValueIdx}
+		a, ok := s.archives[key]
+		if !ok {
+			a = &ArchiveRow{key.Time, v.Sensor, v.ValueIdx, 0, 0, r, r, r}
+			s.archives[key] = a
+		}
+		a.Sum += r
+		a.Min = math.Min(a.Min, r)
+		a.Max = math.Max(a.Max, r)
+		a.Last = r
+		a.Cnt++
+	}
+}
+
+// inRange reports if t is within time range, zero start or end time
+// is not limited.
+func inRange(t, start, end time.Time) bool {
+	return (start.IsZero() || !t.Before(start)) && (end.IsZero() || !t.After(end))
+}
+
+// Scan functions are called with storage unlocked,
+// so they can use storage.
+
+func (s *memStorage) ScanDetections(monId int, start, end time.Time, fn func(*DetectionItem) error) error {
+	s.mu.RLock()
+	list := make([]DetectionItem, 0)
+	for _, d := range s.detections[monId] {
+		if inRange(d.Time, start, end) {
+			list = append(list, d)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+		if a.Sensor_id != b.Sensor_id {
+			return a.Sensor_id < b.Sensor_id
+		}
+		return a.Sensor_val_id < b.Sensor_val_id
+	})
+	for i := range list {
+		err := fn(&list[i])
+		if err != nil {
+			return scanResult(err)
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) ScanArchive(monId int, step uint, start, end time.Time, fn func(*ArchiveRow) error) error {
+	s.mu.RLock()
+	list := make([]ArchiveRow, 0)
+	for key, a := range s.archives {
+		if key.Mon_id == monId && key.Step == step && inRange(key.Time, start, end) {
+			list = append(list, *a)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+		if a.Sensor_id != b.Sensor_id {
+			return a.Sensor_id < b.Sensor_id
+		}
+		return a.Sensor_val_id < b.Sensor_val_id
+	})
+	for i := range list {
+		err := fn(&list[i])
+		if err != nil {
+			return scanResult(err)
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) CountDetections(monId int, before time.Time) (uint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n uint
+	for _, d := range s.detections[monId] {
+		if before.IsZero() || d.Time.Before(before) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memStorage) CountTimes(monId int) (uint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	times := make(map[time.Time]bool)
+	for _, d := range s.detections[monId] {
+		times[d.Time] = true
+	}
+	return uint(len(times)), nil
+}
+
+func (s *memStorage) CountValue(monId int, sensor string, valueIdx int) (uint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n uint
+	for _, d := range s.detections[monId] {
+		if d.Sensor_id == sensor && d.Sensor_val_id == valueIdx {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memStorage) CountArchive(monId int, step uint) (uint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	times := make(map[time.Time]bool)
+	for key := range s.archives {
+		if key.Mon_id == monId && key.Step == step {
+			times[key.Time] = true
+		}
+	}
+	return uint(len(times)), nil
+}
+
+func (s *memStorage) TotalDetections() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n uint64
+	for _, list := range s.detections {
+		n += uint64(len(list))
+	}
+	return n, nil
+}
+
+func (s *memStorage) LastTime(monId int) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last time.Time
+	for _, d := range s.detections[monId] {
+		if d.Time.After(last) {
+			last = d.Time
+		}
+	}
+	return last, nil
+}
+
+func (s *memStorage) DeleteDetections(monDBi *MonitorDBItem, before time.Time, archives bool) (MonCounters, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := s.deleteDetections(monDBi.Id, before, archives)
+	s.counters[monDBi.UUID] = s.counters[monDBi.UUID].sub(removed)
+	return removed, nil
+}
+
+// deleteDetections removes detections of monitor made before time,
+// storage must be locked. It returns counters of removed detections.
+func (s *memStorage) deleteDetections(monId int, before time.Time, archives bool) MonCounters {
+	// Removed times and if they have failed readings
+	failed := make(map[time.Time]bool)
+	kept := make([]DetectionItem, 0)
+	for _, d := range s.detections[monId] {
+		if before.IsZero() || d.Time.Before(before) {
+			failed[d.Time] = failed[d.Time] || math.IsNaN(d.Detection)
+		} else {
+			kept = append(kept, d)
+		}
+	}
+	if before.IsZero() {
+		delete(s.detections, monId)
+	} else {
+		s.detections[monId] = kept
+	}
+
+	if archives {
+		for key := range s.archives {
+			if key.Mon_id == monId && (before.IsZero() || key.Time.Before(before)) {
+				delete(s.archives, key)
+			}
+		}
+	}
+
+	removed := MonCounters{Done: uint(len(failed))}
+	for _, f := range failed {
+		if f {
+			removed.Err++
+		}
+	}
+	return removed
+}
+
+// Size of memory storage is unknown.
+func (s *memStorage) Size() (uint64, uint64, error) {
+	return 0, 0, nil
+}
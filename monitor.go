@@ -23,11 +23,14 @@ import (
 	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	_ "github.com/go-sql-driver/mysql"
 	"database/sql"
 	"strconv"
 	"time"
 	"strings"
 	"math"
+	"sort"
+	"sync"
 )
 
 const (
@@ -35,6 +38,7 @@ const (
 	RFC3339Nano_UTC  = "2006-01-02T15:04:05.999999999Z"
 	RFC3339Milli     = "2006-01-02T15:04:05.999Z07:00"
 	RFC3339Milli_UTC = "2006-01-02T15:04:05.999Z"
+	RFC3339Nano_Fixed = "2006-01-02T15:04:05.000000000Z"
 )
 
 type MonValue struct {
@@ -51,23 +55,47 @@ type MonCounters struct {
 	Err      uint
 }
 
+// sub returns counters without removed detections r.
+func (c MonCounters) sub(r MonCounters) MonCounters {
+	if r.Done > c.Done {
+		r.Done = c.Done
+	}
+	if r.Err > c.Err {
+		r.Err = c.Err
+	}
+	return MonCounters{c.Done - r.Done, c.Err - r.Err}
+}
+
 type Monitor struct {
 	Id       int
 	UUID     uuid.UUID
 	Exp_id   int
 	Setup_id int
-	Step     uint         // Interval
+	Step     uint         // Interval, seconds rounded up
+	StepMs   uint         // Interval, milliseconds
 	Amount   uint         // Amount total, 0 if StopAt mode
 	Duration uint         // Duration, in StopAt mode, only passed to database
 	Created  time.Time
 	StopAt   time.Time
 	Active   bool
+	Paused   bool
 
 	stop     chan int
+	finished chan struct{} // closed when detections are written after stop
 
 	Values   []MonValue
 
 	Counters MonCounters  // Counters
+
+	Archives []uint       // Steps of consolidated archives, seconds
+
+	mu       sync.RWMutex // protects fields of running monitor
+}
+
+// monitorRegistry is a set of loaded monitors safe for concurrent use.
+type monitorRegistry struct {
+	mu sync.RWMutex
+	m  map[string]*Monitor
 }
 
 type MonitorDBItem struct {
@@ -76,15 +104,19 @@ type MonitorDBItem struct {
 	Exp_id   int
 	Setup_id int
 	Step     uint
+	StepMs   uint
 	Amount   uint
 	Duration uint
 	Created  string
 	StopAt   string
 	Active   bool
+	Paused   bool
 
 	Values   []MonValue
 
 	Counters MonCounters
+
+	Archives []uint
 }
 
 type DetectionItem struct {
@@ -116,13 +148,45 @@ type MonValueInfo struct {
 	Len      uint
 }
 
+// MonChange is a set of monitor parameters applied since Time.
+type MonChange struct {
+	Time   time.Time
+	StepMs uint
+	Amount uint
+	StopAt time.Time
+	Values []APIMonValue
+}
+
+type MonPause struct {
+	Start time.Time
+	End   time.Time  // zero time if monitor is paused now
+}
+
+// Causes of gaps in monitor data
+const (
+	GAP_DOWN   = "down"    // daemon was not running
+	GAP_MISSED = "missed"  // ticks were missed by slow readings
+	GAP_PAUSED = "paused"  // monitor was paused
+)
+
+// MonGap is interval of monitor without detections.
+type MonGap struct {
+	Start time.Time  // time of first missed detection or start of pause
+	End   time.Time  // time of next detection or end of pause
+	Cause string
+}
+
 type ArchiveInfo struct {
 	Step uint
 	Len  uint
+	Cf   []string  // consolidation functions available
 }
 
 type MonitorInfo struct {
 	Active   bool
+	Paused   bool
+	Step     uint
+	StepMs   uint
 	Created  time.Time
 	StopAt   time.Time
 	Last     time.Time
@@ -131,14 +195,13 @@ type MonitorInfo struct {
 	Counters MonCounters
 	Archives []ArchiveInfo
 	Values   []MonValueInfo
+	Pauses   []MonPause
+	Changes  []MonChange
+	Gaps     []MonGap
 }
 
-type FetchResultDBItem struct {
-	Time          time.Time
-	Name          string
-	Detection     float64
-	Error         string    // TODO: remode old error field
-}
+// Consolidation functions of archives
+var archiveCfs = []string{"AVERAGE", "MIN", "MAX", "LAST", "COUNT"}
 
 type FetchResultDB struct {
 	Filename string
@@ -147,8 +210,7 @@ type FetchResultDB struct {
 	End      time.Time
 	Step     time.Duration
 	DsNames  []string
-	RowCnt   int
-	DsData   []*FetchResultDBItem
+	RowCnt   int       // number of rows passed to fetch function
 	// contains filtered or unexported fields
 }
 
@@ -156,9 +218,48 @@ var (
 	db       *sql.DB
 	queries  map[string]string
 	stmts    map[string]*sql.Stmt
-	monitors map[string]*Monitor
+	monitors = newMonitorRegistry()
+
+	dbTimeLayout = time.RFC3339Nano  // layout of times stored in database
 )
 
+func newMonitorRegistry() *monitorRegistry {
+	return &monitorRegistry{m: make(map[string]*Monitor)}
+}
+
+// Get returns monitor by uuid string.
+func (r *monitorRegistry) Get(u string) (*Monitor, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	mon, exists := r.m[u]
+	return mon, exists
+}
+
+// Add registers monitor by its uuid.
+func (r *monitorRegistry) Add(mon *Monitor) {
+	r.mu.Lock()
+	r.m[mon.UUID.String()] = mon
+	r.mu.Unlock()
+}
+
+// Delete unregisters monitor by uuid string.
+func (r *monitorRegistry) Delete(u string) {
+	r.mu.Lock()
+	delete(r.m, u)
+	r.mu.Unlock()
+}
+
+// List returns all registered monitors.
+func (r *monitorRegistry) List() []*Monitor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]*Monitor, 0, len(r.m))
+	for _, mon := range r.m {
+		list = append(list, mon)
+	}
+	return list
+}
+
 func initQueries(dbtype string) error {
 	var err error
 
@@ -169,8 +270,23 @@ func initQueries(dbtype string) error {
 
 	// Database specific queries
 	// - pre: prerequisite configuration, database fixes and etc.
+	// - replaceInto, insertIgnore: insert replacing or skipping existing row
+	// - quoteId: quoted identifier which is a reserved word
+	// - timeOf: comparable value of time stored as RFC3339 text
+	// - dbTimeLayout: layout of stored times
+	var replaceInto, insertIgnore string
+	var quoteId, timeOf func(string) string
 	switch dbtype {
 	case "sqlite":
+		replaceInto = "INSERT OR REPLACE INTO"
+		insertIgnore = "INSERT OR IGNORE INTO"
+		quoteId = func(id string) string {
+			return `"` + id + `"`
+		}
+		timeOf = func(expr string) string {
+			return "strftime('%Y-%m-%d %H:%M:%f', " + expr + ")"
+		}
+		dbTimeLayout = time.RFC3339Nano
 		queries["_pre"] = `
 			PRAGMA automatic_index = ON;
 			PRAGMA busy_timeout = 50000000;
@@ -187,6 +303,10 @@ func initQueries(dbtype string) error {
 			PRAGMA temp_store = MEMORY;
 			PRAGMA wal_autocheckpoint = 16384;
 		`
+		queries["_db_size"] = `
+			SELECT p.page_count, f.freelist_count, s.page_size
+			FROM pragma_page_count() AS p, pragma_freelist_count() AS f, pragma_page_size() AS s;
+		`
 		/*
 		Sqlite Database PRAGMAs
 		@see http://www.sqlite.org/pragma.html
@@ -217,10 +337,24 @@ func initQueries(dbtype string) error {
 								 (default enabled 1000)
 		*/
 	case "mysql":
-			// TODO: mysql pragma?
-			fallthrough
-	default: 
+		replaceInto = "REPLACE INTO"
+		insertIgnore = "INSERT IGNORE INTO"
+		quoteId = func(id string) string {
+			return "`" + id + "`"
+		}
+		// Times are UTC of fixed width, so they are compared as text
+		timeOf = func(expr string) string {
+			return expr
+		}
+		dbTimeLayout = RFC3339Nano_Fixed
 		queries["_pre"] = ``
+		queries["_db_size"] = `
+			SELECT COALESCE(SUM(data_length + index_length + data_free), 0), COALESCE(SUM(data_free), 0), 1
+			FROM information_schema.tables
+			WHERE table_schema = DATABASE();
+		`
+	default:
+		return errors.New("Unknown database type")
 	}
 
 	// TABLE: monitors
@@ -235,7 +369,7 @@ func initQueries(dbtype string) error {
 		ORDER BY id;
 	`
 	queries["monitors_select_by_id"] = `
-		SELECT *
+		SELECT id, uuid, exp_id, setup_id, ` + quoteId("interval") + `, interval_ms, amount, duration, created, stopat, active, paused
 		FROM monitors
 		WHERE id = ?;
 	`
@@ -244,12 +378,12 @@ func initQueries(dbtype string) error {
 		FROM monitors;
 	`
 	queries["monitors_insert"] = `
-		INSERT INTO monitors (uuid, exp_id, setup_id, interval, amount, duration, created, stopat, active)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+		INSERT INTO monitors (uuid, exp_id, setup_id, ` + quoteId("interval") + `, interval_ms, amount, duration, created, stopat, active, paused)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 	`
 	queries["monitors_replace"] = `
-		INSERT OR REPLACE INTO monitors (id, uuid, exp_id, setup_id, interval, amount, duration, created, stopat, active)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+		` + replaceInto + ` monitors (id, uuid, exp_id, setup_id, ` + quoteId("interval") + `, interval_ms, amount, duration, created, stopat, active, paused)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 	`
 	queries["monitors_delete_by_id"] = `
 		DELETE FROM monitors
@@ -262,13 +396,118 @@ func initQueries(dbtype string) error {
 		FROM monitors_values
 		WHERE uuid = ?;
 	`
-	queries["_monitors_values_replace_into"] = `INSERT OR REPLACE INTO monitors_values(uuid, name, sensor, valueidx)`
+	queries["_monitors_values_replace_into"] = replaceInto + ` monitors_values(uuid, name, sensor, valueidx)`
 	queries["_monitors_values_replace_values"] = `(?, ?, ?, ?)`
 	queries["monitors_values_delete_by_uuid"] = `
 		DELETE FROM monitors_values
 		WHERE uuid = ?;
 	`
 
+	// TABLE: monitors_archives
+	queries["monitors_archives_select_by_uuid"] = `
+		SELECT step
+		FROM monitors_archives
+		WHERE uuid = ?
+		ORDER BY step;
+	`
+	queries["monitors_archives_insert"] = `
+		INSERT INTO monitors_archives (uuid, step)
+		VALUES (?, ?);
+	`
+	queries["monitors_archives_delete_by_uuid"] = `
+		DELETE FROM monitors_archives
+		WHERE uuid = ?;
+	`
+
+	// TABLE: monitors_changes
+	// Parameters of monitor applied since time, vals is JSON array of values.
+	queries["monitors_changes_select_by_uuid"] = `
+		SELECT time, interval_ms, amount, stopat, vals
+		FROM monitors_changes
+		WHERE uuid = ?
+		ORDER BY time;
+	`
+	queries["monitors_changes_insert"] = `
+		` + replaceInto + ` monitors_changes (uuid, time, interval_ms, amount, stopat, vals)
+		VALUES (?, ?, ?, ?, ?, ?);
+	`
+	queries["monitors_changes_delete_by_uuid"] = `
+		DELETE FROM monitors_changes
+		WHERE uuid = ?;
+	`
+
+	// TABLE: monitors_schedules
+	queries["monitors_schedules_select_all"] = `
+		SELECT uuid, start_at, spec, window_secs
+		FROM monitors_schedules;
+	`
+	queries["monitors_schedules_replace"] = `
+		` + replaceInto + ` monitors_schedules (uuid, start_at, spec, window_secs)
+		VALUES (?, ?, ?, ?);
+	`
+	queries["monitors_schedules_delete_by_uuid"] = `
+		DELETE FROM monitors_schedules
+		WHERE uuid = ?;
+	`
+
+	// TABLE: monitors_alarms
+	// Rule is JSON object of alarm options, reading is null if not valid.
+	queries["monitors_alarms_select_all"] = `
+		SELECT uuid, name, rule, state, cause, since, reading
+		FROM monitors_alarms;
+	`
+	queries["monitors_alarms_replace"] = `
+		` + replaceInto + ` monitors_alarms (uuid, name, rule, state, cause, since, reading)
+		VALUES (?, ?, ?, ?, ?, ?, ?);
+	`
+	queries["monitors_alarms_delete_by_uuid"] = `
+		DELETE FROM monitors_alarms
+		WHERE uuid = ?;
+	`
+
+	// TABLE: monitors_gaps
+	queries["monitors_gaps_select_by_uuid"] = `
+		SELECT start_at, end_at, cause
+		FROM monitors_gaps
+		WHERE uuid = ?
+		ORDER BY start_at;
+	`
+	queries["monitors_gaps_replace"] = `
+		` + replaceInto + ` monitors_gaps (uuid, start_at, end_at, cause)
+		VALUES (?, ?, ?, ?);
+	`
+	queries["monitors_gaps_delete_by_uuid"] = `
+		DELETE FROM monitors_gaps
+		WHERE uuid = ?;
+	`
+
+	// TABLE: monitors_pauses
+	// Open pause has empty resumed_at.
+	queries["monitors_pauses_select_by_uuid"] = `
+		SELECT paused_at, resumed_at
+		FROM monitors_pauses
+		WHERE uuid = ?
+		ORDER BY paused_at;
+	`
+	queries["monitors_pauses_select_open_by_uuid"] = `
+		SELECT paused_at
+		FROM monitors_pauses
+		WHERE uuid = ? AND resumed_at = '';
+	`
+	queries["monitors_pauses_insert"] = `
+		INSERT INTO monitors_pauses (uuid, paused_at, resumed_at)
+		VALUES (?, ?, '');
+	`
+	queries["monitors_pauses_update_resumed"] = `
+		UPDATE monitors_pauses
+		SET resumed_at = ?
+		WHERE uuid = ? AND resumed_at = '';
+	`
+	queries["monitors_pauses_delete_by_uuid"] = `
+		DELETE FROM monitors_pauses
+		WHERE uuid = ?;
+	`
+
 	// TABLE: monitors_counters
 	queries["monitors_counters_select_by_uuid"] = `
 		SELECT *
@@ -276,7 +515,7 @@ func initQueries(dbtype string) error {
 		WHERE uuid = ?;
 	`
 	queries["monitors_counters_replace"] = `
-		INSERT OR REPLACE INTO monitors_counters (uuid, done, err)
+		` + replaceInto + ` monitors_counters (uuid, done, err)
 		VALUES (?, ?, ?);
 	`
 	queries["monitors_counters_update_all_by_uuid"] = `
@@ -294,6 +533,11 @@ func initQueries(dbtype string) error {
 		SET err = err + ?
 		WHERE uuid = ?;
 	`
+	queries["monitors_counters_subtract_by_uuid"] = `
+		UPDATE monitors_counters
+		SET done = done - ?, err = err - ?
+		WHERE uuid = ?;
+	`
 	queries["monitors_counters_delete_by_uuid"] = `
 		DELETE FROM monitors_counters
 		WHERE uuid = ?;
@@ -304,25 +548,25 @@ func initQueries(dbtype string) error {
 		SELECT time, sensor_id, sensor_val_id, detection, error
 		FROM detections
 		WHERE (mon_id = ?)
-		ORDER BY strftime("%Y-%m-%d %H:%M:%f", time), sensor_id, sensor_val_id;
+		ORDER BY ` + timeOf("time") + `, sensor_id, sensor_val_id;
 	`
 	queries["detections_select_by_monitor_time_from"] = `
 		SELECT time, sensor_id, sensor_val_id, detection, error
 		FROM detections
-		WHERE (mon_id = ?) AND (strftime("%Y-%m-%d %H:%M:%f", time) >= strftime("%Y-%m-%d %H:%M:%f", ?))
-		ORDER BY strftime("%Y-%m-%d %H:%M:%f", time), sensor_id, sensor_val_id;
+		WHERE (mon_id = ?) AND (` + timeOf("time") + ` >= ` + timeOf("?") + `)
+		ORDER BY ` + timeOf("time") + `, sensor_id, sensor_val_id;
 	`
 	queries["detections_select_by_monitor_time_to"] = `
 		SELECT time, sensor_id, sensor_val_id, detection, error
 		FROM detections
-		WHERE (mon_id = ?) AND (strftime("%Y-%m-%d %H:%M:%f", time) <= strftime("%Y-%m-%d %H:%M:%f", ?))
-		ORDER BY strftime("%Y-%m-%d %H:%M:%f", time), sensor_id, sensor_val_id;
+		WHERE (mon_id = ?) AND (` + timeOf("time") + ` <= ` + timeOf("?") + `)
+		ORDER BY ` + timeOf("time") + `, sensor_id, sensor_val_id;
 	`
 	queries["detections_select_by_monitor_time_range"] = `
 		SELECT time, sensor_id, sensor_val_id, detection, error
 		FROM detections
-		WHERE (mon_id = ?) AND (strftime("%Y-%m-%d %H:%M:%f", time) BETWEEN strftime("%Y-%m-%d %H:%M:%f", ?) AND strftime("%Y-%m-%d %H:%M:%f", ?))
-		ORDER BY strftime("%Y-%m-%d %H:%M:%f", time), sensor_id, sensor_val_id;
+		WHERE (mon_id = ?) AND (` + timeOf("time") + ` BETWEEN ` + timeOf("?") + ` AND ` + timeOf("?") + `)
+		ORDER BY ` + timeOf("time") + `, sensor_id, sensor_val_id;
 	`
 	queries["detections_count_by_monitor"] = `
 		SELECT COUNT(*)
@@ -336,7 +580,7 @@ func initQueries(dbtype string) error {
 			FROM detections
 			WHERE mon_id = ?
 			GROUP BY time
-		);
+		) AS t;
 	`
 	queries["detections_count_by_monitor_sensor"] = `
 		SELECT COUNT(*)
@@ -347,7 +591,7 @@ func initQueries(dbtype string) error {
 		SELECT time
 		FROM detections
 		WHERE mon_id = ?
-		ORDER BY strftime("%Y-%m-%d %H:%M:%f", time) DESC
+		ORDER BY ` + timeOf("time") + ` DESC
 		LIMIT 1;
 	`
 	queries["detections_insert"] = `
@@ -360,6 +604,77 @@ func initQueries(dbtype string) error {
 		DELETE FROM detections
 		WHERE mon_id = ?;
 	`
+	queries["detections_count_by_monitor_before"] = `
+		SELECT COUNT(*)
+		FROM detections
+		WHERE (mon_id = ?) AND (` + timeOf("time") + ` < ` + timeOf("?") + `);
+	`
+	queries["detections_count_times_by_monitor"] = `
+		SELECT COUNT(*), COALESCE(SUM(failed), 0)
+		FROM (
+			SELECT time, MAX(CASE WHEN detection IS NULL THEN 1 ELSE 0 END) AS failed
+			FROM detections
+			WHERE mon_id = ?
+			GROUP BY time
+		) AS t;
+	`
+	queries["detections_count_times_by_monitor_before"] = `
+		SELECT COUNT(*), COALESCE(SUM(failed), 0)
+		FROM (
+			SELECT time, MAX(CASE WHEN detection IS NULL THEN 1 ELSE 0 END) AS failed
+			FROM detections
+			WHERE (mon_id = ?) AND (` + timeOf("time") + ` < ` + timeOf("?") + `)
+			GROUP BY time
+		) AS t;
+	`
+	queries["detections_delete_by_monitor_before"] = `
+		DELETE FROM detections
+		WHERE (mon_id = ?) AND (` + timeOf("time") + ` < ` + timeOf("?") + `);
+	`
+	queries["detections_count"] = `
+		SELECT COUNT(*)
+		FROM detections;
+	`
+
+	// TABLE: detections_archives
+	// Consolidated detections by time buckets of archive step.
+	// Bucket row is created empty and then updated,
+	// CASE expressions use old values of the row
+	// (mysql assigns from left to right, so cnt is the last).
+	queries["detections_archives_insert_ignore"] = `
+		` + insertIgnore + ` detections_archives (mon_id, step, time, sensor_id, sensor_val_id, cnt, sum, min, max, last)
+		VALUES (?, ?, ?, ?, ?, 0, 0, NULL, NULL, NULL);
+	`
+	queries["detections_archives_update"] = `
+		UPDATE detections_archives
+		SET sum = sum + ?,
+			min = CASE WHEN cnt = 0 OR ? < min THEN ? ELSE min END,
+			max = CASE WHEN cnt = 0 OR ? > max THEN ? ELSE max END,
+			last = ?,
+			cnt = cnt + 1
+		WHERE mon_id = ? AND step = ? AND time = ? AND sensor_id = ? AND sensor_val_id = ?;
+	`
+	queries["detections_archives_select_by_monitor_time_range"] = `
+		SELECT time, sensor_id, sensor_val_id, cnt, sum, min, max, last
+		FROM detections_archives
+		WHERE (mon_id = ?) AND (step = ?)
+			AND (? = '' OR ` + timeOf("time") + ` >= ` + timeOf("?") + `)
+			AND (? = '' OR ` + timeOf("time") + ` <= ` + timeOf("?") + `)
+		ORDER BY ` + timeOf("time") + `, sensor_id, sensor_val_id;
+	`
+	queries["detections_archives_count_by_monitor_step"] = `
+		SELECT COUNT(DISTINCT time)
+		FROM detections_archives
+		WHERE mon_id = ? AND step = ?;
+	`
+	queries["detections_archives_delete_by_monitor"] = `
+		DELETE FROM detections_archives
+		WHERE mon_id = ?;
+	`
+	queries["detections_archives_delete_by_monitor_before"] = `
+		DELETE FROM detections_archives
+		WHERE (mon_id = ?) AND (` + timeOf("time") + ` < ` + timeOf("?") + `);
+	`
 
 	// Prepare statements
 	stmts = make(map[string]*sql.Stmt)
@@ -400,23 +715,32 @@ func prepareDB() error {
 }
 
 func monitorToDB(mon *Monitor) (monDBi *MonitorDBItem, err error) {
+	mon.mu.RLock()
+	defer mon.mu.RUnlock()
+
 	uuid := mon.UUID.String()
 	values := make([]MonValue, len(mon.Values))
 	copy(values, mon.Values)
+	archives := make([]uint, len(mon.Archives))
+	copy(archives, mon.Archives)
 	monDBi = &MonitorDBItem{
 		mon.Id,
 		uuid,
 		mon.Exp_id,
 		mon.Setup_id,
 		mon.Step,
+		mon.StepMs,
 		mon.Amount,
 		mon.Duration,
 		mon.Created.UTC().Format(time.RFC3339Nano),
 		mon.StopAt.UTC().Format(time.RFC3339Nano),
 		mon.Active,
+		mon.Paused,
 
 		values,
 		mon.Counters,
+
+		archives,
 	}
 	return monDBi, nil
 }
@@ -455,220 +779,65 @@ func monitorFromDB(mondbi *MonitorDBItem) (mon *Monitor, err error) {
 	*/
 	values := make([]MonValue, len(mondbi.Values))
 	copy(values, mondbi.Values)
+	archives := make([]uint, len(mondbi.Archives))
+	copy(archives, mondbi.Archives)
 	mon = &Monitor{
 		mondbi.Id,
 		uuid,
 		mondbi.Exp_id,
 		mondbi.Setup_id,
 		mondbi.Step,
+		mondbi.StepMs,
 		mondbi.Amount,
 		mondbi.Duration,
 		created,
 		stopAt,
 		mondbi.Active,
+		mondbi.Paused,
 
+		nil,
 		nil,
 		values,
 		mondbi.Counters,
+		archives,
+		sync.RWMutex{},
 	}
 	return mon, nil
 }
 
-// loadMonitor reads database item and creates a new Monitor
+// loadMonitor reads storage item and creates a new Monitor
 // object.
 func loadMonitor(monid int) (*Monitor, error) {
-	var err, err2 error
-
-	mondbi := MonitorDBItem{}
-	mondbi.Values = make([]MonValue, 0)
-
-	tx, err := db.Begin()
+	mondbi, err := store.LoadMonitor(monid)
 	if err != nil {
 		return nil, err
 	}
 
-	// Load Monitor
-	row := tx.Stmt(stmts["monitors_select_by_id"]).QueryRow(monid)
-	err = row.Scan(
-		&mondbi.Id,
-		&mondbi.UUID,
-		&mondbi.Exp_id,
-		&mondbi.Setup_id,
-		&mondbi.Step,
-		&mondbi.Amount,
-		&mondbi.Duration,
-		&mondbi.Created,
-		&mondbi.StopAt,
-		&mondbi.Active,
-	)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// there were no rows, but otherwise no error occurred
-			err = errors.New("Fatal Monitor Select Stmt QueryRow: " + err.Error())
-			return nil, err
-		} else {
-			//fmt.Printf(LPURPLE+"loadMonitor#%05d:"+RED+" Fatal Monitor Select Stmt QueryRow %s, continue\n"+NCO, monid, err)
-			logger.Print("Fatal Monitor Select Stmt QueryRow: " + err.Error())
-			err2 = tx.Rollback()
-			if err2 != nil {
-				//fmt.Printf(LPURPLE+"loadMonitor#%05d:"+RED+" Fatal Monitor Select Stmt Rollback %s, continue\n"+NCO, monid, err2)
-				logger.Print("Fatal Monitor Select Stmt Rollback: " + err2.Error())
-				return nil, err2
-			}
-			return nil, err
-		}
-	}
-
-	// Load Monitor Values
-	rows, err := tx.Stmt(stmts["monitors_values_select_by_uuid"]).Query(mondbi.UUID)
-	if err != nil {
-		//fmt.Printf(LPURPLE+"loadMonitor#%05d:"+RED+" Fatal Monitor UUID %s Values Stmt Query %s, continue\n"+NCO, monid, mondbi.UUID, err)
-		logger.Printf("Fatal Monitor UUID %s Values Stmt Query: %s\n", mondbi.UUID, err.Error())
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LPURPLE+"loadMonitor#%05d:"+RED+" Fatal Monitor UUID %s Values Stmt Rollback %s, continue\n"+NCO, monid, mondbi.UUID, err2)
-			logger.Printf("Fatal Monitor UUID %s Values Stmt Rollback: %s\n", mondbi.UUID, err2.Error())
-			return nil, err2
-		}
-		return nil, err2
-	}
-	defer rows.Close()
-	monuuid := ""
-	for rows.Next() {
-		monv := new(MonValue)
-
-		err = rows.Scan(&monuuid, &monv.Name, &monv.Sensor, &monv.ValueIdx)
-		if err != nil {
-			//fmt.Printf(LPURPLE+"loadMonitor#%05d:"+RED+" Fatal Scan Monitor UUID %s Values %s, continue\n"+NCO, monid, mondbi.UUID, err)
-			logger.Printf("Fatal Scan Monitor UUID %s Values: %s", mondbi.UUID, err.Error())
-			// no need Rollback
-			continue
-		}
-
-		mondbi.Values = append(mondbi.Values, *monv)
-	}
-
-	// Load Monitor Counters
-	row = tx.Stmt(stmts["monitors_counters_select_by_uuid"]).QueryRow(mondbi.UUID)
-	err = row.Scan(&monuuid, &mondbi.Counters.Done, &mondbi.Counters.Err)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// there were no rows, but otherwise no error occurred
-			err = errors.New("Fatal Monitor Counters Select Stmt QueryRow: " + err.Error())
-			return nil, err
-		} else {
-			//fmt.Printf(LPURPLE+"loadMonitor#%05d:"+RED+" Fatal Monitor Counters Select Stmt QueryRow %s, continue\n"+NCO, monid, err)
-			logger.Print("Fatal Monitor Counters Select Stmt QueryRow: " + err.Error())
-			err2 = tx.Rollback()
-			if err2 != nil {
-				//fmt.Printf(LPURPLE+"loadMonitor#%05d:"+RED+" Fatal Monitor Counters Select Stmt Rollback %s, continue\n"+NCO, monid, err2)
-				logger.Print("Fatal Monitor Counters Select Stmt Rollback: " + err2.Error())
-				return nil, err2
-			}
-			return nil, err
-		}
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		//fmt.Printf(LPURPLE+"loadMonitor#%05d:"+RED+" Fatal Commit Load Monitor %s, exiting\n"+NCO, err)
-		logger.Printf("Fatal Commit Load Monitor %s, exiting\n", err.Error())
-		return nil, err
+	// Monitors created before millisecond steps
+	if mondbi.StepMs == 0 {
+		mondbi.StepMs = mondbi.Step * 1000
 	}
 
 	// Convert Monitor from DB 
-	mon, err := monitorFromDB(&mondbi)
-	if err != nil {
-		return nil, err
-	}
-
-	return mon, err
+	return monitorFromDB(mondbi)
 }
 
 // loadRunMonitors looks for saved monitors, loads them and run those having
 // state active.
 func loadRunMonitors() error {
-	var err, err2 error
 	var monid int
 
 	logger.Print("Loading monitors...")
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-
-	// Count monitors
-	row := tx.Stmt(stmts["monitors_count"]).QueryRow()
-	var count int64 = 0
-	err = row.Scan(&count)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// there were no rows, but otherwise no error occurred
-			count = 0
-		} else {
-			//fmt.Printf(LPURPLE+"loadRunMonitors:"+RED+" Fatal Monitor Count Stmt %s, exiting\n"+NCO, err)
-			logger.Print("Fatal Monitor Count Stmt Query: " + err.Error())
-			err2 = tx.Rollback()
-			if err2 != nil {
-				//fmt.Printf(LPURPLE+"loadRunMonitors:"+RED+" Fatal Monitor Count Stmt Rollback %s, exiting\n"+NCO, err2)
-				logger.Print("Fatal Monitor Count Stmt Rollback: " + err2.Error())
-				return err2
-			}
-			return err
-		}
-	}
-
-	monitors = make(map[string]*Monitor, count)
-
-	// Load monitors
-	// Prepare statement
-	rows, err := tx.Stmt(stmts["monitors_select_all_id"]).Query()
+	monids, err := store.MonitorIds()
 	if err != nil {
-		//fmt.Printf(LPURPLE+"loadRunMonitors:"+RED+" Fatal Monitor All Ids Stmt Query %s, exiting\n"+NCO, err)
-		logger.Print("Fatal Monitor All Ids Stmt Query: " + err.Error())
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LPURPLE+"loadRunMonitors:"+RED+" Fatal Monitor All Ids Stmt Rollback %s, exiting\n"+NCO, err2)
-			logger.Print("Fatal Monitor All Ids Stmt Rollback: " + err2.Error())
-			return err2
-		}
 		return err
 	}
-	defer rows.Close()
 
 	uuids := make([]string, 0)  // DEBUG
 
-	// Collect monitor ids
-	monids := make([]int, 0, count)
-	for rows.Next() {
-		monid = 0
-
-		err = rows.Scan(&monid)
-		if err != nil {
-			//fmt.Printf(LPURPLE+"loadRunMonitors:"+RED+" Fatal Scan Monitor Id %s, exiting\n"+NCO, err)
-			logger.Printf("Fatal Scan Monitor Id: %s", err.Error())
-			// no need Rollback
-			continue
-		}
-		if monid == 0 {
-			continue
-		}
-
-		monids = append(monids, monid)
-	}
-	// CLOSE ROWS HERE!???
-	//rows.Close()
-
-	err = tx.Commit()
-	if err != nil {
-		//fmt.Printf(LPURPLE+"loadRunMonitors:"+RED+" Fatal Commit Get Ids Monitors %s, exiting\n"+NCO, err)
-		logger.Printf("Fatal Commit Get Ids Monitors %s, exiting\n", err.Error())
-		return err
-	}
-
 	// Load
-	count = 0
+	count := 0
 	for _, monid = range monids {
 		mon, err := loadMonitor(monid)
 		if err != nil {
@@ -676,7 +845,16 @@ func loadRunMonitors() error {
 			continue
 		}
 
-		if mon.Active {
+		if mon.Active && mon.Paused {
+			// StopAt of monitor in Duration mode is shifted on resume,
+			// only monitor with fixed deadline expires while paused
+			if mon.Duration == 0 && (!mon.StopAt.IsZero()) && mon.StopAt.Before(time.Now()) {
+				err = mon.Stop()
+				if err != nil {
+					logger.Print(err)
+				}
+			}
+		} else if mon.Active {
 			run := true
 			if (!mon.StopAt.IsZero()) && mon.StopAt.Before(time.Now()) {
 				// condition for Duration or/and Amount mode (with deadline time)
@@ -687,6 +865,12 @@ func loadRunMonitors() error {
 			}
 
 			if run {
+				// Detections were not made while daemon was down
+				last, lerr := store.LastTime(mon.Id)
+				if lerr != nil {
+					logger.Print(lerr)
+				}
+				mon.addGap(last, time.Now(), time.Duration(mon.StepMs) * time.Millisecond, GAP_DOWN)
 				err = mon.Run()
 			} else {
 				mon.Active = false
@@ -696,7 +880,7 @@ func loadRunMonitors() error {
 				logger.Print(err)
 			}
 		}
-		monitors[mon.UUID.String()] = mon
+		monitors.Add(mon)
 
 		count++
 		uuids = append(uuids, mon.UUID.String())
@@ -706,7 +890,13 @@ func loadRunMonitors() error {
 	//fmt.Printf(LPURPLE+"loadRunMonitors#%-23s:"+NCO+" Count Monitors %d Rows %s\n", time.Now().UTC().Format(time.RFC3339Nano), count, uuids_list)
 	logger.Printf("Found %d monitors: [%s]\n", count, uuids_list)
 
-	return nil
+	err = loadAlarms()
+	if err != nil {
+		return err
+	}
+
+	// Re-arm schedules of paused monitors
+	return loadSchedules()
 }
 
 // initDB(config.Database) initialize database instance, loads them and run those having
@@ -733,17 +923,20 @@ func initDB(dbconf DatabaseConf) (*sql.DB, error) {
 		// TODO: Check connection (cannot use Ping() with sqlite, cannot test file exists instead of DSN string params)
 
 	case "mysql":
-		// Todo: add instantiate mysql database
+		dbo, err = sql.Open("mysql", dbconf.Dsn)
+		if err != nil {
+			return nil, err
+		}
+		dbo.SetMaxOpenConns(int(dbconf.MaxOpen))
+		dbo.SetMaxIdleConns(int(dbconf.MaxIdle))
+		dbo.SetConnMaxLifetime(time.Duration(dbconf.MaxLifetime) * time.Second)
 
-		/*
 		// Check connection
 		err = dbo.Ping()
 		if err != nil {
+			dbo.Close()
 			return nil, err
 		}
-		*/
-
-		fallthrough
 
 	default:
 		err = errors.New("Unknown database type")
@@ -756,39 +949,72 @@ func initDB(dbconf DatabaseConf) (*sql.DB, error) {
 }
 
 func (mon *Monitor) Run() error {
-	d := time.Duration(mon.Step) * time.Second
+	mon.mu.Lock()
+	d := time.Duration(mon.StepMs) * time.Millisecond
+	stop := make(chan int, 1)
+	mon.stop = stop
+	finished := make(chan struct{})
+	mon.finished = finished
+	values := make([]MonValue, len(mon.Values))
+	copy(values, mon.Values)
+	source := mon.UUID.String()
+	mon.mu.Unlock()
+
 	t := time.NewTicker(d)
-	mon.stop = make(chan int, 1)
 	go func() {
-		readings := make([](chan float64), len(mon.Values))
+		defer close(finished)
+		defer t.Stop()
+		readings := make([](chan readResult), len(values))
 		for i := range readings {
-			readings[i] = make(chan float64, 1)
+			readings[i] = make(chan readResult, 1)
 		}
-		vals := make([]interface{}, len(mon.Values)+1)
+		vals := make([]interface{}, len(values)+1)
+		step := d
+		var last time.Time
+
 		for {
 			select {
 			case tm := <-t.C:
-				if (!mon.StopAt.IsZero()) && mon.StopAt.Before(tm) {
-					// condition for Duration or/and Amount mode (with deadline time)
-					mon.Stop()
-				} else if (mon.Amount > 0) && (mon.Counters.Done >= mon.Amount) {
-					// condition only for Amount mode
-					mon.Stop()
+				// ticks are dropped while readings are slow
+				mon.addGap(last, tm, step, GAP_MISSED)
+				last = tm
+				mon.mu.RLock()
+				// condition for Duration or/and Amount mode (with deadline time)
+				done := (!mon.StopAt.IsZero()) && mon.StopAt.Before(tm)
+				// condition only for Amount mode
+				done = done || (mon.Amount > 0) && (mon.Counters.Done >= mon.Amount)
+				mon.mu.RUnlock()
+				if done {
+					mon.stopRun(false)
 				}
-				if len(mon.stop) > 0 {
+				if len(stop) > 0 {
+					writes.Flush()
 					return
 				}
-				for i, v := range mon.Values {
+				for i, v := range values {
 					go getSerData(v.Sensor, v.ValueIdx, readings[i])
 				}
 				vals[0] = tm
+				d := &SerData{Time: tm, Readings: make([]float64, len(readings))}
 				for i, c := range readings {
-					vals[i+1] = <-c
-					mon.Values[i].previous = vals[i+1].(float64)
+					r := <-c
+					vals[i+1] = r.Value
+					d.Readings[i] = r.Value
+					if r.Cause != "" {
+						d.setError(i, r.Cause)
+					}
+				}
+				mon.mu.Lock()
+				for i := range d.Readings {
+					mon.Values[i].previous = d.Readings[i]
 				}
 				mon.incCounters(vals...)
-				mon.Update(vals...)
-			case <-mon.stop:
+				mon.mu.Unlock()
+				writes.Add(mon, d)
+				streams.Publish(source, d)
+				alarms.Check(source, tm, values, d.Readings)
+			case <-stop:
+				writes.Flush()
 				return
 			}
 		}
@@ -796,6 +1022,15 @@ func (mon *Monitor) Run() error {
 	return nil
 }
 
+// IsActive reports if monitor is active.
+func (mon *Monitor) IsActive() bool {
+	mon.mu.RLock()
+	defer mon.mu.RUnlock()
+	return mon.Active
+}
+
+// incCounters increments counters of done and failed detections.
+// Monitor must be locked.
 func (mon *Monitor) incCounters(vals ...interface{}) {
 	// Check for errors
 	is_err := false
@@ -828,498 +1063,591 @@ func (mon *Monitor) incCounters(vals ...interface{}) {
 }
 
 func (mon *Monitor) Update(vals ...interface{}) error {
-	var err,err2 error
-
-	is_err := false
-	no_data := false
-	
 	// Works with mon copy
-	// TODO: fix concurrent read access with sync.RWMutex, mon.RLock()
 	monDBi, err := monitorToDB(mon)
 	if err != nil {
 		return err
 	}
 
-	if len(vals) < 2 {
-		/*
-		errf := fmt.Errorf("Update Error: no new detections for %s", monDBi.UUID))
-		if errf != nil {
-			return errf
-		}
-		*/
-		is_err = true
-		no_data = true
+	// Missing detections are errors
+	row := rowOf(vals...)
+
+	_, err = store.AppendDetections([]MonitorRows{{monDBi, []*SerData{row}}}, true)
+	return err
+}
+
+func (mon *Monitor) Stop() error {
+	return mon.stopRun(true)
+}
+
+// stopRun deactivates monitor. If wait is true, it waits until
+// pending detections are written by running monitor.
+func (mon *Monitor) stopRun(wait bool) error {
+	mon.mu.Lock()
+	if !mon.Active {
+		mon.mu.Unlock()
+		//logger.Print("Monitor " + mon.UUID.String() + " is inactive")
+		return nil
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+	select {
+	case mon.stop <- 1:
+	default:
 	}
 
-	// Update Detections
-	if !no_data {
-		var nulltime time.Time
-		tm, ok := vals[0].(time.Time)
-		if !ok {
-			tm = nulltime
-		}
-
-		det := DetectionDBItem{
-			Id:             0,
-			Exp_id:         monDBi.Exp_id,
-			Mon_id:         monDBi.Id,
-			Time:           tm.UTC().Format(time.RFC3339Nano),
-			Sensor_id:      "",
-			Sensor_val_id:  0,
-			Detection:      0,
-			Error:          "",  // TODO: remode old error field
-		}
-
-		sqlInsert := queries["_detections_insert_into"] + " VALUES "
-		values := []interface{}{}
-		for i, v := range vals {
-			if i == 0 {
-				// Skip time
-				continue
-			}
+	mon.Active = false
+	paused := mon.Paused
+	mon.Paused = false
+	finished := mon.finished
+	mon.mu.Unlock()
 
-			sqlInsert += queries["_detections_insert_values"] + ","
+	if wait && finished != nil {
+		<-finished
+	}
 
-			det_error := sql.NullString{String:"", Valid:false}
-			det_value := sql.NullFloat64{Float64:0, Valid:false}
-			var found bool
+	if paused {
+		_, err := mon.closePause(time.Now())
+		if err != nil {
+			logger.Print("error closing pause of monitor " + mon.UUID.String() + ": " + err.Error())
+		}
+	}
 
-			// Check error value
-			if det_value.Float64, found = v.(float64); !found {
-				det_value.Float64 = math.NaN()
-			}
-			if math.IsNaN(det_value.Float64) {
-				det_error.String = "NaN"
-				det_error.Valid = true
-				is_err = true
-			} else {
-				det_value.Valid = true
-			}
+	streams.Close(mon.UUID.String())
+	logger.Print("Monitor.Stop: ok (" + mon.UUID.String() + ")")
 
-			values = append(values,
-				det.Exp_id,
-				det.Mon_id,
-				det.Time,
-				monDBi.Values[i-1].Sensor,
-				monDBi.Values[i-1].ValueIdx,
-				det_value,
-				det_error,
-			)
-		}
-		sqlInsert = strings.TrimSuffix(sqlInsert, ",")
-		//logger.Printf("Update: Debug sqlInsert: %s", sqlInsert)
-		//logger.Printf("Update: Debug sqlInsert vals: %+v", values)
-		// Prepare the statement
-		stmt, err := tx.Prepare(sqlInsert)
-		if err != nil {
-			err2 = tx.Rollback()
-			if err2 != nil {
-				return err2
-			}
+	return mon.Save()
+}
 
-			return err
-		}
+// Pause stops detections of active monitor until Resume,
+// pause interval is recorded.
+func (mon *Monitor) Pause() error {
+	mon.mu.Lock()
+	if !mon.Active {
+		mon.mu.Unlock()
+		return errors.New("monitor is not active")
+	}
+	if mon.Paused {
+		mon.mu.Unlock()
+		return errors.New("monitor is already paused")
+	}
 
-		// Execute
-		//res, err := stmt.Exec(values...)
-		_, err = stmt.Exec(values...)
-		if err != nil {
-			err2 = tx.Rollback()
-			if err2 != nil {
-				return err2
-			}
+	mon.Paused = true
+	mon.mu.Unlock()
 
-			return err
-		}
+	mon.halt()
 
-		//logger.Printf("Update: Inserted for Monitor %s Count Detections %d", monDBi.Id, res.RowsAffected())
+	err := store.AddPause(mon.UUID.String(), time.Now())
+	if err != nil {
+		return err
 	}
 
-	// Update Counters
-	// Execute
-	if is_err {
-		//res, err = tx.Stmt(stmts["monitors_counters_update_all_by_uuid"]).Exec(1, 1, monDBi.UUID)
-		_, err = tx.Stmt(stmts["monitors_counters_update_all_by_uuid"]).Exec(1, 1, monDBi.UUID)
-	} else {
-		//res, err = tx.Stmt(stmts["monitors_counters_update_done_by_uuid"]).Exec(1, monDBi.UUID)
-		_, err = tx.Stmt(stmts["monitors_counters_update_done_by_uuid"]).Exec(1, monDBi.UUID)
+	logger.Print("Monitor.Pause: ok (" + mon.UUID.String() + ")")
+
+	return mon.Save()
+}
+
+// Resume restarts detections of paused monitor. StopAt of monitor
+// in Duration mode is shifted by pause length, so monitor runs for
+// whole Duration. Monitor is stopped if its stop condition is reached.
+func (mon *Monitor) Resume() error {
+	return mon.resume(true)
+}
+
+// resume restarts detections of paused monitor, StopAt of monitor
+// in Duration mode is shifted by pause length if shift is true.
+func (mon *Monitor) resume(shift bool) error {
+	// Check and leave pause at once, so concurrent resumes
+	// do not run monitor twice
+	mon.mu.Lock()
+	if !mon.Active {
+		mon.mu.Unlock()
+		return errors.New("monitor is not active")
 	}
+	if !mon.Paused {
+		mon.mu.Unlock()
+		return errors.New("monitor is not paused")
+	}
+	mon.Paused = false
+	mon.mu.Unlock()
+
+	now := time.Now()
+	d, err := mon.closePause(now)
 	if err != nil {
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LBLUE+"Save:"+RED+" Fatal Save Monitor Counters Update Stmt Rollback %s, exiting\n"+NCO, err2)
-			//logger.Printf("Fatal Save Monitor Counters Update Stmt Rollback %s: %s: ", monDBi.UUID, err2.Error())
-			return err2
-		}
+		mon.mu.Lock()
+		mon.Paused = mon.Active
+		mon.mu.Unlock()
 		return err
 	}
 
-	//logger.Printf("Update: Updated for Monitor %s Counters %d", monDBi.Id, res.RowsAffected())
+	mon.mu.Lock()
+	if shift && mon.Duration > 0 && !mon.StopAt.IsZero() {
+		mon.StopAt = mon.StopAt.Add(d)
+	}
+	// condition for Duration or/and Amount mode (with deadline time)
+	done := (!mon.StopAt.IsZero()) && mon.StopAt.Before(now)
+	// condition only for Amount mode
+	done = done || (mon.Amount > 0) && (mon.Counters.Done >= mon.Amount)
+	mon.mu.Unlock()
+
+	if done {
+		return mon.Stop()
+	}
 
-	err = tx.Commit()
+	err = mon.Save()
 	if err != nil {
-		//fmt.Printf(LBLUE+"Update:"+RED+" Fatal Commit Update Detections for %s: %s\n"+NCO, monDBi.UUID, err.Error())
-		//logger.Printf("Update: Fatal Commit Update Detections for %s: %s", monDBi.UUID, err.Error())
 		return err
 	}
 
-	//fmt.Printf(LBLUE+"Update %-23s:"+NCO+" insert detections\n", time.Now().Format("2006-01-02T15:04:05.999"))
-	//logger.Printf("Update %-23s: insert detections for %s", time.Now().Format("2006-01-02T15:04:05.999"), monDBi.UUID)
+	logger.Print("Monitor.Resume: ok (" + mon.UUID.String() + ")")
 
-	return nil
+	return mon.Run()
 }
 
-func (mon *Monitor) Stop() error {
-	// TODO: fix concurrent read/write access with sync.RWMutex
-	if !mon.Active {
-		//logger.Print("Monitor " + mon.UUID.String() + " is inactive")
-		return nil
-	}
-
+// halt stops detections of running monitor and waits
+// until pending detections are written. Monitor stays active.
+func (mon *Monitor) halt() {
+	mon.mu.Lock()
 	select {
 	case mon.stop <- 1:
 	default:
 	}
+	finished := mon.finished
+	mon.mu.Unlock()
 
-	mon.Active = false
-	logger.Print("Monitor.Stop: ok (" + mon.UUID.String() + ")")
-
-	return mon.Save()
+	if finished != nil {
+		<-finished
+	}
 }
 
-func (mon *Monitor) SaveNew() error {
-	var err,err2 error
+// Change modifies parameters of monitor. Parameters applied before
+// are saved to monitor changes history. Running monitor is restarted
+// with new step and values.
+func (mon *Monitor) Change(opts *MonUpdateOpts) error {
+	now := time.Now()
 
-	// Works with mon copy
-	// TODO: fix concurrent read access with sync.RWMutex, mon.RLock()
 	monDBi, err := monitorToDB(mon)
 	if err != nil {
 		return err
 	}
-
-	// as New Monitor
-	monDBi.Id = 0
-
-	tx, err := db.Begin()
+	history, err := monDBi.changes()
 	if err != nil {
 		return err
 	}
 
-	// Insert new monitor
-	res, err := tx.Stmt(stmts["monitors_insert"]).Exec(
-		monDBi.UUID,
-		monDBi.Exp_id,
-		monDBi.Setup_id,
-		monDBi.Step,
-		monDBi.Amount,
-		monDBi.Duration,
-		monDBi.Created,
-		monDBi.StopAt,
-		monDBi.Active,
-	)
-	if err != nil {
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LBLUE+"SaveNew:"+RED+" Fatal Save Monitor Insert Stmt Rollback %s, exiting\n"+NCO, err2)
-			//logger.Printf("Fatal Save Monitor Insert Stmt Rollback %s: %s: ", monDBi.UUID, err2.Error())
-			return err2
-		}
-		return err
+	// Step
+	step, stepMs := monDBi.Step, monDBi.StepMs
+	if opts.StepMs != nil && *opts.StepMs > 0 {
+		stepMs = *opts.StepMs
+		step = (stepMs + 999) / 1000
+	} else if opts.Step != nil && *opts.Step > 0 {
+		step = *opts.Step
+		stepMs = step * 1000
 	}
-	id, err := res.LastInsertId()
-	if err != nil {
-		// not supported? ErrNotSupported?
-
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LBLUE+"SaveNew:"+RED+" Fatal Save Monitor LastInsertId Stmt Rollback %s, exiting\n"+NCO, err2)
-			//logger.Printf("Fatal Save Monitor LastInsertId Stmt Rollback %s: %s: ", monDBi.UUID, err2.Error())
-			return err2
+	for _, a := range monDBi.Archives {
+		if a <= step {
+			return fmt.Errorf("archive step %d must be greater than monitor step %d", a, step)
 		}
-		return err
 	}
 
-	// assign returned id
-	// XXX: issue with overflow may be here, need int64 type in structs
-	monDBi.Id = int(id)
-	// TODO: fix concurrent write access with sync.RWMutex, mon.Lock(), but there are no runned mon yet, just creation
-	mon.Id = int(id)
-
-	// Save Monitor Values
-	// only once
-	sqlInsert := queries["_monitors_values_replace_into"] + " VALUES "
-	values := []interface{}{}
-	for _, monv := range monDBi.Values {
-		sqlInsert += queries["_monitors_values_replace_values"] + ","
-		values = append(values,
-			monDBi.UUID,
-			monv.Name,
-			monv.Sensor,
-			monv.ValueIdx,
-		)
-	}
-	sqlInsert = strings.TrimSuffix(sqlInsert, ",")
-
-	// Prepare the statement
-	stmt, err := tx.Prepare(sqlInsert)
+	// Stop conditions
+	stopAt, err := time.Parse(time.RFC3339Nano, monDBi.StopAt)
 	if err != nil {
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LBLUE+"SaveNew:"+RED+" Fatal Save Monitor Values Insert Prepare Rollback %s, exiting\n"+NCO, err2)
-			//logger.Printf("Fatal Save Monitor Values Insert Prepare Rollback %s: %s: ", monDBi.UUID, err2.Error())
-			return err2
-		}
 		return err
 	}
+	if opts.StopAt != nil {
+		if (!opts.StopAt.IsZero()) && opts.StopAt.Before(now) {
+			return errors.New("monitor stop time is in the past")
+		}
+		stopAt = *opts.StopAt
+	}
+	amount := monDBi.Amount
+	if opts.Amount != nil {
+		amount = *opts.Amount
+	}
 
-	// Execute
-	//res, err := stmt.Exec(values...)
-	_, err = stmt.Exec(values...)
-	if err != nil {
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LBLUE+"SaveNew:"+RED+" Fatal Save Monitor Values Insert Exec Rollback %s, exiting\n"+NCO, err2)
-			//logger.Printf("Fatal Save Monitor Values Insert Exec Rollback %s: %s: ", monDBi.UUID, err2.Error())
-			return err2
+	// Values, names of values are unique in monitor history
+	used := make(map[string]bool)
+	for _, v := range monDBi.Values {
+		used[v.Name] = true
+	}
+	for _, c := range history {
+		for _, v := range c.Values {
+			used[v.Name] = true
 		}
-		return err
 	}
+	// Repeated names of values to remove are counted once
+	remove := make(map[string]bool)
+	for _, name := range opts.RemoveValues {
+		remove[name] = true
+	}
+	values := make([]MonValue, 0, len(monDBi.Values)+len(opts.AddValues))
+	for _, v := range monDBi.Values {
+		if !remove[v.Name] {
+			values = append(values, v)
+		}
+	}
+	if len(values)+len(remove) != len(monDBi.Values) {
+		return errors.New("no such values in monitor to remove")
+	}
+	for _, v := range opts.AddValues {
+		ok, errcode := valueAvailable(v.Sensor, v.ValueIdx)
+		if !ok {
+			switch errcode {
+			case 1:
+				return errors.New("no sensor '" + v.Sensor + "' connected")
+			case 2:
+				return fmt.Errorf("no value %d for sensor '%s' available", v.ValueIdx, v.Sensor)
+			default:
+				return errors.New("Wrong sensor spec")
+			}
+		}
+		n := len(values)
+		name := ""
+		for {
+			name = pluggedSensors[v.Sensor].Values[v.ValueIdx].Name + strconv.Itoa(n)
+			if !used[name] {
+				break
+			}
+			n++
+		}
+		used[name] = true
+		values = append(values, MonValue{
+			name,
+			v.Sensor,
+			v.ValueIdx,
+			pluggedSensors[v.Sensor].Values[v.ValueIdx].Type,
+			0,
+		})
+	}
+	if len(values) == 0 {
+		return errors.New("no sensors selected")
+	}
+
+	// Parameters applied before are first in history
+	changes := make([]MonChange, 0, 2)
+	if len(history) == 0 {
+		created, _ := time.Parse(time.RFC3339Nano, monDBi.Created)
+		oldStopAt, _ := time.Parse(time.RFC3339Nano, monDBi.StopAt)
+		changes = append(changes, changeOf(created, monDBi.StepMs, monDBi.Amount, oldStopAt, monDBi.Values))
+	}
+	changes = append(changes, changeOf(now, stepMs, amount, stopAt, values))
 
-	//logger.Printf("SaveNew: Inserted for Monitor %s Count Values %d", monDBi.UUID, res.RowsAffected())
+	// Write pending detections before change
+	running := mon.IsActive()
+	if running {
+		mon.halt()
+	}
 
-	// Save Monitor Counters
-	// only once
-	// Execute
-	//res, err := tx.Stmt(stmts["monitors_counters_replace"]).Exec(monDBi.UUID, 0, 0)
-	_, err = tx.Stmt(stmts["monitors_counters_replace"]).Exec(monDBi.UUID, 0, 0)
+	// Monitor, its values and history are saved at once
+	// and monitor is changed only if they are saved
+	changed, err := monitorToDB(mon)
 	if err != nil {
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LBLUE+"SaveNew:"+RED+" Fatal Save Monitor Counters Insert Stmt Rollback %s, exiting\n"+NCO, err2)
-			//logger.Printf("Fatal Save Monitor Counters Insert Stmt Rollback %s: %s: ", monDBi.UUID, err2.Error())
-			return err2
-		}
 		return err
 	}
+	changed.Step = step
+	changed.StepMs = stepMs
+	changed.StopAt = stopAt.UTC().Format(time.RFC3339Nano)
+	changed.Amount = amount
+	changed.Values = values
+	err = store.ChangeMonitor(changed, changes)
 
-	//logger.Printf("SaveNew: Inserted for Monitor %s Counters %d", monDBi.UUID, res.RowsAffected())
+	mon.mu.Lock()
+	if err == nil {
+		mon.Step = step
+		mon.StepMs = stepMs
+		mon.StopAt = stopAt
+		mon.Amount = amount
+		mon.Values = values
+	}
+	running = running && mon.Active && !mon.Paused
+	mon.mu.Unlock()
 
-	err = tx.Commit()
 	if err != nil {
-		//fmt.Printf(LBLUE+"SaveNew:"+RED+" Fatal Commit Save Monitor %s\n"+NCO, monDBi.UUID, err)
-		//logger.Printf("Fatal Commit Save Monitor %s: %s", monDBi.UUID, err.Error())
+		// monitor runs with parameters applied before
+		if running {
+			rerr := mon.Run()
+			if rerr != nil {
+				logger.Print("error restarting monitor " + mon.UUID.String() + ": " + rerr.Error())
+			}
+		}
 		return err
 	}
 
-	//fmt.Printf(LBLUE+"SaveNew %-23s:"+NCO+" saved monitor %s\n", time.Now().Format("2006-01-02T15:04:05.999"), monDBi.UUID)
-	//logger.Printf("SaveNew %-23s: saved monitor %s", time.Now().Format("2006-01-02T15:04:05.999"), monDBi.UUID)
+	logger.Print("Monitor.Change: ok (" + mon.UUID.String() + ")")
 
+	if running {
+		return mon.Run()
+	}
 	return nil
 }
 
-func (mon *Monitor) Save() error {
-	var err,err2 error
+// changeOf returns change of monitor parameters applied since tm.
+func changeOf(tm time.Time, stepMs, amount uint, stopAt time.Time, values []MonValue) MonChange {
+	vals := make([]APIMonValue, len(values))
+	for i, v := range values {
+		vals[i] = APIMonValue{v.Name, ValueId{v.Sensor, v.ValueIdx}}
+	}
 
-	// Works with mon copy
-	// TODO: fix concurrent read access with sync.RWMutex, mon.RLock()
-	monDBi, err := monitorToDB(mon)
+	return MonChange{Time: tm, StepMs: stepMs, Amount: amount, StopAt: stopAt, Values: vals}
+}
+
+// changes loads history of monitor parameters.
+func (monDBi *MonitorDBItem) changes() ([]MonChange, error) {
+	return store.Changes(monDBi.UUID)
+}
+
+// allValues returns current values of monitor followed by values
+// removed from monitor by changes.
+func (monDBi *MonitorDBItem) allValues() ([]MonValue, error) {
+	changes, err := monDBi.changes()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// only Edit Monitor
-	if monDBi.Id == 0 {
-		return errors.New("monitor not saved, incorrect id");
+	values := make([]MonValue, len(monDBi.Values))
+	copy(values, monDBi.Values)
+	found := make(map[string]bool)
+	for _, v := range values {
+		found[v.Name] = true
+	}
+	for _, c := range changes {
+		for _, v := range c.Values {
+			if !found[v.Name] {
+				found[v.Name] = true
+				values = append(values, MonValue{Name: v.Name, Sensor: v.Sensor, ValueIdx: v.ValueIdx})
+			}
+		}
 	}
+	return values, nil
+}
 
-	tx, err := db.Begin()
+// closePause records end time of open pause of monitor.
+// It returns pause length.
+func (mon *Monitor) closePause(tm time.Time) (time.Duration, error) {
+	start, ok, err := store.ClosePause(mon.UUID.String(), tm)
+	if err != nil || !ok {
+		return 0, err
+	}
+	err = store.AddGap(mon.UUID.String(), MonGap{start, tm, GAP_PAUSED})
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return tm.Sub(start), nil
+}
 
-	// Update monitor
-	_, err = tx.Stmt(stmts["monitors_replace"]).Exec(
-		monDBi.Id,
-		monDBi.UUID,
-		monDBi.Exp_id,
-		monDBi.Setup_id,
-		monDBi.Step,
-		monDBi.Amount,
-		monDBi.Duration,
-		monDBi.Created,
-		monDBi.StopAt,
-		monDBi.Active,
-	)
+// addGap records gap of running monitor, gap is not recorded
+// if it is shorter than step.
+func (mon *Monitor) addGap(last, next time.Time, step time.Duration, cause string) {
+	if last.IsZero() || next.Sub(last) < step * 3 / 2 {
+		return
+	}
+	u := mon.UUID.String()
+	err := store.AddGap(u, MonGap{last.Add(step), next, cause})
+	if err != nil {
+		logger.Print("error recording gap of monitor " + u + ": " + err.Error())
+		return
+	}
+	logger.Printf("Monitor %s has no detections from %s to %s (%s)\n", u, last.Add(step).Format(time.RFC3339Nano), next.Format(time.RFC3339Nano), cause)
+}
+
+// gaps loads recorded gaps of monitor with pauses which have no gaps
+// recorded (pause is not ended or was made by older version).
+func (monDBi *MonitorDBItem) gaps() ([]MonGap, error) {
+	gaps, err := store.Gaps(monDBi.UUID)
 	if err != nil {
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LBLUE+"Save:"+RED+" Fatal Save Monitor Replace Stmt Rollback %s, exiting\n"+NCO, err2)
-			//logger.Printf("Fatal Save Monitor Replace Stmt Rollback %s: %s: ", monDBi.UUID, err2.Error())
-			return err2
+		return nil, err
+	}
+	pauses, err := monDBi.pauses()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pauses {
+		found := false
+		for _, g := range gaps {
+			if g.Cause == GAP_PAUSED && g.Start.Equal(p.Start) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			gaps = append(gaps, MonGap{p.Start, p.End, GAP_PAUSED})
 		}
+	}
+	sort.SliceStable(gaps, func(i, j int) bool {
+		return gaps[i].Start.Before(gaps[j].Start)
+	})
+	return gaps, nil
+}
+
+// pauses loads pause intervals of monitor.
+func (monDBi *MonitorDBItem) pauses() ([]MonPause, error) {
+	return store.Pauses(monDBi.UUID)
+}
+
+func (mon *Monitor) SaveNew() error {
+	// Works with mon copy
+	monDBi, err := monitorToDB(mon)
+	if err != nil {
 		return err
 	}
 
-	err = tx.Commit()
+	// as New Monitor
+	monDBi.Id = 0
+
+	id, err := store.InsertMonitor(monDBi)
 	if err != nil {
-		//fmt.Printf(LBLUE+"Save:"+RED+" Fatal Commit Save Monitor %s\n"+NCO, monDBi.UUID, err)
-		//logger.Printf("Fatal Commit Save Monitor %s: %s", monDBi.UUID, err.Error())
 		return err
 	}
 
-	//fmt.Printf(LBLUE+"Save %-23s:"+NCO+" update monitor %s\n", time.Now().Format("2006-01-02T15:04:05.999"), monDBi.UUID)
-	//logger.Printf("Save %-23s: update monitor %s", time.Now().Format("2006-01-02T15:04:05.999"), monDBi.UUID)
+	// assign returned id
+	mon.mu.Lock()
+	mon.Id = id
+	mon.mu.Unlock()
 
 	return nil
 }
 
-func (mon *Monitor) Info() (*MonitorInfo, error) {
-	var err, err2 error
-
+func (mon *Monitor) Save() error {
 	// Works with mon copy
-	// TODO: fix concurrent read access with sync.RWMutex, mon.RLock()
 	monDBi, err := monitorToDB(mon)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	created := mon.Created
-	stopat := mon.StopAt
 
-	tx, err := db.Begin()
+	// only Edit Monitor
+	if monDBi.Id == 0 {
+		return errors.New("monitor not saved, incorrect id");
+	}
+
+	return store.UpdateMonitor(monDBi)
+}
+
+func (mon *Monitor) Info() (*MonitorInfo, error) {
+	// Works with mon copy
+	monDBi, err := monitorToDB(mon)
 	if err != nil {
 		return nil, err
 	}
+	mon.mu.RLock()
+	created := mon.Created
+	stopat := mon.StopAt
+	mon.mu.RUnlock()
+
+	var counters MonCounters
+	var last time.Time
+	var ai []ArchiveInfo
+	var vi []MonValueInfo
+	// Detections waiting in write queue are counted with stored ones
+	count := func(pending []*SerData) error {
+		// Get last detection time,
+		// queued detections written already are not counted twice
+		var err error
+		last, err = store.LastTime(monDBi.Id)
+		if err != nil {
+			logger.Print("Fatal Detections Last Time: " + err.Error())
+			return err
+		}
+		pending = newerRows(pending, last)
 
-	// Get counters
-	row := tx.Stmt(stmts["monitors_counters_select_by_uuid"]).QueryRow(monDBi.UUID)
-	monuuid := ""
-	counters := MonCounters{}
-	// XXX: can use monDBi.Counters, but its in mon in memory, mon counters may be not equal to stored to db values
-	err = row.Scan(&monuuid, &counters.Done, &counters.Err)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// there were no rows, but otherwise no error occurred
-			counters.Done = 0
-			counters.Err = 0
-		} else {
-			//fmt.Printf(LPURPLE+"Info:"+RED+" Fatal Select Monitors Counters Stmt %s, exiting\n"+NCO, err)
-			logger.Print("Fatal Select Monitors Counters Stmt Query: " + err.Error())
-			err2 = tx.Rollback()
-			if err2 != nil {
-				//fmt.Printf(LPURPLE+"Info:"+RED+" Fatal Select Monitors Counters Stmt Rollback %s, exiting\n"+NCO, err2)
-				logger.Print("Fatal Select Monitors Counters Stmt Rollback: " + err2.Error())
-				return nil, err2
-			}
-			return nil, err
+		// Get counters
+		// XXX: can use monDBi.Counters, but its in mon in memory, mon counters may be not equal to stored values
+		counters, err = store.Counters(monDBi.UUID)
+		if err != nil {
+			return err
 		}
-	}
 
-	// Count grouped detections
-	row = tx.Stmt(stmts["detections_count_by_monitor_grouptime"]).QueryRow(monDBi.Id)
-	var alen uint = 0
-	err = row.Scan(&alen)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// there were no rows, but otherwise no error occurred
-			alen = 0
-		} else {
-			//fmt.Printf(LPURPLE+"Info:"+RED+" Fatal Detections Grouped Count Stmt %s, exiting\n"+NCO, err)
-			logger.Print("Fatal Detections Grouped Count Stmt Query: " + err.Error())
-			err2 = tx.Rollback()
-			if err2 != nil {
-				//fmt.Printf(LPURPLE+"Info:"+RED+" Fatal Detections Grouped Count Stmt Rollback %s, exiting\n"+NCO, err2)
-				logger.Print("Fatal Detections Grouped Count Stmt Rollback: " + err2.Error())
-				return nil, err2
-			}
-			return nil, err
+		// Count grouped detections
+		alen, err := store.CountTimes(monDBi.Id)
+		if err != nil {
+			logger.Print("Fatal Detections Grouped Count: " + err.Error())
+			return err
 		}
-	}
 
-	// Get last detection time
-	row = tx.Stmt(stmts["detections_select_last_time_by_monitor"]).QueryRow(monDBi.Id)
-	var nulltime time.Time
-	lasttxt, last := "", nulltime
-	err = row.Scan(&lasttxt)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// there were no rows, but otherwise no error occurred
-			lasttxt = ""
-		} else {
-			//fmt.Printf(LPURPLE+"Info:"+RED+" Fatal Detections Last Time Stmt %s, exiting\n"+NCO, err)
-			logger.Print("Fatal Detections Last Time Stmt Query: " + err.Error())
-			err2 = tx.Rollback()
-			if err2 != nil {
-				//fmt.Printf(LPURPLE+"Info:"+RED+" Fatal Detections Last Time Stmt Rollback %s, exiting\n"+NCO, err2)
-				logger.Print("Fatal Detections Last Time Stmt Rollback: " + err2.Error())
-				return nil, err2
+		for _, row := range pending {
+			counters.Done++
+			for i := range row.Readings {
+				if row.readingError(i) != "" {
+					counters.Err++
+					break
+				}
+			}
+			if row.Time.After(last) {
+				last = row.Time
 			}
-			return nil, err
 		}
-	}
-	if lasttxt != "" {
-		last, _ = time.Parse(time.RFC3339Nano, lasttxt)
-	}
+		alen += uint(len(pending))
 
-	n := 1  // number of archives, only one archive now, no step multiplied stores on Step*2, Step*4, Step*16, and etc.
-	ai := make([]ArchiveInfo, n)
-	for i := range ai {
-		ai[i] = ArchiveInfo{
+		// Raw detections archive and consolidated archives,
+		// queued detections are not consolidated yet
+		ai = make([]ArchiveInfo, 1, len(monDBi.Archives)+1)
+		ai[0] = ArchiveInfo{
 			monDBi.Step, // archive data step
 			alen,
+			nil,
+		}
+		for _, step := range monDBi.Archives {
+			clen, err := store.CountArchive(monDBi.Id, step)
+			if err != nil {
+				logger.Print("Fatal Detections Archives Count: " + err.Error())
+				return err
+			}
+			ai = append(ai, ArchiveInfo{step, clen, archiveCfs})
 		}
-	}
 
-	// Get Values data
-	var vlen uint
-	vi := make([]MonValueInfo, len(monDBi.Values))
-	for i := range vi {
-		// Count separate Values
-		vlen = 0
-		row = tx.Stmt(stmts["detections_count_by_monitor_sensor"]).QueryRow(
-			monDBi.Id,
-			monDBi.Values[i].Sensor,
-			monDBi.Values[i].ValueIdx,
-		)
-		err = row.Scan(&vlen)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				// there were no rows, but otherwise no error occurred
-				vlen = 0
-			} else {
-				//fmt.Printf(LPURPLE+"Info:"+RED+" Fatal Detections Grouped Sensor Count Stmt %s, exiting\n"+NCO, err)
-				logger.Print("Fatal Detections Grouped Sensor Count Stmt Query: " + err.Error())
-				err2 = tx.Rollback()
-				if err2 != nil {
-					//fmt.Printf(LPURPLE+"Info:"+RED+" Fatal Detections Grouped Sensor Count Stmt Rollback %s, exiting\n"+NCO, err2)
-					logger.Print("Fatal Detections Grouped Sensor Count Stmt Rollback: " + err2.Error())
-					return nil, err2
+		// Get Values data
+		vi = make([]MonValueInfo, len(monDBi.Values))
+		for i := range vi {
+			// Count separate Values
+			vlen, err := store.CountValue(monDBi.Id, monDBi.Values[i].Sensor, monDBi.Values[i].ValueIdx)
+			if err != nil {
+				logger.Print("Fatal Detections Grouped Sensor Count: " + err.Error())
+				return err
+			}
+			for _, row := range pending {
+				if i < len(row.Readings) {
+					vlen++
 				}
-				return nil, err
 			}
-		}
 
-		vi[i] = MonValueInfo{
-			monDBi.Values[i].Name,
-			monDBi.Values[i].Sensor,
-			monDBi.Values[i].ValueIdx,
-			vlen,
+			vi[i] = MonValueInfo{
+				monDBi.Values[i].Name,
+				monDBi.Values[i].Sensor,
+				monDBi.Values[i].ValueIdx,
+				vlen,
+			}
+		}
+		return nil
+	}
+	// counting is repeated if queued detections are written meanwhile
+	for try := 0; ; try++ {
+		pending, gen := writes.Pending(mon)
+		err = count(pending)
+		if err != nil {
+			return nil, err
+		}
+		if !writes.Flushed(gen) || try == WRITE_READ_RETRIES {
+			break
 		}
 	}
 
-	err = tx.Commit()
+	pauses, err := monDBi.pauses()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := monDBi.changes()
+	if err != nil {
+		return nil, err
+	}
+	gaps, err := monDBi.gaps()
 	if err != nil {
-		//fmt.Printf(LPURPLE+"Info:"+RED+" Fatal Commit Detections Grouped Sensor Count %s, exiting\n"+NCO, err)
-		logger.Printf("Fatal Commit Monitor Info %s, exiting\n", err.Error())
 		return nil, err
 	}
 
 	mi := &MonitorInfo{
 		monDBi.Active,
+		monDBi.Paused,
+		monDBi.Step,
+		monDBi.StepMs,
 		created,
 		stopat,
 		last,
@@ -1328,212 +1656,295 @@ func (mon *Monitor) Info() (*MonitorInfo, error) {
 		counters,
 		ai,
 		vi,
+		pauses,
+		changes,
+		gaps,
 	}
 	return mi, nil
 }
 
-func (mon *Monitor) Fetch(start, end time.Time, step time.Duration) (*FetchResultDB, error) {
-	var err, err2 error
+// rowCollector groups detections of values by time
+// into data rows, completed rows are passed to fn.
+type rowCollector struct {
+	idx   map[ValueId]int
+	nvals int
+	row   *SerData
+	cnt   int
+	fn    func(*SerData) error
+	stop  bool  // fn stopped fetching by errStopScan
+}
+
+func newRowCollector(values []MonValue, fn func(*SerData) error) *rowCollector {
+	c := &rowCollector{
+		idx:   make(map[ValueId]int),
+		nvals: len(values),
+		fn:    fn,
+	}
+	for i, v := range values {
+		id := ValueId{v.Sensor, v.ValueIdx}
+		if _, ok := c.idx[id]; !ok {
+			c.idx[id] = i
+		}
+	}
+	return c
+}
+
+// add sets reading of value at time tm with error of detection,
+// row of previous time is completed.
+func (c *rowCollector) add(tm time.Time, sensor string, valueIdx int, val float64, derr string) error {
+	if c.row != nil && !tm.Equal(c.row.Time) {
+		err := c.flush()
+		if err != nil {
+			return err
+		}
+	}
+	if c.row == nil {
+		c.row = &SerData{
+			Time:     tm,
+			Readings: make([]float64, c.nvals),
+		}
+		// value may be not detected at this time
+		// (archive bucket without data, value added or removed by changes)
+		for j := range c.row.Readings {
+			c.row.Readings[j] = math.NaN()
+		}
+	}
+	if j, ok := c.idx[ValueId{sensor, valueIdx}]; ok {
+		c.row.Readings[j] = val
+		if derr != "" {
+			c.row.setError(j, derr)
+		}
+	}
+	return nil
+}
+
+// count sets number of detections of value in collected archive bucket.
+func (c *rowCollector) count(sensor string, valueIdx int, cnt uint) {
+	j, ok := c.idx[ValueId{sensor, valueIdx}]
+	if !ok || c.row == nil {
+		return
+	}
+	if c.row.counts == nil {
+		c.row.counts = make([]uint, c.nvals)
+	}
+	c.row.counts[j] = cnt
+}
+
+// flush passes collected row to fn.
+func (c *rowCollector) flush() error {
+	if c.row == nil {
+		return nil
+	}
+	row := c.row
+	c.row = nil
+	return c.pass(row)
+}
+
+// pass passes completed row to fn.
+func (c *rowCollector) pass(row *SerData) error {
+	c.cnt++
+	err := c.fn(row)
+	if err == errStopScan {
+		c.stop = true
+	}
+	return err
+}
 
+// addRow completes collected row and passes data row with readings
+// of first values to fn, readings of other values are unknown.
+func (c *rowCollector) addRow(row *SerData) error {
+	err := c.flush()
+	if err != nil {
+		return err
+	}
+	r := &SerData{
+		Time:      row.Time,
+		Readings:  make([]float64, c.nvals),
+		Scheduled: row.Scheduled,
+	}
+	for j := range r.Readings {
+		r.Readings[j] = math.NaN()
+		if j < len(row.Readings) {
+			r.Readings[j] = row.Readings[j]
+			if cause := row.readingError(j); cause != "" {
+				r.setError(j, cause)
+			}
+		}
+	}
+	return c.pass(r)
+}
+
+// Fetch passes data rows of monitor within time range to fn ordered by time,
+// rows are read from storage one by one. Fetch stops on error of fn,
+// errStopScan stops it without error.
+func (mon *Monitor) Fetch(start, end time.Time, archive uint, cf string, fn func(*SerData) error) (*FetchResultDB, error) {
 	// Works with mon copy
-	// TODO: fix concurrent read access with sync.RWMutex, mon.RLock()
 	monDBi, err := monitorToDB(mon)
 	if err != nil {
 		return nil, err
 	}
 
-	tx, err := db.Begin()
+	// Data of values removed by changes follow current values
+	monDBi.Values, err = monDBi.allValues()
 	if err != nil {
 		return nil, err
 	}
 
+	if archive != 0 {
+		return fetchArchive(monDBi, start, end, archive, cf, fn)
+	}
+
 	fr := &FetchResultDB{
 		Filename: config.Database.Type + ":" + config.Database.Dsn,  // XXX: old, not used (only for RRD)
-		Cf:       "AVERAGE",  // XXX: not AVERAGE, just ABSOLUTE now, not used (only for RRD)
+		Cf:       "",  // raw detections, not consolidated
 		Start:    start,
 		End:      end,
-		Step:     time.Duration(monDBi.Step) * time.Second,  // XXX: old, not used (only for RRD)
+		Step:     time.Duration(monDBi.StepMs) * time.Millisecond,
 		DsNames:  make([]string, len(monDBi.Values)),
 		RowCnt:   0,
-		DsData:   make([]*FetchResultDBItem, 0),
-	}
-	//fr.DsNames = make([]string, len(monDBi.Values))
-	//fr.DsData = make([]*FetchResultDBItem, 0)
-
-	var sensor_val_id int
-	var tm, sensor_id string
-	var detection sql.NullFloat64
-	var derror    sql.NullString
-
-	// Load detections
-	var rows *sql.Rows
-	if start.IsZero() && end.IsZero() {
-		rows, err = tx.Stmt(stmts["detections_select_by_monitor"]).Query(
-			monDBi.Id,
-		)
-	} else if start.IsZero() {
-		rows, err = tx.Stmt(stmts["detections_select_by_monitor_time_to"]).Query(
-			monDBi.Id,
-			end.UTC().Format(time.RFC3339Nano),
-		)
-	} else if end.IsZero() {
-		rows, err = tx.Stmt(stmts["detections_select_by_monitor_time_from"]).Query(
-			monDBi.Id,
-			start.UTC().Format(time.RFC3339Nano),
-		)
-	} else {
-		rows, err = tx.Stmt(stmts["detections_select_by_monitor_time_range"]).Query(
-			monDBi.Id,
-			start.UTC().Format(time.RFC3339Nano),
-			end.UTC().Format(time.RFC3339Nano),
-		)
 	}
-
-	if err != nil {
-		//fmt.Printf(LPURPLE+"Fetch:"+RED+" Fatal Detections Select Time Range Stmt Query %s, exiting\n"+NCO, err)
-		logger.Print("Fatal Detections Select Time Range Stmt Query: " + err.Error())
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LPURPLE+"Fetch:"+RED+" Fatal Detections Select Time Range Rollback %s, exiting\n"+NCO, err2)
-			logger.Print("Fatal Detections Select Time Range Stmt Rollback: " + err2.Error())
-			return nil, err2
-		}
-		return nil, err
+	for i := range fr.DsNames {
+		fr.DsNames[i] = monDBi.Values[i].Name;
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		err = rows.Scan(&tm, &sensor_id, &sensor_val_id, &detection, &derror)
-		if err != nil {
-			//fmt.Printf(LPURPLE+"Fetch:"+RED+" Fatal Detections Select Time Range Scan, exiting\n"+NCO, err)
-			logger.Printf("Fatal Detections Select Time Range Scan: %s", err.Error())
-			err2 = tx.Rollback()
-			if err2 != nil {
-				//fmt.Printf(LPURPLE+"Fetch:"+RED+" Fatal Detections Select Time Range Scan Rollback %s, exiting\n"+NCO, err2)
-				logger.Printf("Fatal Detections Select Time Range Scan Rollback: %s", err2.Error())
-				return nil, err2
-			}
-			return nil, err
+	// Load detections, then detections waiting in write queue
+	// which are newer than stored ones
+	c := newRowCollector(monDBi.Values, fn)
+	pending, _ := writes.Pending(mon)
+	var last time.Time
+	err = store.ScanDetections(monDBi.Id, start, end, func(d *DetectionItem) error {
+		last = d.Time
+		return c.add(d.Time, d.Sensor_id, d.Sensor_val_id, d.Detection, d.Error)
+	})
+	for _, row := range newerRows(pending, last) {
+		if err != nil || c.stop {
+			break
 		}
-
-		t, _ := time.Parse(time.RFC3339Nano, tm)
-		
-		// Link with DsNames by name
-		// Search Name by unique sensor info
-		name := ""
-		for _, v := range monDBi.Values {
-			if v.Sensor == sensor_id && v.ValueIdx == sensor_val_id {
-				name = v.Name
-				break
-			}
+		if (start.IsZero() || !row.Time.Before(start)) && (end.IsZero() || !row.Time.After(end)) {
+			err = c.addRow(row)
 		}
+	}
+	if err == nil {
+		err = c.flush()
+	}
+	err = scanResult(err)
+	fr.RowCnt = c.cnt
 
-		// Convert non valid to NaN value
-		if !detection.Valid {
-			detection.Valid = true
-			detection.Float64 = math.NaN()
-		}
-		// Convert non valid error to empty string value
-		if !derror.Valid {
-			derror.Valid = true
-			derror.String = ""
-		}
+	return fr, err
+}
 
-		fr.DsData = append(fr.DsData, &FetchResultDBItem{t, name, detection.Float64, derror.String});
+// fetchArchive passes consolidated detections of monitor archive
+// with given step to fn, value of each bucket is computed by consolidation function cf.
+func fetchArchive(monDBi *MonitorDBItem, start, end time.Time, archive uint, cf string, fn func(*SerData) error) (*FetchResultDB, error) {
+	if cf == "" {
+		cf = "AVERAGE"
 	}
-
-	err = tx.Commit()
+	err := checkCf(cf, archiveCfs)
 	if err != nil {
-		//fmt.Printf(LPURPLE+"Fetch:"+RED+" Fatal Commit Detections Select Time Range %s, exiting\n"+NCO, err)
-		logger.Printf("Fatal Commit Detections Select Time Range %s, exiting\n", err.Error())
 		return nil, err
 	}
+	found := false
+	for _, a := range monDBi.Archives {
+		if a == archive {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no archive with step %d", archive)
+	}
 
-	fr.RowCnt = len(fr.DsData)
-
+	fr := &FetchResultDB{
+		Filename: config.Database.Type + ":" + config.Database.Dsn,
+		Cf:       cf,
+		Start:    start,
+		End:      end,
+		Step:     time.Duration(archive) * time.Second,
+		DsNames:  make([]string, len(monDBi.Values)),
+		RowCnt:   0,
+	}
 	for i := range fr.DsNames {
-		fr.DsNames[i] = monDBi.Values[i].Name;
+		fr.DsNames[i] = monDBi.Values[i].Name
+	}
+
+	if !start.IsZero() {
+		start = start.Truncate(fr.Step)
+	}
+	c := newRowCollector(monDBi.Values, fn)
+	err = store.ScanArchive(monDBi.Id, archive, start, end, func(a *ArchiveRow) error {
+		var val float64
+		switch cf {
+		case "AVERAGE":
+			val = math.NaN()
+			if a.Cnt > 0 {
+				val = a.Sum / float64(a.Cnt)
+			}
+		case "MIN":
+			val = a.Min
+		case "MAX":
+			val = a.Max
+		case "LAST":
+			val = a.Last
+		case "COUNT":
+			val = float64(a.Cnt)
+		}
+		err := c.add(a.Time, a.Sensor_id, a.Sensor_val_id, val, "")
+		if err == nil && cf == "AVERAGE" {
+			// averages of buckets are weighted by counts on aggregation
+			c.count(a.Sensor_id, a.Sensor_val_id, a.Cnt)
+		}
+		return err
+	})
+	if err == nil {
+		err = scanResult(c.flush())
 	}
+	fr.RowCnt = c.cnt
 
 	return fr, err
 }
 
 func (mon *Monitor) Remove(wdata bool) error {
-	var err,err2 error
-	var errcnt uint = 0
+	var err error
 
-	if mon.Active {
+	if mon.IsActive() {
 		err = mon.Stop()
 		if err != nil {
 			logger.Print("error stopping monitor being removed: " + err.Error())
 		}
 	}
-	delete(monitors, mon.UUID.String())
+	monitors.Delete(mon.UUID.String())
+	schedules.Cancel(mon.UUID.String())
+	alarms.Remove(mon.UUID.String())
 
 	// Works with mon copy
-	// TODO: fix concurrent read access with sync.RWMutex, mon.RLock()
 	monDBi, err := monitorToDB(mon)
 	if err != nil {
 		return err
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-
-	// Delete monitor detections data
-	if wdata {
-		_, err = tx.Stmt(stmts["detections_delete_by_monitor"]).Exec(monDBi.Id)
-		if err != nil {
-			errcnt++
-			logger.Print("error removing monitor data: " + err.Error())
-		}
-	}
-
-	// Delete monitor values
-	//mon.Values = nil
-	_, err = tx.Stmt(stmts["monitors_values_delete_by_uuid"]).Exec(monDBi.UUID)
-	if err != nil {
-		errcnt++
-		logger.Print("error removing monitor values: " + err.Error())
-	}
-
-	// Delete monitor counters
-	//mon.Counters.Done = 0
-	//mon.Counters.Err = 0
-	_, err = tx.Stmt(stmts["monitors_counters_delete_by_uuid"]).Exec(monDBi.UUID)
-	if err != nil {
-		errcnt++
-		logger.Print("error removing monitor counters: " + err.Error())
-	}
-
-	// Delete monitor
-	_, err = tx.Stmt(stmts["monitors_delete_by_id"]).Exec(monDBi.Id)
-	if err != nil {
-		errcnt++
-		logger.Print("error removing monitor configuration: " + err.Error())
-	}
+	return store.RemoveMonitor(monDBi, wdata)
+}
 
-	if errcnt > 0 {
-		err2 = tx.Rollback()
-		if err2 != nil {
-			//fmt.Printf(LPURPLE+"Remove:"+RED+" Fatal Rollback Monitor Remove %s, exiting\n"+NCO, err2)
-			logger.Printf("Fatal Rollback Monitor Remove: %s", err2.Error())
-		}
-	} else {
-		err = tx.Commit()
-		if err != nil {
-			//fmt.Printf(LPURPLE+"Remove:"+RED+" Fatal Commit Monitor Remove %s, exiting\n"+NCO, err)
-			logger.Printf("Fatal Commit Monitor Remove %s, exiting\n", err.Error())
+// rowOf converts time and detections values passed after time in vals
+// to data row. Error values are converted to NaN with cause of error,
+// other non float values are converted to NaN.
+func rowOf(vals ...interface{}) *SerData {
+	row := &SerData{}
+	if len(vals) == 0 {
+		return row
+	}
+	row.Time, _ = vals[0].(time.Time)
+	row.Readings = make([]float64, len(vals)-1)
+	for i, v := range vals[1:] {
+		var found bool
+		if row.Readings[i], found = v.(float64); !found {
+			row.Readings[i] = math.NaN()
+			if err, ok := v.(error); ok {
+				row.setError(i, readCause(err))
+			}
 		}
 	}
-
-	// Result error
-	if errcnt > 0 {
-		err = fmt.Errorf("error removing monitor: %d : %s", monDBi.Id, monDBi.UUID)
-	}
-	return err
+	return row
 }
 
 func runStrobe(monDBi *MonitorDBItem, check bool) error {
@@ -1556,127 +1967,87 @@ func runStrobe(monDBi *MonitorDBItem, check bool) error {
 	}
 
 	go func() {
-		readings := make([](chan float64), len(monDBi.Values))
+		readings := make([](chan readResult), len(monDBi.Values))
 		for i := range readings {
-			readings[i] = make(chan float64, 1)
+			readings[i] = make(chan readResult, 1)
 		}
-		vals := make([]interface{}, len(monDBi.Values)+1)
 		for i, v := range monDBi.Values {
 			go getSerData(v.Sensor, v.ValueIdx, readings[i])
 		}
-		vals[0] = time.Now()
+		row := &SerData{Time: time.Now(), Readings: make([]float64, len(readings))}
 		for i, c := range readings {
-			vals[i+1] = <-c
+			r := <-c
+			row.Readings[i] = r.Value
+			if r.Cause != "" {
+				row.setError(i, r.Cause)
+			}
 		}
-		updateStrob(monDBi, vals...)
+		updateStrob(monDBi, row)
 	}()
 	return nil
 }
 
-func updateStrob(monDBi *MonitorDBItem, vals ...interface{}) error {
-	var err,err2 error
-
-	if len(vals) < 2 {
+func updateStrob(monDBi *MonitorDBItem, row *SerData) error {
+	if len(row.Readings) == 0 {
 		//return fmt.Errorf("Update Strobe Error: no new detections for %s", monDBi.UUID)
 		return nil
 	}
 
-	var nulltime time.Time
-	tm, ok := vals[0].(time.Time)
-	if !ok {
-		tm = nulltime
-	}
-
-	det := DetectionDBItem{
-		Id:             0,
-		Exp_id:         monDBi.Exp_id,
-		Mon_id:         monDBi.Id,
-		Time:           tm.UTC().Format(time.RFC3339Nano),
-		Sensor_id:      "",
-		Sensor_val_id:  0,
-		Detection:      0,
-		Error:          "",  // TODO: remode old error field
-	}
+	// Strobe detections are not counted
+	_, err := store.AppendDetections([]MonitorRows{{monDBi, []*SerData{row}}}, false)
+	return err
+}
 
-	tx, err := db.Begin()
+// Append writes data rows of series to monitor detections and updates
+// monitor counters in single transaction.
+func (mon *Monitor) Append(rows []*SerData) error {
+	counters, err := mon.insertRows(rows)
 	if err != nil {
 		return err
 	}
 
-	sqlInsert := queries["_detections_insert_into"] + " VALUES "
-	values := []interface{}{}
-	for i, v := range vals {
-		if i == 0 {
-			// Skip time
-			continue
-		}
-
-		sqlInsert += queries["_detections_insert_values"] + ","
+	mon.mu.Lock()
+	mon.Counters.Done += counters.Done
+	mon.Counters.Err += counters.Err
+	mon.mu.Unlock()
 
-		det_error := sql.NullString{String:"", Valid:false}
-		det_value := sql.NullFloat64{Float64:0, Valid:false}
-		var found bool
-
-		// Check error value
-		if det_value.Float64, found = v.(float64); !found {
-			det_value.Float64 = math.NaN()
-		}
-		if math.IsNaN(det_value.Float64) {
-			det_error.String = "NaN"
-			det_error.Valid = true
-		} else {
-			det_value.Valid = true
-		}
-
-		values = append(values,
-			det.Exp_id,
-			det.Mon_id,
-			det.Time,
-			monDBi.Values[i-1].Sensor,
-			monDBi.Values[i-1].ValueIdx,
-			det_value,
-			det_error,
-		)
-	}
-	sqlInsert = strings.TrimSuffix(sqlInsert, ",")
-	//logger.Printf("Update Strobe: Debug sqlInsert: %s", sqlInsert)
-	//logger.Printf("Update Strobe: Debug sqlInsert vals: %+v", values)
-	// Prepare the statement
-	stmt, err := tx.Prepare(sqlInsert)
-	if err != nil {
-		err2 = tx.Rollback()
-		if err2 != nil {
-			return err2
-		}
+	return nil
+}
 
-		return err
+// insertRows writes data rows to monitor detections and updates
+// stored counters. It returns counters of inserted rows,
+// counters of monitor in memory are not changed.
+func (mon *Monitor) insertRows(rows []*SerData) (MonCounters, error) {
+	if len(rows) == 0 {
+		return MonCounters{}, nil
 	}
 
-	// Execute
-	//res, err := stmt.Exec(values...)
-	_, err = stmt.Exec(values...)
+	// Works with mon copy
+	monDBi, err := monitorToDB(mon)
 	if err != nil {
-		err2 = tx.Rollback()
-		if err2 != nil {
-			return err2
-		}
-
-		return err
+		return MonCounters{}, err
 	}
 
-	//logger.Printf("Update Strobe: Inserted for Monitor %s Count Detections %d", monDBi.Id, res.RowsAffected())
-
-	err = tx.Commit()
+	counters, err := store.AppendDetections([]MonitorRows{{monDBi, rows}}, true)
 	if err != nil {
-		//fmt.Printf(LBLUE+"Update Strobe:"+RED+" Fatal Commit Update Detections for %s: %s\n"+NCO, monDBi.UUID, err)
-		//logger.Printf("Update Strobe: Fatal Commit Update Detections for %s: %s", monDBi.UUID, err.Error())
-		return err
+		return MonCounters{}, err
 	}
+	return counters[0], nil
+}
 
-	//fmt.Printf(LBLUE+"Update Strobe %-23s:"+NCO+" insert detections\n", time.Now().Format("2006-01-02T15:04:05.999"))
-	//logger.Printf("Update Strobe %-23s: insert detections for %s", time.Now().Format("2006-01-02T15:04:05.999"), monDBi.UUID)
+// queueRow counts data row of monitor and queues it to be written.
+func (mon *Monitor) queueRow(row *SerData) {
+	mon.mu.Lock()
+	mon.Counters.Done++
+	for i := range row.Readings {
+		if row.readingError(i) != "" {
+			mon.Counters.Err++
+			break
+		}
+	}
+	mon.mu.Unlock()
 
-	return nil
+	writes.Add(mon, row)
 }
 
 func newMonitor(opts *MonitorOpts) (*Monitor, error) {
@@ -1713,43 +2084,173 @@ func newMonitor(opts *MonitorOpts) (*Monitor, error) {
 		}
 	}
 
+	// Step in seconds is kept for compatibility,
+	// StepMs takes precedence if set
+	step, stepMs := opts.Step, opts.StepMs
+	if stepMs > 0 {
+		step = (stepMs + 999) / 1000
+	} else {
+		stepMs = step * 1000
+	}
+	if stepMs == 0 {
+		return nil, errors.New("monitor step must be positive")
+	}
+
+	archives, err := monitorArchives(step, opts.Archives)
+	if err != nil {
+		return nil, err
+	}
+
 	mon := Monitor{
 		0,
 		uuid.NewRandom(),
 		opts.Exp_id,
 		opts.Setup_id,
-		opts.Step,
+		step,
+		stepMs,
 		opts.Count,
 		opts.Duration,
 		time.Now(),
 		opts.StopAt,
 		true,
+		false,
+		nil,
 		nil,
 		vals,
 		MonCounters{0,0},
+		archives,
+		sync.RWMutex{},
 	}
 
 	return &mon, nil
 }
 
+// monitorArchives checks steps of consolidated archives requested
+// for monitor with given step. Default steps from configuration
+// not greater than monitor step are skipped.
+func monitorArchives(step uint, archives []uint) ([]uint, error) {
+	if archives == nil {
+		res := make([]uint, 0, len(config.Monitor.Archives))
+		for _, a := range config.Monitor.Archives {
+			if a > step {
+				res = append(res, a)
+			}
+		}
+		return res, nil
+	}
+
+	res := make([]uint, len(archives))
+	copy(res, archives)
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	for i, a := range res {
+		if a <= step {
+			return nil, fmt.Errorf("archive step %d must be greater than monitor step %d", a, step)
+		}
+		if i > 0 && res[i-1] == a {
+			return nil, fmt.Errorf("duplicate archive step %d", a)
+		}
+	}
+	return res, nil
+}
+
 func createRunMonitor(opts *MonitorOpts) (*Monitor, error) {
 	mon, err := newMonitor(opts)
 	if err != nil {
 		return mon, err
 	}
+
+	// Monitor starting later or by schedule
+	var sch *schedule
+	if !opts.StartAt.IsZero() || opts.Schedule != "" {
+		if (!opts.StartAt.IsZero()) && opts.StartAt.Before(mon.Created) {
+			return nil, errors.New("monitor start time is in the past")
+		}
+		if (!opts.StopAt.IsZero()) && opts.StopAt.Before(opts.StartAt) {
+			return nil, errors.New("monitor stop time is before start time")
+		}
+		sch, err = newSchedule(mon.UUID.String(), opts.StartAt, opts.Schedule, opts.Window)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = checkAlarms(opts.Alarms, mon.Values)
+	if err != nil {
+		return nil, err
+	}
 	logger.Print("createRunMonitor: newMonitor: ok")
 	err = mon.SaveNew()
 	if err != nil {
 		return mon, err
 	}
 	logger.Print("createRunMonitor: mon.SaveNew: ok")
+
+	// Saved monitor is removed if it is not started
+	defer func() {
+		if err != nil {
+			rerr := mon.Remove(true)
+			if rerr != nil {
+				logger.Print("error removing monitor failed to start: " + rerr.Error())
+			}
+		}
+	}()
+
+	if len(opts.Alarms) > 0 {
+		err = alarms.Set(mon.UUID.String(), opts.Alarms, mon.Values)
+		if err != nil {
+			return mon, err
+		}
+	}
+
+	if sch != nil {
+		// Wait paused for schedule
+		mon.Paused = true
+		err = store.AddPause(mon.UUID.String(), mon.Created)
+		if err == nil {
+			err = mon.Save()
+		}
+		if err == nil {
+			err = sch.save()
+		}
+		if err != nil {
+			return mon, err
+		}
+		monitors.Add(mon)
+		schedules.Arm(sch)
+		logger.Print("createRunMonitor: scheduled: ok")
+		return mon, nil
+	}
+
 	err = mon.Run()
 	if err != nil {
 		return mon, err
 	}
 	logger.Print("createRunMonitor: mon.Run: ok")
 
-	monitors[mon.UUID.String()] = mon
+	monitors.Add(mon)
+
+	return mon, nil
+}
+
+// createSeriesMonitor creates inactive monitor to store data of series
+// made by exp_id experiment.
+func createSeriesMonitor(exp_id int, values []ValueId, period time.Duration, created time.Time) (*Monitor, error) {
+	opts := MonitorOpts{
+		Exp_id: exp_id,
+		StepMs: uint(math.Ceil(float64(period) / float64(time.Millisecond))),
+		Values: values,
+	}
+	mon, err := newMonitor(&opts)
+	if err != nil {
+		return mon, err
+	}
+	mon.Created = created
+	mon.Active = false
+	err = mon.SaveNew()
+	if err != nil {
+		return mon, err
+	}
+
+	monitors.Add(mon)
 
 	return mon, nil
 }
@@ -0,0 +1,268 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	RETENTION_DELETE     = "delete"      // remove detections and archives
+	RETENTION_DOWNSAMPLE = "downsample"  // remove detections, keep consolidated archives
+)
+
+type RetentionAction struct {
+	UUID   string
+	Exp_id int
+	Reason string     // "age", "size" or "free"
+	Before time.Time  // data older than this is removed, zero time for all data
+	Rows   uint       // detections removed
+	Action string     // "delete" or "downsample", "delete" for monitor without archives
+}
+
+type RetentionReport struct {
+	Time    time.Time
+	DryRun  bool
+	Size    uint64  // used database size, bytes
+	Free    uint64  // free space for database, bytes, 0 if unknown
+	Actions []RetentionAction
+}
+
+// retentionEnabled reports if any retention limit is configured.
+func retentionEnabled() bool {
+	r := config.Retention
+	return r.MaxAge > 0 || r.MaxSize > 0 || r.MinFree > 0 ||
+		len(r.Experiments) > 0 || len(r.Monitors) > 0
+}
+
+// maxAge returns max age of data of monitor in seconds, 0 if unlimited.
+// Monitor limit overrides experiment limit, which overrides global one.
+func maxAge(monDBi *MonitorDBItem) uint {
+	if age, ok := config.Retention.Monitors[monDBi.UUID]; ok {
+		return age
+	}
+	if age, ok := config.Retention.Experiments[monDBi.Exp_id]; ok {
+		return age
+	}
+	return config.Retention.MaxAge
+}
+
+// monitorAction returns retention action for monitor data.
+// Detections of monitor without consolidated archives can not be
+// downsampled, so they are deleted.
+func monitorAction(monDBi *MonitorDBItem, action string) string {
+	if action == RETENTION_DOWNSAMPLE && len(monDBi.Archives) == 0 {
+		return RETENTION_DELETE
+	}
+	return action
+}
+
+// fsFree returns free space of filesystem with database file in bytes,
+// 0 if database is not a file.
+func fsFree() uint64 {
+	if config.Database.Type != "sqlite" {
+		return 0
+	}
+	path := strings.TrimPrefix(config.Database.Dsn, "file:")
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	if path == "" || path == ":memory:" {
+		return 0
+	}
+	var st syscall.Statfs_t
+	err := syscall.Statfs(filepath.Dir(path), &st)
+	if err != nil {
+		return 0
+	}
+	return st.Bavail * uint64(st.Bsize)
+}
+
+// retentionPlan finds data to remove by retention limits.
+// Data of active monitors is never removed.
+// Data older than max age is removed first, then, if database is still
+// too large or free space is too low, all data of inactive monitors
+// with oldest data.
+func retentionPlan() (*RetentionReport, error) {
+	now := time.Now()
+	action := config.Retention.Action
+	if action == "" {
+		action = RETENTION_DELETE
+	}
+
+	r := &RetentionReport{
+		Time:    now,
+		DryRun:  true,
+		Actions: make([]RetentionAction, 0),
+	}
+	size, reusable, err := store.Size()
+	if err != nil {
+		return nil, err
+	}
+	r.Size = size
+	if free := fsFree(); free > 0 {
+		r.Free = free + reusable
+	}
+
+	type candidate struct {
+		monDBi *MonitorDBItem
+		last   time.Time
+		rows   uint
+	}
+	candidates := make([]candidate, 0)
+	for _, mon := range monitors.List() {
+		if mon.IsActive() {
+			continue
+		}
+		monDBi, err := monitorToDB(mon)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := store.CountDetections(monDBi.Id, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		if rows == 0 {
+			continue
+		}
+
+		// Data older than max age
+		if age := maxAge(monDBi); age > 0 {
+			before := now.Add(-time.Duration(age) * time.Second)
+			old, err := store.CountDetections(monDBi.Id, before)
+			if err != nil {
+				return nil, err
+			}
+			if old > 0 {
+				r.Actions = append(r.Actions, RetentionAction{monDBi.UUID, monDBi.Exp_id, "age", before, old, monitorAction(monDBi, action)})
+				rows -= old
+			}
+		}
+		if rows == 0 {
+			continue
+		}
+
+		last, err := store.LastTime(monDBi.Id)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate{monDBi, last, rows})
+	}
+
+	// Space to free
+	var excess uint64
+	reason := ""
+	const MB = 1024 * 1024
+	if max := uint64(config.Retention.MaxSize) * MB; max > 0 && r.Size > max {
+		excess = r.Size - max
+		reason = "size"
+	}
+	if min := uint64(config.Retention.MinFree) * MB; min > 0 && r.Free > 0 && r.Free < min && min-r.Free > excess {
+		excess = min - r.Free
+		reason = "free"
+	}
+	if excess == 0 {
+		return r, nil
+	}
+
+	total, err := store.TotalDetections()
+	if err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return r, nil
+	}
+	perRow := r.Size / total
+	if perRow == 0 {
+		perRow = 1
+	}
+
+	// Inactive monitors with oldest data first
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].last.Before(candidates[j].last)
+	})
+	for _, c := range candidates {
+		if excess == 0 {
+			break
+		}
+		r.Actions = append(r.Actions, RetentionAction{c.monDBi.UUID, c.monDBi.Exp_id, reason, time.Time{}, c.rows, monitorAction(c.monDBi, action)})
+		freed := uint64(c.rows) * perRow
+		if freed >= excess {
+			excess = 0
+		} else {
+			excess -= freed
+		}
+	}
+
+	return r, nil
+}
+
+// applyRetention removes data by report actions,
+// removed detections are subtracted from monitor counters.
+func applyRetention(r *RetentionReport) error {
+	for _, a := range r.Actions {
+		mon, exists := monitors.Get(a.UUID)
+		if !exists || mon.IsActive() {
+			continue
+		}
+		monDBi, err := monitorToDB(mon)
+		if err != nil {
+			return err
+		}
+
+		removed, err := store.DeleteDetections(monDBi, a.Before, a.Action == RETENTION_DELETE)
+		if err != nil {
+			return err
+		}
+		mon.mu.Lock()
+		mon.Counters = mon.Counters.sub(removed)
+		mon.mu.Unlock()
+
+		logger.Printf("Retention: %s %d detections of monitor %s by %s", a.Action, a.Rows, a.UUID, a.Reason)
+	}
+	r.DryRun = false
+	return nil
+}
+
+// startRetention runs retention job periodically if any limit is configured.
+func startRetention() {
+	if !retentionEnabled() {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(time.Duration(config.Retention.Interval) * time.Second)
+		defer t.Stop()
+		for {
+			r, err := retentionPlan()
+			if err == nil {
+				err = applyRetention(r)
+			}
+			if err != nil {
+				logger.Print("Retention: " + err.Error())
+			}
+			<-t.C
+		}
+	}()
+}
@@ -0,0 +1,377 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cronSpec is a parsed cron-like schedule:
+// minute, hour, day of month, month and day of week.
+type cronSpec struct {
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+	anyDom bool
+	anyDow bool
+}
+
+type APISchedule struct {
+	UUID     string
+	StartAt  time.Time
+	Schedule string
+	Window   uint       // seconds
+	Next     time.Time  // next start, zero if monitor runs by one-time StartAt already
+}
+
+// schedule starts paused monitor at StartAt and then, if Spec is set,
+// resumes it at every time matched by Spec and pauses after Window.
+type schedule struct {
+	UUID    string
+	StartAt time.Time
+	Spec    string
+	Window  time.Duration
+
+	cron   *cronSpec
+	cancel chan struct{}
+}
+
+// scheduleRegistry is a set of armed schedules safe for concurrent use.
+type scheduleRegistry struct {
+	mu sync.Mutex
+	m  map[string]*schedule
+}
+
+var schedules = newScheduleRegistry()
+
+// parseCron parses schedule spec of five fields:
+// minute (0-59), hour (0-23), day of month (1-31), month (1-12) and
+// day of week (0-6, 0 is Sunday, 7 is also Sunday). Field may be "*",
+// number, range "a-b", list "a,b" and step "*/n" or "a-b/n".
+func parseCron(spec string) (*cronSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("schedule must have 5 fields: minute hour day month weekday")
+	}
+
+	c := &cronSpec{}
+	c.anyDom = fields[2] == "*"
+	c.anyDow = fields[4] == "*"
+	dow := make([]bool, 8)
+	err := parseCronField(fields[0], 0, 59, c.minute[:])
+	if err == nil {
+		err = parseCronField(fields[1], 0, 23, c.hour[:])
+	}
+	if err == nil {
+		err = parseCronField(fields[2], 1, 31, c.dom[:])
+	}
+	if err == nil {
+		err = parseCronField(fields[3], 1, 12, c.month[:])
+	}
+	if err == nil {
+		err = parseCronField(fields[4], 0, 7, dow)
+	}
+	if err != nil {
+		return nil, errors.New("wrong schedule '" + spec + "': " + err.Error())
+	}
+	copy(c.dow[:], dow)
+	c.dow[0] = c.dow[0] || dow[7]
+
+	return c, nil
+}
+
+func parseCronField(field string, min, max int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("wrong step in '%s'", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			from, err = strconv.Atoi(r[0])
+			if err != nil {
+				return fmt.Errorf("wrong value '%s'", r[0])
+			}
+			to = from
+			if len(r) == 2 {
+				to, err = strconv.Atoi(r[1])
+				if err != nil {
+					return fmt.Errorf("wrong value '%s'", r[1])
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func (c *cronSpec) matchDay(t time.Time) bool {
+	dom := c.dom[t.Day()]
+	dow := c.dow[t.Weekday()]
+	// as in cron, if both days are restricted, any of them matches
+	if !c.anyDom && !c.anyDow {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next returns the first time matched by schedule after t
+// or zero time if there is none within 5 years.
+func (c *cronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.month[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func newSchedule(u string, startAt time.Time, spec string, window uint) (*schedule, error) {
+	sch := &schedule{
+		UUID:    u,
+		StartAt: startAt,
+		Spec:    spec,
+		Window:  time.Duration(window) * time.Second,
+	}
+	if spec != "" {
+		c, err := parseCron(spec)
+		if err != nil {
+			return nil, err
+		}
+		if window == 0 {
+			return nil, errors.New("schedule window must be positive")
+		}
+		sch.cron = c
+	}
+	return sch, nil
+}
+
+// nextWindow returns start and end of the first run window
+// not ended at time t. End is zero time for one-time start.
+func (sch *schedule) nextWindow(t time.Time) (time.Time, time.Time) {
+	if sch.cron == nil {
+		return sch.StartAt, time.Time{}
+	}
+	from := t.Add(-sch.Window)
+	if from.Before(sch.StartAt) {
+		from = sch.StartAt.Add(-time.Nanosecond)
+	}
+	start := sch.cron.Next(from)
+	if start.IsZero() {
+		return start, start
+	}
+	return start, start.Add(sch.Window)
+}
+
+// run resumes and pauses monitor by schedule until schedule is
+// cancelled or monitor is stopped.
+func (sch *schedule) run() {
+	defer schedules.Delete(sch.UUID)
+
+	for {
+		mon, exists := monitors.Get(sch.UUID)
+		if !exists || !mon.IsActive() {
+			sch.remove()
+			return
+		}
+
+		start, end := sch.nextWindow(time.Now())
+		if start.IsZero() {
+			logger.Print("schedule of monitor " + sch.UUID + " has no more runs")
+			sch.remove()
+			return
+		}
+		if !sch.wait(start) {
+			return
+		}
+
+		mon.mu.RLock()
+		paused := mon.Paused
+		mon.mu.RUnlock()
+		if paused {
+			err := mon.resume(false)
+			if err != nil {
+				logger.Print("error resuming monitor " + sch.UUID + " by schedule: " + err.Error())
+			}
+		}
+
+		if end.IsZero() {
+			// one-time start is done
+			sch.remove()
+			return
+		}
+		if !sch.wait(end) {
+			return
+		}
+
+		if mon.IsActive() {
+			err := mon.Pause()
+			if err != nil {
+				logger.Print("error pausing monitor " + sch.UUID + " by schedule: " + err.Error())
+			}
+		}
+	}
+}
+
+// wait sleeps until time t. It returns false if schedule is cancelled.
+func (sch *schedule) wait(t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-sch.cancel:
+		return false
+	}
+}
+
+// save stores schedule.
+func (sch *schedule) save() error {
+	return store.SaveSchedule(APISchedule{
+		UUID:     sch.UUID,
+		StartAt:  sch.StartAt,
+		Schedule: sch.Spec,
+		Window:   uint(sch.Window / time.Second),
+	})
+}
+
+// remove deletes stored schedule.
+func (sch *schedule) remove() {
+	err := store.RemoveSchedule(sch.UUID)
+	if err != nil {
+		logger.Print("error removing schedule of monitor " + sch.UUID + ": " + err.Error())
+	}
+}
+
+func newScheduleRegistry() *scheduleRegistry {
+	return &scheduleRegistry{m: make(map[string]*schedule)}
+}
+
+// Arm registers schedule and starts it.
+func (r *scheduleRegistry) Arm(sch *schedule) {
+	sch.cancel = make(chan struct{})
+	r.mu.Lock()
+	r.m[sch.UUID] = sch
+	r.mu.Unlock()
+	go sch.run()
+}
+
+// Cancel stops schedule of monitor with uuid string
+// and removes it from database. It returns false if there is no schedule.
+func (r *scheduleRegistry) Cancel(u string) bool {
+	r.mu.Lock()
+	sch, exists := r.m[u]
+	if exists {
+		delete(r.m, u)
+		close(sch.cancel)
+	}
+	r.mu.Unlock()
+
+	if exists {
+		sch.remove()
+	}
+	return exists
+}
+
+// Delete unregisters schedule by uuid string.
+func (r *scheduleRegistry) Delete(u string) {
+	r.mu.Lock()
+	delete(r.m, u)
+	r.mu.Unlock()
+}
+
+// List returns all armed schedules.
+func (r *scheduleRegistry) List() []APISchedule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	list := make([]APISchedule, 0, len(r.m))
+	for _, sch := range r.m {
+		next, _ := sch.nextWindow(now)
+		if sch.cron == nil && next.Before(now) {
+			next = time.Time{}
+		}
+		list = append(list, APISchedule{
+			sch.UUID,
+			sch.StartAt,
+			sch.Spec,
+			uint(sch.Window / time.Second),
+			next,
+		})
+	}
+	return list
+}
+
+// loadSchedules arms stored schedules.
+func loadSchedules() error {
+	saved, err := store.Schedules()
+	if err != nil {
+		return err
+	}
+
+	list := make([]*schedule, 0)
+	for _, s := range saved {
+		sch, err := newSchedule(s.UUID, s.StartAt, s.Schedule, s.Window)
+		if err != nil {
+			logger.Print("schedule of monitor " + s.UUID + ": " + err.Error())
+			continue
+		}
+		list = append(list, sch)
+	}
+
+	for _, sch := range list {
+		schedules.Arm(sch)
+	}
+	logger.Printf("Found %d monitor schedules\n", len(list))
+
+	return nil
+}
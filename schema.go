@@ -0,0 +1,431 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// migration is a step of database schema upgrade.
+// Statements must be safe to run on database where objects already exist,
+// so databases created before versioning are upgraded by the same steps.
+type migration struct {
+	Version uint
+	Name    string
+	SQL     []string
+	Columns []schemaColumn // added only if missing
+}
+
+type schemaColumn struct {
+	Table string
+	Name  string
+	Def   string
+}
+
+// schema is a database specific set of migrations.
+type schema struct {
+	// queries with parameters: table name; table name and column name
+	TableExists  string
+	ColumnExists string
+	Version      string
+	Migrations   []migration
+}
+
+var schemas = map[string]schema{
+	"sqlite": {
+		TableExists: `
+			SELECT COUNT(*)
+			FROM sqlite_master
+			WHERE type = 'table' AND name = ?;
+		`,
+		ColumnExists: `
+			SELECT COUNT(*)
+			FROM pragma_table_info(?)
+			WHERE name = ?;
+		`,
+		Version: `
+			CREATE TABLE IF NOT EXISTS schema_version (
+				version INTEGER NOT NULL PRIMARY KEY,
+				name TEXT NOT NULL,
+				applied TEXT NOT NULL
+			);
+		`,
+		Migrations: []migration{
+			{1, "monitors and detections", []string{`
+				CREATE TABLE IF NOT EXISTS monitors (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					uuid TEXT NOT NULL UNIQUE,
+					exp_id INTEGER NOT NULL DEFAULT 0,
+					setup_id INTEGER NOT NULL DEFAULT 0,
+					interval INTEGER NOT NULL DEFAULT 0,
+					amount INTEGER NOT NULL DEFAULT 0,
+					duration INTEGER NOT NULL DEFAULT 0,
+					created TEXT NOT NULL,
+					stopat TEXT NOT NULL,
+					active INTEGER NOT NULL DEFAULT 0
+				);`, `
+				CREATE TABLE IF NOT EXISTS monitors_values (
+					uuid TEXT NOT NULL,
+					name TEXT NOT NULL,
+					sensor TEXT NOT NULL,
+					valueidx INTEGER NOT NULL,
+					PRIMARY KEY (uuid, name)
+				);`, `
+				CREATE TABLE IF NOT EXISTS monitors_counters (
+					uuid TEXT NOT NULL PRIMARY KEY,
+					done INTEGER NOT NULL DEFAULT 0,
+					err INTEGER NOT NULL DEFAULT 0
+				);`, `
+				CREATE TABLE IF NOT EXISTS detections (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					exp_id INTEGER NOT NULL,
+					mon_id INTEGER NOT NULL,
+					time TEXT NOT NULL,
+					sensor_id TEXT NOT NULL,
+					sensor_val_id INTEGER NOT NULL,
+					detection REAL,
+					error TEXT
+				);`, `
+				CREATE INDEX IF NOT EXISTS detections_mon_id
+				ON detections (mon_id);`,
+			}, nil},
+			{2, "consolidated archives", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_archives (
+					uuid TEXT NOT NULL,
+					step INTEGER NOT NULL,
+					PRIMARY KEY (uuid, step)
+				);`, `
+				CREATE TABLE IF NOT EXISTS detections_archives (
+					mon_id INTEGER NOT NULL,
+					step INTEGER NOT NULL,
+					time TEXT NOT NULL,
+					sensor_id TEXT NOT NULL,
+					sensor_val_id INTEGER NOT NULL,
+					cnt INTEGER NOT NULL DEFAULT 0,
+					sum REAL NOT NULL DEFAULT 0,
+					min REAL,
+					max REAL,
+					last REAL,
+					PRIMARY KEY (mon_id, step, time, sensor_id, sensor_val_id)
+				);`,
+			}, nil},
+			{3, "millisecond steps", nil, []schemaColumn{
+				{"monitors", "interval_ms", "INTEGER NOT NULL DEFAULT 0"},
+			}},
+			{4, "monitor pauses", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_pauses (
+					uuid TEXT NOT NULL,
+					paused_at TEXT NOT NULL,
+					resumed_at TEXT NOT NULL DEFAULT '',
+					PRIMARY KEY (uuid, paused_at)
+				);`,
+			}, []schemaColumn{
+				{"monitors", "paused", "INTEGER NOT NULL DEFAULT 0"},
+			}},
+			{5, "monitor changes", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_changes (
+					uuid TEXT NOT NULL,
+					time TEXT NOT NULL,
+					interval_ms INTEGER NOT NULL,
+					amount INTEGER NOT NULL,
+					stopat TEXT NOT NULL,
+					vals TEXT NOT NULL,
+					PRIMARY KEY (uuid, time)
+				);`,
+			}, nil},
+			{6, "monitor schedules", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_schedules (
+					uuid TEXT NOT NULL PRIMARY KEY,
+					start_at TEXT NOT NULL,
+					spec TEXT NOT NULL DEFAULT '',
+					window_secs INTEGER NOT NULL DEFAULT 0
+				);`,
+			}, nil},
+			{7, "monitor alarms", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_alarms (
+					uuid TEXT NOT NULL,
+					name TEXT NOT NULL,
+					rule TEXT NOT NULL,
+					state TEXT NOT NULL,
+					cause TEXT NOT NULL DEFAULT '',
+					since TEXT NOT NULL,
+					reading REAL,
+					PRIMARY KEY (uuid, name)
+				);`,
+			}, nil},
+			{8, "monitor gaps", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_gaps (
+					uuid TEXT NOT NULL,
+					start_at TEXT NOT NULL,
+					end_at TEXT NOT NULL,
+					cause TEXT NOT NULL,
+					PRIMARY KEY (uuid, start_at)
+				);`,
+			}, nil},
+		},
+	},
+	// Times are stored as fixed-width RFC3339 text (RFC3339Nano_Fixed),
+	// so they are ordered by ascii_bin collation,
+	// DDL statements are committed implicitly by mysql,
+	// so migrations must stay safe to run again after failure.
+	"mysql": {
+		TableExists: `
+			SELECT COUNT(*)
+			FROM information_schema.tables
+			WHERE table_schema = DATABASE() AND table_name = ?;
+		`,
+		ColumnExists: `
+			SELECT COUNT(*)
+			FROM information_schema.columns
+			WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?;
+		`,
+		Version: `
+			CREATE TABLE IF NOT EXISTS schema_version (
+				version INTEGER NOT NULL PRIMARY KEY,
+				name VARCHAR(255) NOT NULL,
+				applied VARCHAR(40) NOT NULL
+			);
+		`,
+		Migrations: []migration{
+			{1, "monitors and detections", []string{`
+				CREATE TABLE IF NOT EXISTS monitors (
+					id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+					uuid VARCHAR(36) NOT NULL UNIQUE,
+					exp_id INTEGER NOT NULL DEFAULT 0,
+					setup_id INTEGER NOT NULL DEFAULT 0,
+					` + "`interval`" + ` INTEGER NOT NULL DEFAULT 0,
+					amount INTEGER NOT NULL DEFAULT 0,
+					duration INTEGER NOT NULL DEFAULT 0,
+					created VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					stopat VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					active INTEGER NOT NULL DEFAULT 0
+				);`, `
+				CREATE TABLE IF NOT EXISTS monitors_values (
+					uuid VARCHAR(36) NOT NULL,
+					name VARCHAR(255) NOT NULL,
+					sensor VARCHAR(255) NOT NULL,
+					valueidx INTEGER NOT NULL,
+					PRIMARY KEY (uuid, name)
+				);`, `
+				CREATE TABLE IF NOT EXISTS monitors_counters (
+					uuid VARCHAR(36) NOT NULL PRIMARY KEY,
+					done INTEGER NOT NULL DEFAULT 0,
+					err INTEGER NOT NULL DEFAULT 0
+				);`, `
+				CREATE TABLE IF NOT EXISTS detections (
+					id BIGINT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+					exp_id INTEGER NOT NULL,
+					mon_id INTEGER NOT NULL,
+					time VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					sensor_id VARCHAR(64) NOT NULL,
+					sensor_val_id INTEGER NOT NULL,
+					detection DOUBLE,
+					error TEXT,
+					INDEX detections_mon_id (mon_id)
+				);`,
+			}, nil},
+			{2, "consolidated archives", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_archives (
+					uuid VARCHAR(36) NOT NULL,
+					step INTEGER NOT NULL,
+					PRIMARY KEY (uuid, step)
+				);`, `
+				CREATE TABLE IF NOT EXISTS detections_archives (
+					mon_id INTEGER NOT NULL,
+					step INTEGER NOT NULL,
+					time VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					sensor_id VARCHAR(64) NOT NULL,
+					sensor_val_id INTEGER NOT NULL,
+					cnt INTEGER NOT NULL DEFAULT 0,
+					sum DOUBLE NOT NULL DEFAULT 0,
+					min DOUBLE,
+					max DOUBLE,
+					last DOUBLE,
+					PRIMARY KEY (mon_id, step, time, sensor_id, sensor_val_id)
+				);`,
+			}, nil},
+			{3, "millisecond steps", nil, []schemaColumn{
+				{"monitors", "interval_ms", "INTEGER NOT NULL DEFAULT 0"},
+			}},
+			{4, "monitor pauses", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_pauses (
+					uuid VARCHAR(36) NOT NULL,
+					paused_at VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					resumed_at VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL DEFAULT '',
+					PRIMARY KEY (uuid, paused_at)
+				);`,
+			}, []schemaColumn{
+				{"monitors", "paused", "INTEGER NOT NULL DEFAULT 0"},
+			}},
+			{5, "monitor changes", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_changes (
+					uuid VARCHAR(36) NOT NULL,
+					time VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					interval_ms INTEGER NOT NULL,
+					amount INTEGER NOT NULL,
+					stopat VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					vals TEXT NOT NULL,
+					PRIMARY KEY (uuid, time)
+				);`,
+			}, nil},
+			{6, "monitor schedules", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_schedules (
+					uuid VARCHAR(36) NOT NULL PRIMARY KEY,
+					start_at VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					spec VARCHAR(255) NOT NULL DEFAULT '',
+					window_secs INTEGER NOT NULL DEFAULT 0
+				);`,
+			}, nil},
+			{7, "monitor alarms", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_alarms (
+					uuid VARCHAR(36) NOT NULL,
+					name VARCHAR(255) NOT NULL,
+					rule TEXT NOT NULL,
+					state VARCHAR(16) NOT NULL,
+					cause VARCHAR(16) NOT NULL DEFAULT '',
+					since VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					reading DOUBLE,
+					PRIMARY KEY (uuid, name)
+				);`,
+			}, nil},
+			{8, "monitor gaps", []string{`
+				CREATE TABLE IF NOT EXISTS monitors_gaps (
+					uuid VARCHAR(36) NOT NULL,
+					start_at VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					end_at VARCHAR(40) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					cause VARCHAR(16) NOT NULL,
+					PRIMARY KEY (uuid, start_at)
+				);`,
+			}, nil},
+		},
+	},
+}
+
+// schemaVersion returns version of database schema,
+// 0 if database has no versioning yet.
+func schemaVersion(sch schema) (uint, error) {
+	var n int
+	err := db.QueryRow(sch.TableExists, "schema_version").Scan(&n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = db.QueryRow("SELECT MAX(version) FROM schema_version;").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return uint(version.Int64), nil
+}
+
+// migrateDB creates or upgrades database schema of dbtype to the last version.
+// Every migration is applied in its own transaction.
+// It returns pending migrations, which are not applied if dryRun is true.
+func migrateDB(dbtype string, dryRun bool) ([]migration, error) {
+	sch, ok := schemas[dbtype]
+	if !ok {
+		return nil, errors.New("no schema for database type '" + dbtype + "'")
+	}
+
+	version, err := schemaVersion(sch)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]migration, 0)
+	for _, m := range sch.Migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	if dryRun || len(pending) == 0 {
+		return pending, nil
+	}
+
+	_, err = db.Exec(sch.Version)
+	if err != nil {
+		return pending, err
+	}
+	for _, m := range pending {
+		logger.Printf("Migrate database schema to version %d: %s\n", m.Version, m.Name)
+		err = applyMigration(sch, m)
+		if err != nil {
+			return pending, fmt.Errorf("migration %d (%s): %s", m.Version, m.Name, err)
+		}
+	}
+
+	return pending, nil
+}
+
+func applyMigration(sch schema, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, query := range m.SQL {
+		_, err = tx.Exec(query)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, c := range m.Columns {
+		var n int
+		err = tx.QueryRow(sch.ColumnExists, c.Table, c.Name).Scan(&n)
+		if err == nil && n == 0 {
+			_, err = tx.Exec("ALTER TABLE " + c.Table + " ADD COLUMN " + c.Name + " " + c.Def)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(
+		"INSERT INTO schema_version (version, name, applied) VALUES (?, ?, ?);",
+		m.Version,
+		m.Name,
+		time.Now().UTC().Format(time.RFC3339Nano),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// printMigrations prints steps of migrations for migrate command.
+func printMigrations(list []migration) {
+	if len(list) == 0 {
+		fmt.Println("Database schema is up to date")
+		return
+	}
+	for _, m := range list {
+		fmt.Printf("-- version %d: %s\n", m.Version, m.Name)
+		for _, query := range m.SQL {
+			fmt.Println(query)
+		}
+		for _, c := range m.Columns {
+			fmt.Printf("ALTER TABLE %s ADD COLUMN %s %s; -- if missing\n", c.Table, c.Name, c.Def)
+		}
+	}
+}
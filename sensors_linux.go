@@ -19,6 +19,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/scratchduino/i2c"
@@ -31,6 +32,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -69,6 +71,7 @@ type Value struct {
 	Multiplier float64
 	Addend     float64
 	Type       ValueType
+	Unit       string
 }
 
 type Sensor struct {
@@ -297,8 +300,38 @@ func (sensor Sensor) Search() (PluggedSensors, error) {
 	return nil, errors.New("Unknown sensor type")
 }
 
+// Causes of reading errors
+const (
+	READ_TIMEOUT = "timeout"  // sensor did not answer in time
+	READ_RANGE   = "range"    // reading is out of range
+	READ_PARSE   = "parse"    // sensor data can not be parsed
+	READ_MISSING = "missing"  // sensor or its value is not plugged
+	READ_IO      = "io"       // sensor data can not be read
+	READ_NODATA  = "nodata"   // value is not detected, cause is unknown
+)
+
+// ReadError is error of reading sensor value with its cause.
+type ReadError struct {
+	Cause string
+	Err   error
+}
+
+func (e *ReadError) Error() string {
+	return e.Err.Error()
+}
+
+// readCause returns cause of reading error.
+func readCause(err error) string {
+	if re, ok := err.(*ReadError); ok {
+		return re.Cause
+	}
+	return READ_IO
+}
+
 // GetData reads n'th value from sensor and returns it and error, if any.
-func (sensor PluggedSensor) GetData(n int) (data float64, err error) {
+// Error is *ReadError with cause of error. Command reading value
+// is killed when ctx is done.
+func (sensor PluggedSensor) GetData(ctx context.Context, n int) (data float64, err error) {
 	var s []byte
 	if sensor.Values[n].Command != "" {
 		var cmd string
@@ -321,11 +354,19 @@ func (sensor PluggedSensor) GetData(n int) (data float64, err error) {
 		default:
 			logger.Panic("unknown bus")
 		}
-		c := exec.Command("/bin/sh", "-c", cmd)
+		c := exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+		// kill shell with commands it runs, so output is closed
+		c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		c.Cancel = func() error {
+			return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		}
 		s, err = c.Output()
+		if ctx.Err() != nil {
+			return 0.0, &ReadError{READ_TIMEOUT, ctx.Err()}
+		}
 		if err != nil {
 			logger.Print("'" + cmd + "': " + err.Error())
-			return 0.0, err
+			return 0.0, &ReadError{READ_IO, err}
 		}
 	} else if path.IsAbs(sensor.Values[n].File) {
 		// read value from file by absolute path.
@@ -336,7 +377,7 @@ func (sensor PluggedSensor) GetData(n int) (data float64, err error) {
 				"Cannot read file '%s': %s",
 				sensor.Values[n].File, err,
 			)
-			return 0.0, err
+			return 0.0, &ReadError{READ_IO, err}
 		}
 	} else {
 		// read value from file relative to device directory in sysfs
@@ -355,48 +396,48 @@ func (sensor PluggedSensor) GetData(n int) (data float64, err error) {
 			}
 		case I2C:
 			if sensor.Values[n].File == "" {
-				return 0.0, errors.New("No file nor command specified")
+				return 0.0, &ReadError{READ_IO, errors.New("No file nor command specified")}
 			}
 			addr := sensor.Address & 0xff
 			bus := sensor.Address >> 8
 			file = fmt.Sprintf("/sys/bus/i2c/devices/i2c-%d/%x-%04x/%s", bus, bus, addr, sensor.Values[n].File)
 		case FILE:
 			if sensor.Values[n].File == "" {
-				return 0.0, errors.New("No file nor command specified")
+				return 0.0, &ReadError{READ_IO, errors.New("No file nor command specified")}
 			}
 			err = fmt.Errorf("Relative file path is not supported for bus type '%s'", sensor.Device.Bus)
 			logger.Print(err)
-			return 0.0, err
+			return 0.0, &ReadError{READ_IO, err}
 		default:
 			logger.Panic("unknown bus")
 		}
 		s, err = ioutil.ReadFile(file)
 		if err != nil {
 			err = fmt.Errorf("Cannot read file '%s': %s", file, err)
-			return 0.0, err
+			return 0.0, &ReadError{READ_IO, err}
 		}
 	}
 	strdata := sensor.Values[n].Re.FindSubmatch(s)
 	switch len(strdata) {
 	case 0:
-		return 0.0, errors.New("No data received")
+		return 0.0, &ReadError{READ_PARSE, errors.New("No data received")}
 	case 1:
 		data, err = strconv.ParseFloat(string(strdata[0]), 64)
 	default:
 		data, err = strconv.ParseFloat(string(strdata[1]), 64)
 	}
 	if err != nil {
-		return math.NaN(), errors.New("Cannot parse data: " + err.Error())
+		return math.NaN(), &ReadError{READ_PARSE, errors.New("Cannot parse data: " + err.Error())}
 	}
 	if math.IsNaN(data) {
-		return math.NaN(), errors.New("Cannot parse data: NaN")
+		return math.NaN(), &ReadError{READ_PARSE, errors.New("Cannot parse data: NaN")}
 	}
 
 	data = data*sensor.Values[n].Multiplier + sensor.Values[n].Addend
 
 	// check range
 	if data < sensor.Values[n].Range.Min || data > sensor.Values[n].Range.Max {
-		return math.NaN(), errors.New("Data value out of range: NaN")
+		return math.NaN(), &ReadError{READ_RANGE, errors.New("Data value out of range: NaN")}
 	}
 
 	return data, nil
@@ -19,118 +19,429 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
+	"runtime"
+	"sync"
 	"time"
 )
 
 type SerData struct {
-	Time     time.Time
-	Readings []float64
+	Time      time.Time
+	Readings  []float64
+	Scheduled time.Time
+	Errors    []string  // causes of reading errors by value, nil if there are none
+	Gap       string    // cause of gap starting at Time for row of NaN readings
+
+	counts    []uint    // detections of readings of archive bucket, weights of average
+}
+
+// readResult is a reading of sensor value sent by getSerData.
+type readResult struct {
+	Value float64
+	Cause string  // cause of reading error, empty if there is none
+}
+
+// setError sets cause of error of i'th reading.
+func (sd *SerData) setError(i int, cause string) {
+	if sd.Errors == nil {
+		sd.Errors = make([]string, len(sd.Readings))
+	}
+	sd.Errors[i] = cause
+}
+
+// readingError returns cause of error of i'th reading,
+// empty string if reading is valid.
+func (sd *SerData) readingError(i int) string {
+	if i < len(sd.Errors) && sd.Errors[i] != "" {
+		return sd.Errors[i]
+	}
+	if i >= len(sd.Readings) || math.IsNaN(sd.Readings[i]) {
+		return READ_NODATA
+	}
+	return ""
+}
+
+type SeriesStatus struct {
+	Done   uint          // Samples made
+	Missed uint          // Ticks skipped because previous reading was too slow
+	Late   uint          // Samples completed later than tolerance after scheduled time
+	MaxLag time.Duration // Maximum lag of completed acquisition from scheduled time
+	Drift  time.Duration // Lag of the last completed sample from scheduled time
+}
+
+// sampler schedules ticks of series at absolute times start + n*period,
+// so timing error of single tick does not accumulate.
+type sampler struct {
+	period time.Duration
+	start  time.Time
+	n      int64
+
+	mu     sync.Mutex
+	status SeriesStatus
+}
+
+// serBuffer is a ring buffer of series data rows. Rows are numbered
+// sequentially from 0, so readers can fetch rows since a cursor
+// without consuming them.
+type serBuffer struct {
+	mu   sync.RWMutex
+	rows []*SerData
+	next uint64   // sequence number of the next row
+	mon  *Monitor // monitor new rows are saved to, nil if series is not saved
+
+	pmu       sync.Mutex // serializes Persist calls
+	persisted []*SerData // rows pushed while rows in buffer are saved, nil otherwise
+}
+
+const (
+	// spinPeriod is the period of series below which sampler
+	// busy-waits the last part of interval instead of sleeping
+	spinPeriod = 10 * time.Millisecond
+	// spinTime is the part of interval sampler busy-waits
+	spinTime = time.Millisecond
+)
+
+func newSerBuffer(size uint) *serBuffer {
+	return &serBuffer{rows: make([]*SerData, size)}
+}
+
+// Push appends row to buffer overwriting the oldest one if buffer is full.
+// If series is saved, row is queued to be written to its monitor.
+func (b *serBuffer) Push(d *SerData) {
+	b.mu.Lock()
+	b.rows[b.next%uint64(len(b.rows))] = d
+	b.next++
+	if b.mon != nil {
+		b.mon.queueRow(d)
+	} else if b.persisted != nil {
+		b.persisted = append(b.persisted, d)
+	}
+	b.mu.Unlock()
+}
+
+// Persist calls save with rows in buffer, rows pushed after that
+// are queued to be written to monitor returned by save.
+// Rows pushed while save runs are kept aside and queued after it,
+// so Push is not blocked by saving and every row is saved once.
+func (b *serBuffer) Persist(save func(rows []*SerData) (*Monitor, error)) (*Monitor, error) {
+	b.pmu.Lock()
+	defer b.pmu.Unlock()
+
+	b.mu.Lock()
+	if b.mon != nil {
+		b.mu.Unlock()
+		return b.mon, nil
+	}
+	rows := make([]*SerData, 0, b.next-b.first())
+	for i := b.first(); i < b.next; i++ {
+		rows = append(rows, b.rows[i%uint64(len(b.rows))])
+	}
+	b.persisted = make([]*SerData, 0)
+	b.mu.Unlock()
+
+	mon, err := save(rows)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pushed := b.persisted
+	b.persisted = nil
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range pushed {
+		mon.queueRow(d)
+	}
+	b.mon = mon
+	return mon, nil
+}
+
+// first returns sequence number of the oldest row in buffer.
+func (b *serBuffer) first() uint64 {
+	if b.next > uint64(len(b.rows)) {
+		return b.next - uint64(len(b.rows))
+	}
+	return 0
+}
+
+// Since returns rows with sequence numbers from seq, sequence number
+// of the next row to read and true if some rows since seq were
+// overwritten before being read.
+func (b *serBuffer) Since(seq uint64) ([]*SerData, uint64, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	lost := false
+	if first := b.first(); seq < first {
+		seq = first
+		lost = true
+	}
+	if seq > b.next {
+		seq = b.next
+	}
+	rows := make([]*SerData, 0, b.next-seq)
+	for i := seq; i < b.next; i++ {
+		rows = append(rows, b.rows[i%uint64(len(b.rows))])
+	}
+	return rows, b.next, lost
+}
+
+// Len returns number of rows in buffer.
+func (b *serBuffer) Len() uint {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return uint(b.next - b.first())
+}
+
+func newSampler(period time.Duration) *sampler {
+	return &sampler{
+		period: period,
+		start:  time.Now().Add(period),
+	}
+}
+
+// wait sleeps until the next scheduled tick and returns its time.
+// Ticks passed already are skipped and counted as missed.
+// It returns false if stop signal is received while waiting.
+func (sm *sampler) wait(stop <-chan int) (time.Time, bool) {
+	now := time.Now()
+	next := sm.start.Add(time.Duration(sm.n) * sm.period)
+	if now.After(next) && sm.n > 0 {
+		missed := int64(now.Sub(next) / sm.period)
+		if missed > 0 {
+			sm.n += missed
+			next = sm.start.Add(time.Duration(sm.n) * sm.period)
+			sm.mu.Lock()
+			sm.status.Missed += uint(missed)
+			sm.mu.Unlock()
+		}
+	}
+	sm.n++
+
+	d := next.Sub(now)
+	if sm.period < spinPeriod {
+		d -= spinTime
+	}
+	if d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-stop:
+			t.Stop()
+			return next, false
+		}
+	}
+	for time.Now().Before(next) {
+		runtime.Gosched()
+	}
+	return next, true
+}
+
+// done registers sample scheduled at time sched whose readings are
+// all acquired at time t, so lag includes timer wake-up and reading time.
+func (sm *sampler) done(sched, t time.Time) {
+	lag := t.Sub(sched)
+	sm.mu.Lock()
+	sm.status.Done++
+	if lag > sm.period/4 {
+		sm.status.Late++
+	}
+	if lag > sm.status.MaxLag {
+		sm.status.MaxLag = lag
+	}
+	sm.status.Drift = lag
+	sm.mu.Unlock()
+}
+
+// Status returns copy of sampler timing statistics.
+func (sm *sampler) Status() SeriesStatus {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.status
 }
 
 // startSeries begins the series of measurements of values one time per period,
-// maximum number of measurements is count.
-// It returns channel to read data from, channel receiving value to stop series
-// and error if any.
-func startSeries(values []ValueId, period time.Duration, count int) (<-chan *SerData, chan<- int, <-chan int, error) {
+// maximum number of measurements is count. Measured data is also published
+// to stream subscribers of source and queued to be written to persist
+// monitor if not nil.
+// If trigger is not nil, count is ignored and series runs until trigger
+// capture is complete.
+// It returns buffer to read data from, channel receiving value to stop series,
+// channel closed on series end, sampler with timing statistics and error if any.
+func startSeries(source string, values []ValueId, period time.Duration, count int, persist *Monitor, tr *trigger) (*serBuffer, chan<- int, <-chan int, *sampler, error) {
 	// check arguments
 	if len(values) == 0 {
-		return nil, nil, nil, errors.New("no sensors selected")
+		return nil, nil, nil, nil, errors.New("no sensors selected")
 	}
-	if period == 0 {
-		return nil, nil, nil, errors.New("period must be greater than zero")
+	if period <= 0 {
+		return nil, nil, nil, nil, errors.New("period must be greater than zero")
 	}
-	if count <= 0 {
-		return nil, nil, nil, errors.New("count must be greater than zero")
+	if count <= 0 && tr == nil {
+		return nil, nil, nil, nil, errors.New("count must be greater than zero")
 	}
 
 	// check that values are available and period does not exceed resolution
 	for _, v := range values {
 		if pluggedSensors[v.Sensor] == nil {
 			err := errors.New("no sensor '" + v.Sensor + "' connected")
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 		if len(pluggedSensors[v.Sensor].Values) <= v.ValueIdx {
 			err := fmt.Errorf("no value %d for sensor '%s' available",
 				v.ValueIdx, v.Sensor)
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 		if pluggedSensors[v.Sensor].Values[v.ValueIdx].Resolution > period {
 			err := errors.New("cannot read values so quickly")
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 	}
-	out := make(chan *SerData, config.Series.Buffer)
+	out := newSerBuffer(config.Series.Buffer)
+	out.mon = persist
 	stop := make(chan int, 1)
 	finished := make(chan int, 1)
+	sm := newSampler(period)
 	// starting measurements
 	go func() {
-		ti := time.NewTicker(period)
-		readings := make([](chan float64), len(values))
+		readings := make([](chan readResult), len(values))
 		for i := range readings {
-			readings[i] = make(chan float64, 1)
+			readings[i] = make(chan readResult, 1)
 		}
 		for {
-			select {
-			case t := <-ti.C:
-				for i, v := range values {
-					// sensors are polled simultaneously
-					// to avoid lags
-					go getSerData(v.Sensor, v.ValueIdx, readings[i])
-				}
-				data := SerData{t, make([]float64, len(values))}
-				for i, c := range readings {
-					data.Readings[i] = <-c
-				}
-				if len(out) == int(config.Series.Buffer) {
-					// channel shouldn't be blocked
-					// so we simply drop the oldest dataset
-					<-out
-				}
-				out <- &data
-				// check if we are enforced to stop
-				if len(stop) > 0 {
-					<-stop
-					close(out)
-					close(finished)
-					return
+			sched, ok := sm.wait(stop)
+			if !ok {
+				close(finished)
+				streams.Close(source)
+				return
+			}
+			t := time.Now()
+			for i, v := range values {
+				// sensors are polled simultaneously
+				// to avoid lags
+				go getSerData(v.Sensor, v.ValueIdx, readings[i])
+			}
+			data := SerData{Time: t, Readings: make([]float64, len(values)), Scheduled: sched}
+			for i, c := range readings {
+				r := <-c
+				data.Readings[i] = r.Value
+				if r.Cause != "" {
+					data.setError(i, r.Cause)
 				}
-				// or series is complete
+			}
+			sm.done(sched, time.Now())
+			// the oldest dataset is overwritten if buffer is full
+			out.Push(&data)
+			streams.Publish(source, &data)
+			// check if we are enforced to stop
+			if len(stop) > 0 {
+				<-stop
+				close(finished)
+				streams.Close(source)
+				return
+			}
+			// or series is complete
+			// (or trigger capture is complete)
+			complete := false
+			if tr != nil {
+				complete = tr.add(&data)
+			} else {
 				count--
-				if count == 0 {
-					// stop himself
-					finished <- 1
-					close(finished)
-					close(out)
-					return
-				}
-			case <-stop:
-				close(out)
+				complete = count == 0
+			}
+			if complete {
+				// stop himself
+				finished <- 1
 				close(finished)
+				streams.Close(source)
 				return
 			}
 		}
 	}()
-	return out, stop, finished, nil
+	return out, stop, finished, sm, nil
+}
+
+// sensorRead is a running reading of sensor value.
+type sensorRead struct {
+	done     chan struct{}  // closed when reading is done
+	res      readResult
+	timedOut bool           // reading timed out, but is still running
 }
 
-func getSerData(s string, id int, c chan float64) {
+// readsInFlight keeps values being read, so concurrent readings
+// of value share one reading and value is not read again while
+// previous reading which timed out is still running.
+var readsInFlight = struct {
+	mu sync.Mutex
+	m  map[ValueId]*sensorRead
+}{m: make(map[ValueId]*sensorRead)}
+
+// sensorContext returns context of reading sensor value
+// which is done after `sensorstimeout` milliseconds,
+// it is not done by timeout if `sensorstimeout` is 0.
+func sensorContext() (context.Context, context.CancelFunc) {
+	if config.SensorsTimeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(config.SensorsTimeout) * time.Millisecond)
+}
+
+// getSerData reads value of sensor and sends reading to c,
+// reading is NaN with cause of error if value is not read
+// in `sensorstimeout` milliseconds. Reading command is killed
+// on timeout. If value is being read already, reading is shared,
+// if previous reading of value timed out and is still running,
+// value is not read and reading is timed out.
+func getSerData(s string, id int, c chan readResult) {
 	sr, f := pluggedSensors[s]
 	if !f {
-		c <- math.NaN()
+		c <- readResult{math.NaN(), READ_MISSING}
 		return
 	}
 	if len(sr.Values) <= id {
-		c <- math.NaN()
+		c <- readResult{math.NaN(), READ_MISSING}
 		return
 	}
-	d, err := sr.GetData(id)
-	if err != nil {
-		logger.Print(err)
-		c <- math.NaN()
+
+	ctx, cancel := sensorContext()
+	defer cancel()
+
+	vid := ValueId{s, id}
+	readsInFlight.mu.Lock()
+	r, running := readsInFlight.m[vid]
+	if running && r.timedOut {
+		readsInFlight.mu.Unlock()
+		c <- readResult{math.NaN(), READ_TIMEOUT}
 		return
 	}
-	c <- d
+	if !running {
+		r = &sensorRead{done: make(chan struct{})}
+		readsInFlight.m[vid] = r
+		go func() {
+			d, err := sr.GetData(ctx, id)
+			if err != nil {
+				logger.Print(err)
+				r.res = readResult{math.NaN(), readCause(err)}
+			} else {
+				r.res = readResult{d, ""}
+			}
+			readsInFlight.mu.Lock()
+			delete(readsInFlight.m, vid)
+			readsInFlight.mu.Unlock()
+			close(r.done)
+		}()
+	}
+	readsInFlight.mu.Unlock()
+
+	select {
+	case <-r.done:
+		c <- r.res
+	case <-ctx.Done():
+		readsInFlight.mu.Lock()
+		r.timedOut = true
+		readsInFlight.mu.Unlock()
+		logger.Printf("Timeout reading value %d of sensor '%s'", id, s)
+		c <- readResult{math.NaN(), READ_TIMEOUT}
+	}
 }
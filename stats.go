@@ -0,0 +1,187 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+type MonStatsOpts struct {
+	UUID  string
+	Start time.Time  `json:",omitempty"`
+	End   time.Time  `json:",omitempty"`
+	Step  time.Duration  // group by time buckets of Step, 0 for whole range
+}
+
+// ValueStats are statistics of value readings,
+// they are zero if there are no valid readings.
+type ValueStats struct {
+	Name      string
+	Count     uint           // valid readings
+	Errors    uint           // failed readings
+	Min       float64
+	MinTime   time.Time
+	Max       float64
+	MaxTime   time.Time
+	Mean      float64
+	StdDev    float64        // population standard deviation
+	First     float64
+	FirstTime time.Time
+	Last      float64
+	LastTime  time.Time
+	Duration  time.Duration  // from first to last valid reading
+}
+
+type MonStatsBucket struct {
+	Time   time.Time  // start of bucket
+	Values []ValueStats
+}
+
+type MonStats struct {
+	UUID    string
+	Values  []ValueStats
+	Buckets []MonStatsBucket  `json:",omitempty"`
+}
+
+// statsAcc accumulates statistics of value readings,
+// mean and deviation are computed by Welford's algorithm.
+type statsAcc struct {
+	ValueStats
+	m2 float64
+}
+
+func (a *statsAcc) add(tm time.Time, v float64, failed bool) {
+	if failed || math.IsNaN(v) {
+		a.Errors++
+		return
+	}
+
+	a.Count++
+	if a.Count == 1 {
+		a.Min, a.MinTime = v, tm
+		a.Max, a.MaxTime = v, tm
+		a.First, a.FirstTime = v, tm
+	}
+	if v < a.Min {
+		a.Min, a.MinTime = v, tm
+	}
+	if v > a.Max {
+		a.Max, a.MaxTime = v, tm
+	}
+	a.Last, a.LastTime = v, tm
+	a.Duration = a.LastTime.Sub(a.FirstTime)
+
+	delta := v - a.Mean
+	a.Mean += delta / float64(a.Count)
+	a.m2 += delta * (v - a.Mean)
+	a.StdDev = math.Sqrt(a.m2 / float64(a.Count))
+}
+
+func newStatsAccs(values []MonValue) []statsAcc {
+	accs := make([]statsAcc, len(values))
+	for i, v := range values {
+		accs[i].Name = v.Name
+	}
+	return accs
+}
+
+func statsOf(accs []statsAcc) []ValueStats {
+	stats := make([]ValueStats, len(accs))
+	for i := range accs {
+		stats[i] = accs[i].ValueStats
+	}
+	return stats
+}
+
+// monitorStats computes statistics of monitor values within time range
+// reading detections one by one.
+func monitorStats(mon *Monitor, opts *MonStatsOpts) (*MonStats, error) {
+	if opts.Step < 0 {
+		return nil, errors.New("wrong statistics step")
+	}
+
+	monDBi, err := monitorToDB(mon)
+	if err != nil {
+		return nil, err
+	}
+	values, err := monDBi.allValues()
+	if err != nil {
+		return nil, err
+	}
+	idx := make(map[ValueId]int)
+	for i, v := range values {
+		id := ValueId{v.Sensor, v.ValueIdx}
+		if _, ok := idx[id]; !ok {
+			idx[id] = i
+		}
+	}
+
+	stats := &MonStats{UUID: monDBi.UUID}
+	total := newStatsAccs(values)
+	var bucket []statsAcc
+	var bucketTime time.Time
+	flush := func() {
+		if bucket != nil {
+			stats.Buckets = append(stats.Buckets, MonStatsBucket{bucketTime, statsOf(bucket)})
+		}
+	}
+	add := func(tm time.Time, i int, v float64, failed bool) {
+		total[i].add(tm, v, failed)
+
+		if opts.Step > 0 {
+			bt := tm.Truncate(opts.Step)
+			if bucket == nil || !bt.Equal(bucketTime) {
+				flush()
+				bucket = newStatsAccs(values)
+				bucketTime = bt
+			}
+			bucket[i].add(tm, v, failed)
+		}
+	}
+	// Detections waiting in write queue are newer than stored ones
+	pending, _ := writes.Pending(mon)
+	var last time.Time
+	err = store.ScanDetections(monDBi.Id, opts.Start, opts.End, func(d *DetectionItem) error {
+		last = d.Time
+		i, ok := idx[ValueId{d.Sensor_id, d.Sensor_val_id}]
+		if ok {
+			add(d.Time, i, d.Detection, d.Error != "")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range newerRows(pending, last) {
+		if (!opts.Start.IsZero() && row.Time.Before(opts.Start)) || (!opts.End.IsZero() && row.Time.After(opts.End)) {
+			continue
+		}
+		for i, v := range row.Readings {
+			if i < len(values) {
+				add(row.Time, i, v, row.readingError(i) != "")
+			}
+		}
+	}
+	flush()
+
+	stats.Values = statsOf(total)
+	return stats, nil
+}
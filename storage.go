@@ -0,0 +1,1169 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Storage keeps monitors with their history and detections.
+// Times are stored in UTC.
+type Storage interface {
+	Close() error
+
+	// Monitors
+	MonitorIds() ([]int, error)
+	LoadMonitor(id int) (*MonitorDBItem, error)
+	// InsertMonitor saves new monitor with values, archives and zero counters,
+	// it returns id of monitor.
+	InsertMonitor(monDBi *MonitorDBItem) (int, error)
+	// UpdateMonitor saves monitor parameters, values and counters are not changed.
+	UpdateMonitor(monDBi *MonitorDBItem) error
+	// ChangeMonitor saves monitor parameters and values and adds
+	// changes to history of monitor parameters atomically.
+	ChangeMonitor(monDBi *MonitorDBItem, changes []MonChange) error
+	// RemoveMonitor removes monitor, its detections are removed if wdata is true.
+	RemoveMonitor(monDBi *MonitorDBItem, wdata bool) error
+	Counters(u string) (MonCounters, error)
+
+	// History of monitor parameters and pauses
+	Changes(u string) ([]MonChange, error)
+	Pauses(u string) ([]MonPause, error)
+	AddPause(u string, start time.Time) error
+	// ClosePause sets end of open pause, it returns start of the pause
+	// or false if monitor has no open pause.
+	ClosePause(u string, end time.Time) (time.Time, bool, error)
+	// Gaps returns gaps of monitor ordered by start.
+	Gaps(u string) ([]MonGap, error)
+	AddGap(u string, g MonGap) error
+
+	// Schedules, Next is not stored
+	Schedules() ([]APISchedule, error)
+	SaveSchedule(sch APISchedule) error
+	RemoveSchedule(u string) error
+
+	// Alarms of monitor values with their state
+	Alarms() ([]APIAlarm, error)
+	SaveAlarm(a APIAlarm) error
+	RemoveAlarms(u string) error
+
+	// AppendDetections writes data rows of monitors and updates their
+	// consolidated archives atomically. Stored counters are updated
+	// if count is true. It returns counters of written rows by monitor.
+	AppendDetections(batch []MonitorRows, count bool) ([]MonCounters, error)
+	// ScanDetections passes detections of monitor within time range
+	// to fn ordered by time, zero start or end time is not limited.
+	// Scan stops on error of fn, errStopScan stops it without error.
+	ScanDetections(monId int, start, end time.Time, fn func(*DetectionItem) error) error
+	// ScanArchive passes buckets of consolidated archive like ScanDetections.
+	ScanArchive(monId int, step uint, start, end time.Time, fn func(*ArchiveRow) error) error
+	// CountDetections counts detections of monitor made before time,
+	// all detections of monitor if before is zero.
+	CountDetections(monId int, before time.Time) (uint, error)
+	CountTimes(monId int) (uint, error)
+	CountValue(monId int, sensor string, valueIdx int) (uint, error)
+	CountArchive(monId int, step uint) (uint, error)
+	TotalDetections() (uint64, error)
+	// LastTime returns time of last detection, zero time if there is none.
+	LastTime(monId int) (time.Time, error)
+	// DeleteDetections removes detections of monitor made before time,
+	// all detections if before is zero, and subtracts them from stored
+	// counters. Consolidated archives are removed too if archives is true.
+	// It returns counters of removed detections.
+	DeleteDetections(monDBi *MonitorDBItem, before time.Time, archives bool) (MonCounters, error)
+	// Size returns used and reusable size of storage in bytes.
+	Size() (uint64, uint64, error)
+}
+
+// MonitorRows are data rows to write to detections of monitor.
+type MonitorRows struct {
+	Monitor *MonitorDBItem
+	Rows    []*SerData
+}
+
+// ArchiveRow is a bucket of consolidated archive,
+// Min, Max and Last are NaN while bucket is empty.
+type ArchiveRow struct {
+	Time          time.Time
+	Sensor_id     string
+	Sensor_val_id int
+	Cnt           uint
+	Sum           float64
+	Min           float64
+	Max           float64
+	Last          float64
+}
+
+var store Storage
+
+// errStopScan is returned by scan function to stop scan without error.
+var errStopScan = errors.New("stop scan")
+
+// scanResult converts error of scan function to scan result.
+func scanResult(err error) error {
+	if err == errStopScan {
+		return nil
+	}
+	return err
+}
+
+// openStorage opens storage selected by database type.
+func openStorage(dbconf DatabaseConf) (Storage, error) {
+	switch dbconf.Type {
+	case "memory":
+		logger.Print("Using memory storage, data is lost on exit")
+		return newMemStorage(), nil
+	case "sqlite", "mysql":
+		return openSQLStorage(dbconf)
+	}
+	return nil, errors.New("Unknown database type")
+}
+
+// sqlStorage keeps data in sqlite or mysql database
+// using global db connection and prepared statements.
+type sqlStorage struct{}
+
+func openSQLStorage(dbconf DatabaseConf) (Storage, error) {
+	var err error
+
+	db, err = initDB(dbconf)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = migrateDB(dbconf.Type, false)
+	if err == nil {
+		err = initQueries(dbconf.Type)
+	}
+	if err == nil {
+		err = prepareDB()
+	}
+	if err != nil {
+		cleanupQueries()
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlStorage{}, nil
+}
+
+func (s *sqlStorage) Close() error {
+	cleanupQueries()
+	return db.Close()
+}
+
+func (s *sqlStorage) MonitorIds() ([]int, error) {
+	var err, err2 error
+	var monid int
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Count monitors
+	row := tx.Stmt(stmts["monitors_count"]).QueryRow()
+	var count int64 = 0
+	err = row.Scan(&count)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// there were no rows, but otherwise no error occurred
+			count = 0
+		} else {
+			logger.Print("Fatal Monitor Count Stmt Query: " + err.Error())
+			err2 = tx.Rollback()
+			if err2 != nil {
+				logger.Print("Fatal Monitor Count Stmt Rollback: " + err2.Error())
+				return nil, err2
+			}
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Stmt(stmts["monitors_select_all_id"]).Query()
+	if err != nil {
+		logger.Print("Fatal Monitor All Ids Stmt Query: " + err.Error())
+		err2 = tx.Rollback()
+		if err2 != nil {
+			logger.Print("Fatal Monitor All Ids Stmt Rollback: " + err2.Error())
+			return nil, err2
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Collect monitor ids
+	monids := make([]int, 0, count)
+	for rows.Next() {
+		monid = 0
+
+		err = rows.Scan(&monid)
+		if err != nil {
+			logger.Printf("Fatal Scan Monitor Id: %s", err.Error())
+			// no need Rollback
+			continue
+		}
+		if monid == 0 {
+			continue
+		}
+
+		monids = append(monids, monid)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Printf("Fatal Commit Get Ids Monitors %s, exiting\n", err.Error())
+		return nil, err
+	}
+
+	return monids, nil
+}
+
+func (s *sqlStorage) LoadMonitor(monid int) (*MonitorDBItem, error) {
+	var err, err2 error
+
+	mondbi := MonitorDBItem{}
+	mondbi.Values = make([]MonValue, 0)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Load Monitor
+	row := tx.Stmt(stmts["monitors_select_by_id"]).QueryRow(monid)
+	err = row.Scan(
+		&mondbi.Id,
+		&mondbi.UUID,
+		&mondbi.Exp_id,
+		&mondbi.Setup_id,
+		&mondbi.Step,
+		&mondbi.StepMs,
+		&mondbi.Amount,
+		&mondbi.Duration,
+		&mondbi.Created,
+		&mondbi.StopAt,
+		&mondbi.Active,
+		&mondbi.Paused,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// there were no rows, but otherwise no error occurred
+			tx.Rollback()
+			err = errors.New("Fatal Monitor Select Stmt QueryRow: " + err.Error())
+			return nil, err
+		} else {
+			logger.Print("Fatal Monitor Select Stmt QueryRow: " + err.Error())
+			err2 = tx.Rollback()
+			if err2 != nil {
+				logger.Print("Fatal Monitor Select Stmt Rollback: " + err2.Error())
+				return nil, err2
+			}
+			return nil, err
+		}
+	}
+
+	// Load Monitor Values
+	rows, err := tx.Stmt(stmts["monitors_values_select_by_uuid"]).Query(mondbi.UUID)
+	if err != nil {
+		logger.Printf("Fatal Monitor UUID %s Values Stmt Query: %s\n", mondbi.UUID, err.Error())
+		err2 = tx.Rollback()
+		if err2 != nil {
+			logger.Printf("Fatal Monitor UUID %s Values Stmt Rollback: %s\n", mondbi.UUID, err2.Error())
+			return nil, err2
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	monuuid := ""
+	for rows.Next() {
+		monv := new(MonValue)
+
+		err = rows.Scan(&monuuid, &monv.Name, &monv.Sensor, &monv.ValueIdx)
+		if err != nil {
+			logger.Printf("Fatal Scan Monitor UUID %s Values: %s", mondbi.UUID, err.Error())
+			// no need Rollback
+			continue
+		}
+
+		mondbi.Values = append(mondbi.Values, *monv)
+	}
+
+	// Load Monitor Archives
+	arows, err := tx.Stmt(stmts["monitors_archives_select_by_uuid"]).Query(mondbi.UUID)
+	if err != nil {
+		logger.Printf("Fatal Monitor UUID %s Archives Stmt Query: %s\n", mondbi.UUID, err.Error())
+		err2 = tx.Rollback()
+		if err2 != nil {
+			logger.Printf("Fatal Monitor UUID %s Archives Stmt Rollback: %s\n", mondbi.UUID, err2.Error())
+			return nil, err2
+		}
+		return nil, err
+	}
+	defer arows.Close()
+	for arows.Next() {
+		var step uint
+		err = arows.Scan(&step)
+		if err != nil {
+			logger.Printf("Fatal Scan Monitor UUID %s Archives: %s", mondbi.UUID, err.Error())
+			// no need Rollback
+			continue
+		}
+		mondbi.Archives = append(mondbi.Archives, step)
+	}
+
+	// Load Monitor Counters
+	row = tx.Stmt(stmts["monitors_counters_select_by_uuid"]).QueryRow(mondbi.UUID)
+	err = row.Scan(&monuuid, &mondbi.Counters.Done, &mondbi.Counters.Err)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// there were no rows, but otherwise no error occurred
+			tx.Rollback()
+			err = errors.New("Fatal Monitor Counters Select Stmt QueryRow: " + err.Error())
+			return nil, err
+		} else {
+			logger.Print("Fatal Monitor Counters Select Stmt QueryRow: " + err.Error())
+			err2 = tx.Rollback()
+			if err2 != nil {
+				logger.Print("Fatal Monitor Counters Select Stmt Rollback: " + err2.Error())
+				return nil, err2
+			}
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Printf("Fatal Commit Load Monitor %s, exiting\n", err.Error())
+		return nil, err
+	}
+
+	return &mondbi, nil
+}
+
+func (s *sqlStorage) InsertMonitor(monDBi *MonitorDBItem) (int, error) {
+	var err, err2 error
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Insert new monitor
+	res, err := tx.Stmt(stmts["monitors_insert"]).Exec(
+		monDBi.UUID,
+		monDBi.Exp_id,
+		monDBi.Setup_id,
+		monDBi.Step,
+		monDBi.StepMs,
+		monDBi.Amount,
+		monDBi.Duration,
+		monDBi.Created,
+		monDBi.StopAt,
+		monDBi.Active,
+		monDBi.Paused,
+	)
+	if err != nil {
+		err2 = tx.Rollback()
+		if err2 != nil {
+			return 0, err2
+		}
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		// not supported? ErrNotSupported?
+
+		err2 = tx.Rollback()
+		if err2 != nil {
+			return 0, err2
+		}
+		return 0, err
+	}
+
+	// Save Monitor Values
+	// only once
+	err = insertValuesTx(tx, monDBi)
+	if err != nil {
+		err2 = tx.Rollback()
+		if err2 != nil {
+			return 0, err2
+		}
+		return 0, err
+	}
+
+	// Save Monitor Archives
+	for _, step := range monDBi.Archives {
+		_, err = tx.Stmt(stmts["monitors_archives_insert"]).Exec(monDBi.UUID, step)
+		if err != nil {
+			err2 = tx.Rollback()
+			if err2 != nil {
+				return 0, err2
+			}
+			return 0, err
+		}
+	}
+
+	// Save Monitor Counters
+	// only once
+	_, err = tx.Stmt(stmts["monitors_counters_replace"]).Exec(monDBi.UUID, 0, 0)
+	if err != nil {
+		err2 = tx.Rollback()
+		if err2 != nil {
+			return 0, err2
+		}
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	// XXX: issue with overflow may be here, need int64 type in structs
+	return int(id), nil
+}
+
+// insertValuesTx writes values of monitor within transaction tx.
+func insertValuesTx(tx *sql.Tx, monDBi *MonitorDBItem) error {
+	if len(monDBi.Values) == 0 {
+		return nil
+	}
+
+	sqlInsert := queries["_monitors_values_replace_into"] + " VALUES "
+	values := []interface{}{}
+	for _, monv := range monDBi.Values {
+		sqlInsert += queries["_monitors_values_replace_values"] + ","
+		values = append(values,
+			monDBi.UUID,
+			monv.Name,
+			monv.Sensor,
+			monv.ValueIdx,
+		)
+	}
+	sqlInsert = strings.TrimSuffix(sqlInsert, ",")
+
+	_, err := tx.Exec(sqlInsert, values...)
+	return err
+}
+
+func (s *sqlStorage) UpdateMonitor(monDBi *MonitorDBItem) error {
+	_, err := stmts["monitors_replace"].Exec(monitorArgs(monDBi)...)
+	return err
+}
+
+// monitorArgs returns parameters of monitor for monitors_replace query.
+func monitorArgs(monDBi *MonitorDBItem) []interface{} {
+	return []interface{}{
+		monDBi.Id,
+		monDBi.UUID,
+		monDBi.Exp_id,
+		monDBi.Setup_id,
+		monDBi.Step,
+		monDBi.StepMs,
+		monDBi.Amount,
+		monDBi.Duration,
+		monDBi.Created,
+		monDBi.StopAt,
+		monDBi.Active,
+		monDBi.Paused,
+	}
+}
+
+func (s *sqlStorage) ChangeMonitor(monDBi *MonitorDBItem, changes []MonChange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Stmt(stmts["monitors_replace"]).Exec(monitorArgs(monDBi)...)
+	if err == nil {
+		_, err = tx.Stmt(stmts["monitors_values_delete_by_uuid"]).Exec(monDBi.UUID)
+	}
+	if err == nil {
+		err = insertValuesTx(tx, monDBi)
+	}
+	for _, c := range changes {
+		if err != nil {
+			break
+		}
+		var b []byte
+		b, err = json.Marshal(c.Values)
+		if err != nil {
+			break
+		}
+		_, err = tx.Stmt(stmts["monitors_changes_insert"]).Exec(
+			monDBi.UUID,
+			c.Time.UTC().Format(dbTimeLayout),
+			c.StepMs,
+			c.Amount,
+			c.StopAt.UTC().Format(dbTimeLayout),
+			string(b),
+		)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStorage) RemoveMonitor(monDBi *MonitorDBItem, wdata bool) error {
+	var err, err2 error
+	var errcnt uint = 0
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Delete monitor detections data
+	if wdata {
+		_, err = tx.Stmt(stmts["detections_delete_by_monitor"]).Exec(monDBi.Id)
+		if err != nil {
+			errcnt++
+			logger.Print("error removing monitor data: " + err.Error())
+		}
+	}
+
+	// Delete monitor values
+	_, err = tx.Stmt(stmts["monitors_values_delete_by_uuid"]).Exec(monDBi.UUID)
+	if err != nil {
+		errcnt++
+		logger.Print("error removing monitor values: " + err.Error())
+	}
+
+	// Delete monitor archives
+	if wdata {
+		_, err = tx.Stmt(stmts["detections_archives_delete_by_monitor"]).Exec(monDBi.Id)
+		if err != nil {
+			errcnt++
+			logger.Print("error removing monitor archives data: " + err.Error())
+		}
+	}
+	_, err = tx.Stmt(stmts["monitors_archives_delete_by_uuid"]).Exec(monDBi.UUID)
+	if err != nil {
+		errcnt++
+		logger.Print("error removing monitor archives: " + err.Error())
+	}
+
+	// Delete monitor changes
+	_, err = tx.Stmt(stmts["monitors_changes_delete_by_uuid"]).Exec(monDBi.UUID)
+	if err != nil {
+		errcnt++
+		logger.Print("error removing monitor changes: " + err.Error())
+	}
+
+	// Delete monitor pauses
+	_, err = tx.Stmt(stmts["monitors_pauses_delete_by_uuid"]).Exec(monDBi.UUID)
+	if err != nil {
+		errcnt++
+		logger.Print("error removing monitor pauses: " + err.Error())
+	}
+
+	// Delete monitor gaps
+	_, err = tx.Stmt(stmts["monitors_gaps_delete_by_uuid"]).Exec(monDBi.UUID)
+	if err != nil {
+		errcnt++
+		logger.Print("error removing monitor gaps: " + err.Error())
+	}
+
+	// Delete monitor counters
+	_, err = tx.Stmt(stmts["monitors_counters_delete_by_uuid"]).Exec(monDBi.UUID)
+	if err != nil {
+		errcnt++
+		logger.Print("error removing monitor counters: " + err.Error())
+	}
+
+	// Delete monitor
+	_, err = tx.Stmt(stmts["monitors_delete_by_id"]).Exec(monDBi.Id)
+	if err != nil {
+		errcnt++
+		logger.Print("error removing monitor configuration: " + err.Error())
+	}
+
+	if errcnt > 0 {
+		err2 = tx.Rollback()
+		if err2 != nil {
+			logger.Printf("Fatal Rollback Monitor Remove: %s", err2.Error())
+		}
+		return fmt.Errorf("error removing monitor: %d : %s", monDBi.Id, monDBi.UUID)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Printf("Fatal Commit Monitor Remove %s, exiting\n", err.Error())
+	}
+	return err
+}
+
+func (s *sqlStorage) Counters(u string) (MonCounters, error) {
+	counters := MonCounters{}
+	monuuid := ""
+	err := stmts["monitors_counters_select_by_uuid"].QueryRow(u).Scan(&monuuid, &counters.Done, &counters.Err)
+	if err == sql.ErrNoRows {
+		// there were no rows, but otherwise no error occurred
+		return counters, nil
+	}
+	if err != nil {
+		logger.Print("Fatal Select Monitors Counters Stmt Query: " + err.Error())
+	}
+	return counters, err
+}
+
+func (s *sqlStorage) Changes(u string) ([]MonChange, error) {
+	rows, err := stmts["monitors_changes_select_by_uuid"].Query(u)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := make([]MonChange, 0)
+	var tm, stopAt, vals string
+	for rows.Next() {
+		c := MonChange{}
+		err = rows.Scan(&tm, &c.StepMs, &c.Amount, &stopAt, &vals)
+		if err != nil {
+			return nil, err
+		}
+		c.Time, _ = time.Parse(time.RFC3339Nano, tm)
+		c.StopAt, _ = time.Parse(time.RFC3339Nano, stopAt)
+		err = json.Unmarshal([]byte(vals), &c.Values)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func (s *sqlStorage) Pauses(u string) ([]MonPause, error) {
+	rows, err := stmts["monitors_pauses_select_by_uuid"].Query(u)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pauses := make([]MonPause, 0)
+	var start, end string
+	for rows.Next() {
+		err = rows.Scan(&start, &end)
+		if err != nil {
+			return nil, err
+		}
+		p := MonPause{}
+		p.Start, _ = time.Parse(time.RFC3339Nano, start)
+		if end != "" {
+			p.End, _ = time.Parse(time.RFC3339Nano, end)
+		}
+		pauses = append(pauses, p)
+	}
+	return pauses, rows.Err()
+}
+
+func (s *sqlStorage) AddPause(u string, start time.Time) error {
+	_, err := stmts["monitors_pauses_insert"].Exec(u, start.UTC().Format(dbTimeLayout))
+	return err
+}
+
+func (s *sqlStorage) ClosePause(u string, end time.Time) (time.Time, bool, error) {
+	var start string
+	err := stmts["monitors_pauses_select_open_by_uuid"].QueryRow(u).Scan(&start)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	_, err = stmts["monitors_pauses_update_resumed"].Exec(end.UTC().Format(dbTimeLayout), u)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, start)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+func (s *sqlStorage) Gaps(u string) ([]MonGap, error) {
+	rows, err := stmts["monitors_gaps_select_by_uuid"].Query(u)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	gaps := make([]MonGap, 0)
+	var start, end string
+	for rows.Next() {
+		g := MonGap{}
+		err = rows.Scan(&start, &end, &g.Cause)
+		if err != nil {
+			return nil, err
+		}
+		g.Start, _ = time.Parse(time.RFC3339Nano, start)
+		g.End, _ = time.Parse(time.RFC3339Nano, end)
+		gaps = append(gaps, g)
+	}
+	return gaps, rows.Err()
+}
+
+func (s *sqlStorage) AddGap(u string, g MonGap) error {
+	_, err := stmts["monitors_gaps_replace"].Exec(
+		u,
+		g.Start.UTC().Format(dbTimeLayout),
+		g.End.UTC().Format(dbTimeLayout),
+		g.Cause,
+	)
+	return err
+}
+
+func (s *sqlStorage) Schedules() ([]APISchedule, error) {
+	rows, err := stmts["monitors_schedules_select_all"].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]APISchedule, 0)
+	var startAt string
+	for rows.Next() {
+		sch := APISchedule{}
+		err = rows.Scan(&sch.UUID, &startAt, &sch.Schedule, &sch.Window)
+		if err != nil {
+			logger.Print("Fatal Scan Monitor Schedule: " + err.Error())
+			continue
+		}
+		sch.StartAt, _ = time.Parse(time.RFC3339Nano, startAt)
+		list = append(list, sch)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStorage) SaveSchedule(sch APISchedule) error {
+	_, err := stmts["monitors_schedules_replace"].Exec(
+		sch.UUID,
+		sch.StartAt.UTC().Format(dbTimeLayout),
+		sch.Schedule,
+		sch.Window,
+	)
+	return err
+}
+
+func (s *sqlStorage) RemoveSchedule(u string) error {
+	_, err := stmts["monitors_schedules_delete_by_uuid"].Exec(u)
+	return err
+}
+
+func (s *sqlStorage) Alarms() ([]APIAlarm, error) {
+	rows, err := stmts["monitors_alarms_select_all"].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]APIAlarm, 0)
+	var rule, since string
+	var reading sql.NullFloat64
+	for rows.Next() {
+		a := APIAlarm{}
+		err = rows.Scan(&a.UUID, &a.Value, &rule, &a.State, &a.Cause, &since, &reading)
+		if err != nil {
+			logger.Print("Fatal Scan Monitor Alarm: " + err.Error())
+			continue
+		}
+		err = json.Unmarshal([]byte(rule), &a.AlarmOpts)
+		if err != nil {
+			logger.Print("Fatal Unmarshal Monitor Alarm: " + err.Error())
+			continue
+		}
+		a.Since, _ = time.Parse(time.RFC3339Nano, since)
+		if reading.Valid {
+			a.Reading = &reading.Float64
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStorage) SaveAlarm(a APIAlarm) error {
+	rule, err := json.Marshal(a.AlarmOpts)
+	if err != nil {
+		return err
+	}
+	reading := sql.NullFloat64{}
+	if a.Reading != nil {
+		reading = sql.NullFloat64{Float64: *a.Reading, Valid: true}
+	}
+	_, err = stmts["monitors_alarms_replace"].Exec(
+		a.UUID,
+		a.Value,
+		string(rule),
+		a.State,
+		a.Cause,
+		a.Since.UTC().Format(dbTimeLayout),
+		reading,
+	)
+	return err
+}
+
+func (s *sqlStorage) RemoveAlarms(u string) error {
+	_, err := stmts["monitors_alarms_delete_by_uuid"].Exec(u)
+	return err
+}
+
+func (s *sqlStorage) AppendDetections(batch []MonitorRows, count bool) ([]MonCounters, error) {
+	res := make([]MonCounters, len(batch))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return res, err
+	}
+	for i, b := range batch {
+		res[i], err = insertRowsTx(tx, b.Monitor, b.Rows, count)
+		if err != nil {
+			err2 := tx.Rollback()
+			if err2 != nil {
+				return res, err2
+			}
+			return res, fmt.Errorf("monitor %s: %s", b.Monitor.UUID, err)
+		}
+	}
+
+	return res, tx.Commit()
+}
+
+// insertRowsTx writes data rows to monitor detections, archives
+// and, if count is true, stored counters within transaction tx.
+func insertRowsTx(tx *sql.Tx, monDBi *MonitorDBItem, rows []*SerData, count bool) (MonCounters, error) {
+	var err error
+	counters := MonCounters{}
+
+	// Insert detections by chunks,
+	// keep number of statement variables below SQLite limit (999)
+	nvals := len(monDBi.Values)
+	if nvals == 0 || len(rows) == 0 {
+		return counters, nil
+	}
+	chunk := 999 / (7 * nvals)
+	if chunk == 0 {
+		chunk = 1
+	}
+	for n := 0; n < len(rows); n += chunk {
+		sqlInsert := queries["_detections_insert_into"] + " VALUES "
+		values := []interface{}{}
+		for _, row := range rows[n:int(math.Min(float64(n+chunk), float64(len(rows))))] {
+			tm := row.Time.UTC().Format(dbTimeLayout)
+			is_err := false
+			for i, v := range monDBi.Values {
+				sqlInsert += queries["_detections_insert_values"] + ","
+
+				det_error := sql.NullString{String:"", Valid:false}
+				det_value := sql.NullFloat64{Float64:math.NaN(), Valid:false}
+				if i < len(row.Readings) {
+					det_value.Float64 = row.Readings[i]
+				}
+				if math.IsNaN(det_value.Float64) {
+					det_error.String = row.readingError(i)
+					det_error.Valid = true
+					is_err = true
+				} else {
+					det_value.Valid = true
+				}
+
+				values = append(values,
+					monDBi.Exp_id,
+					monDBi.Id,
+					tm,
+					v.Sensor,
+					v.ValueIdx,
+					det_value,
+					det_error,
+				)
+			}
+			counters.Done++
+			if is_err {
+				counters.Err++
+			}
+		}
+		sqlInsert = strings.TrimSuffix(sqlInsert, ",")
+
+		_, err = tx.Exec(sqlInsert, values...)
+		if err != nil {
+			return counters, err
+		}
+	}
+
+	// Update consolidated archives
+	for _, row := range rows {
+		err = updateArchives(tx, monDBi, row.Time, row.Readings)
+		if err != nil {
+			return counters, err
+		}
+	}
+
+	// Update Counters
+	if count {
+		_, err = tx.Stmt(stmts["monitors_counters_update_all_by_uuid"]).Exec(counters.Done, counters.Err, monDBi.UUID)
+		if err != nil {
+			return counters, err
+		}
+	}
+
+	return counters, nil
+}
+
+// updateArchives adds readings made at time tm to consolidated archives
+// of monitor. NaN readings are skipped.
+func updateArchives(tx *sql.Tx, monDBi *MonitorDBItem, tm time.Time, readings []float64) error {
+	for _, step := range monDBi.Archives {
+		bucket := tm.UTC().Truncate(time.Duration(step) * time.Second).Format(dbTimeLayout)
+		for i, v := range monDBi.Values {
+			if i >= len(readings) || math.IsNaN(readings[i]) {
+				continue
+			}
+			r := readings[i]
+			_, err := tx.Stmt(stmts["detections_archives_insert_ignore"]).Exec(
+				monDBi.Id, step, bucket, v.Sensor, v.ValueIdx,
+			)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Stmt(stmts["detections_archives_update"]).Exec(
+				r, r, r, r, r, r,
+				monDBi.Id, step, bucket, v.Sensor, v.ValueIdx,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *sqlStorage) ScanDetections(monId int, start, end time.Time, fn func(*DetectionItem) error) error {
+	var err error
+	var rows *sql.Rows
+	if start.IsZero() && end.IsZero() {
+		rows, err = stmts["detections_select_by_monitor"].Query(
+			monId,
+		)
+	} else if start.IsZero() {
+		rows, err = stmts["detections_select_by_monitor_time_to"].Query(
+			monId,
+			end.UTC().Format(dbTimeLayout),
+		)
+	} else if end.IsZero() {
+		rows, err = stmts["detections_select_by_monitor_time_from"].Query(
+			monId,
+			start.UTC().Format(dbTimeLayout),
+		)
+	} else {
+		rows, err = stmts["detections_select_by_monitor_time_range"].Query(
+			monId,
+			start.UTC().Format(dbTimeLayout),
+			end.UTC().Format(dbTimeLayout),
+		)
+	}
+	if err != nil {
+		logger.Print("Fatal Detections Select Time Range Stmt Query: " + err.Error())
+		return err
+	}
+	defer rows.Close()
+
+	var tm string
+	var detection sql.NullFloat64
+	var derror    sql.NullString
+	for rows.Next() {
+		d := DetectionItem{Mon_id: monId}
+		err = rows.Scan(&tm, &d.Sensor_id, &d.Sensor_val_id, &detection, &derror)
+		if err != nil {
+			logger.Printf("Fatal Detections Select Time Range Scan: %s", err.Error())
+			return err
+		}
+		d.Time, _ = time.Parse(time.RFC3339Nano, tm)
+
+		// Convert non valid to NaN value
+		d.Detection = detection.Float64
+		if !detection.Valid {
+			d.Detection = math.NaN()
+		}
+		// Non valid error is empty string
+		d.Error = derror.String
+
+		err = fn(&d)
+		if err != nil {
+			return scanResult(err)
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStorage) ScanArchive(monId int, step uint, start, end time.Time, fn func(*ArchiveRow) error) error {
+	startStr, endStr := "", ""
+	if !start.IsZero() {
+		startStr = start.UTC().Format(dbTimeLayout)
+	}
+	if !end.IsZero() {
+		endStr = end.UTC().Format(dbTimeLayout)
+	}
+
+	rows, err := stmts["detections_archives_select_by_monitor_time_range"].Query(
+		monId, step, startStr, startStr, endStr, endStr,
+	)
+	if err != nil {
+		logger.Print("Fatal Detections Archives Select Stmt Query: " + err.Error())
+		return err
+	}
+	defer rows.Close()
+
+	var tm string
+	var min, max, last sql.NullFloat64
+	for rows.Next() {
+		a := ArchiveRow{}
+		err = rows.Scan(&tm, &a.Sensor_id, &a.Sensor_val_id, &a.Cnt, &a.Sum, &min, &max, &last)
+		if err != nil {
+			logger.Print("Fatal Detections Archives Select Scan: " + err.Error())
+			return err
+		}
+		a.Time, _ = time.Parse(time.RFC3339Nano, tm)
+		a.Min, a.Max, a.Last = math.NaN(), math.NaN(), math.NaN()
+		if min.Valid {
+			a.Min = min.Float64
+		}
+		if max.Valid {
+			a.Max = max.Float64
+		}
+		if last.Valid {
+			a.Last = last.Float64
+		}
+		err = fn(&a)
+		if err != nil {
+			return scanResult(err)
+		}
+	}
+	return rows.Err()
+}
+
+// countRow scans count returned by statement, no rows is zero count.
+func countRow(name string, args ...interface{}) (uint, error) {
+	var n uint
+	err := stmts[name].QueryRow(args...).Scan(&n)
+	if err == sql.ErrNoRows {
+		// there were no rows, but otherwise no error occurred
+		return 0, nil
+	}
+	return n, err
+}
+
+func (s *sqlStorage) CountDetections(monId int, before time.Time) (uint, error) {
+	if before.IsZero() {
+		return countRow("detections_count_by_monitor", monId)
+	}
+	return countRow("detections_count_by_monitor_before", monId, before.UTC().Format(dbTimeLayout))
+}
+
+func (s *sqlStorage) CountTimes(monId int) (uint, error) {
+	return countRow("detections_count_by_monitor_grouptime", monId)
+}
+
+func (s *sqlStorage) CountValue(monId int, sensor string, valueIdx int) (uint, error) {
+	return countRow("detections_count_by_monitor_sensor", monId, sensor, valueIdx)
+}
+
+func (s *sqlStorage) CountArchive(monId int, step uint) (uint, error) {
+	return countRow("detections_archives_count_by_monitor_step", monId, step)
+}
+
+func (s *sqlStorage) TotalDetections() (uint64, error) {
+	var total uint64
+	err := stmts["detections_count"].QueryRow().Scan(&total)
+	return total, err
+}
+
+func (s *sqlStorage) LastTime(monId int) (time.Time, error) {
+	var last string
+	err := stmts["detections_select_last_time_by_monitor"].QueryRow(monId).Scan(&last)
+	if err == sql.ErrNoRows {
+		// there were no rows, but otherwise no error occurred
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, _ := time.Parse(time.RFC3339Nano, last)
+	return t, nil
+}
+
+func (s *sqlStorage) DeleteDetections(monDBi *MonitorDBItem, before time.Time, archives bool) (MonCounters, error) {
+	counters := MonCounters{}
+	tx, err := db.Begin()
+	if err != nil {
+		return counters, err
+	}
+	if before.IsZero() {
+		err = tx.Stmt(stmts["detections_count_times_by_monitor"]).QueryRow(monDBi.Id).Scan(&counters.Done, &counters.Err)
+		if err == nil {
+			_, err = tx.Stmt(stmts["detections_delete_by_monitor"]).Exec(monDBi.Id)
+		}
+		if err == nil && archives {
+			_, err = tx.Stmt(stmts["detections_archives_delete_by_monitor"]).Exec(monDBi.Id)
+		}
+	} else {
+		b := before.UTC().Format(dbTimeLayout)
+		err = tx.Stmt(stmts["detections_count_times_by_monitor_before"]).QueryRow(monDBi.Id, b).Scan(&counters.Done, &counters.Err)
+		if err == nil {
+			_, err = tx.Stmt(stmts["detections_delete_by_monitor_before"]).Exec(monDBi.Id, b)
+		}
+		if err == nil && archives {
+			_, err = tx.Stmt(stmts["detections_archives_delete_by_monitor_before"]).Exec(monDBi.Id, b)
+		}
+	}
+	if err == nil && counters.Done > 0 {
+		_, err = tx.Stmt(stmts["monitors_counters_subtract_by_uuid"]).Exec(counters.Done, counters.Err, monDBi.UUID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return MonCounters{}, err
+	}
+	return counters, tx.Commit()
+}
+
+// Size returns size of database used by data and reusable free space.
+func (s *sqlStorage) Size() (uint64, uint64, error) {
+	query, ok := queries["_db_size"]
+	if !ok || query == "" {
+		return 0, 0, nil
+	}
+	var pages, freelist, pageSize uint64
+	err := db.QueryRow(query).Scan(&pages, &freelist, &pageSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	return (pages - freelist) * pageSize, freelist * pageSize, nil
+}
@@ -0,0 +1,237 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/pborman/uuid"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// apiConn is a client connection of API.
+// Writes are serialized, so notifications can be sent to the client
+// between responses of JSON-RPC server.
+type apiConn struct {
+	net.Conn
+	id  uint64
+	wmu sync.Mutex
+}
+
+type Notification struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type StreamData struct {
+	Subscription string
+	UUID         string
+	Data         *SerData
+}
+
+type StreamEnd struct {
+	Subscription string
+	UUID         string
+}
+
+type subscriber struct {
+	id     string
+	source string
+	conn   *apiConn
+	data   chan *SerData
+	done   chan struct{}
+}
+
+// streamHub fans out data rows of series and monitors to subscribers,
+// each subscriber has own buffer, so slow clients do not block others.
+type streamHub struct {
+	mu      sync.Mutex
+	sources map[string]map[string]*subscriber
+	subs    map[string]*subscriber
+}
+
+var (
+	streams = newStreamHub()
+	connSeq uint64
+)
+
+func newAPIConn(conn net.Conn) *apiConn {
+	return &apiConn{Conn: conn, id: atomic.AddUint64(&connSeq, 1)}
+}
+
+// Name returns connection identifier: remote address and sequence number.
+func (c *apiConn) Name() string {
+	addr := ""
+	if a := c.RemoteAddr(); a != nil {
+		addr = a.String()
+	}
+	return fmt.Sprintf("%s#%d", addr, c.id)
+}
+
+func (c *apiConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// Notify sends JSON-RPC notification (request without id) to the client.
+func (c *apiConn) Notify(method string, params ...interface{}) error {
+	b, err := json.Marshal(Notification{"2.0", method, params})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(append(b, '\n'))
+	return err
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{
+		sources: make(map[string]map[string]*subscriber),
+		subs:    make(map[string]*subscriber),
+	}
+}
+
+// Subscribe registers connection as receiver of data rows of series
+// or monitor with given uuid and returns subscription id.
+func (h *streamHub) Subscribe(source string, conn *apiConn) string {
+	s := &subscriber{
+		id:     uuid.NewRandom().String(),
+		source: source,
+		conn:   conn,
+		data:   make(chan *SerData, config.Stream.Buffer),
+		done:   make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	if h.sources[source] == nil {
+		h.sources[source] = make(map[string]*subscriber)
+	}
+	h.sources[source][s.id] = s
+	h.subs[s.id] = s
+	h.mu.Unlock()
+
+	go s.run()
+
+	return s.id
+}
+
+// Unsubscribe removes subscription by id.
+// It returns false if subscription not found.
+func (h *streamHub) Unsubscribe(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, exists := h.subs[id]
+	if !exists {
+		return false
+	}
+	h.remove(s)
+	close(s.done)
+	return true
+}
+
+// Owner returns connection of subscription with given id or nil.
+func (h *streamHub) Owner(id string) *apiConn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, exists := h.subs[id]; exists {
+		return s.conn
+	}
+	return nil
+}
+
+// Publish sends data row to all subscribers of source.
+func (h *streamHub) Publish(source string, d *SerData) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, s := range h.sources[source] {
+		select {
+		case s.data <- d:
+		default:
+			// subscriber buffer is full,
+			// drop the oldest row
+			select {
+			case <-s.data:
+			default:
+			}
+			select {
+			case s.data <- d:
+			default:
+			}
+		}
+	}
+}
+
+// Close finishes all subscriptions to source. Subscribers receive
+// rows buffered before and end of stream notification.
+func (h *streamHub) Close(source string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, s := range h.sources[source] {
+		h.remove(s)
+		close(s.data)
+	}
+}
+
+// CloseConn removes all subscriptions of closed connection.
+func (h *streamHub) CloseConn(conn *apiConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, s := range h.subs {
+		if s.conn == conn {
+			h.remove(s)
+			close(s.done)
+		}
+	}
+}
+
+func (h *streamHub) remove(s *subscriber) {
+	delete(h.subs, s.id)
+	delete(h.sources[s.source], s.id)
+	if len(h.sources[s.source]) == 0 {
+		delete(h.sources, s.source)
+	}
+}
+
+func (s *subscriber) run() {
+	for {
+		select {
+		case d, ok := <-s.data:
+			if !ok {
+				s.conn.Notify("Lab.StreamEnd", StreamEnd{s.id, s.source})
+				return
+			}
+			err := s.conn.Notify("Lab.StreamData", StreamData{s.id, s.source, d})
+			if err != nil {
+				logger.Print("stream " + s.id + ": " + err.Error())
+				streams.Unsubscribe(s.id)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
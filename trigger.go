@@ -0,0 +1,195 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	TRIGGER_ARMED     = "armed"
+	TRIGGER_TRIGGERED = "triggered"
+	TRIGGER_CAPTURED  = "captured"
+)
+
+type TriggerOpts struct {
+	Mode  string   // "level", "edge" or "manual"
+	Value int      // index of series value to check
+	Level float64  // threshold for level and edge modes
+	Edge  string   // "rising" (default), "falling" or "any"
+	Pre   uint     // samples to keep before trigger
+	Post  uint     // samples to capture after trigger
+}
+
+type Capture struct {
+	State  string
+	Cause  string     // mode caused trigger: "level", "edge" or "manual"
+	Time   time.Time  // time of trigger sample
+	Pre    uint       // number of pre-trigger samples in Rows
+	Rows   []*SerData
+}
+
+// trigger watches series data and freezes samples around
+// trigger event into capture.
+type trigger struct {
+	opts   TriggerOpts
+	manual chan int
+
+	pre    []*SerData  // ring of pre-trigger samples
+	npre   uint
+	post   uint        // post-trigger samples left to capture
+	prev   float64
+
+	mu      sync.Mutex
+	capture Capture
+}
+
+func newTrigger(opts *TriggerOpts, nvalues int) (*trigger, error) {
+	switch opts.Mode {
+	case "level", "edge", "manual":
+	default:
+		return nil, errors.New("wrong trigger mode: '" + opts.Mode + "'")
+	}
+	switch opts.Edge {
+	case "":
+		opts.Edge = "rising"
+	case "rising", "falling", "any":
+	default:
+		return nil, errors.New("wrong trigger edge: '" + opts.Edge + "'")
+	}
+	if opts.Value < 0 || opts.Value >= nvalues {
+		return nil, fmt.Errorf("no value %d in series for trigger", opts.Value)
+	}
+	if opts.Pre > config.Series.Buffer || opts.Post > config.Series.Buffer {
+		return nil, fmt.Errorf("trigger capture cannot exceed %d samples before and after", config.Series.Buffer)
+	}
+
+	tr := &trigger{
+		opts:   *opts,
+		manual: make(chan int, 1),
+		pre:    make([]*SerData, opts.Pre),
+		prev:   math.NaN(),
+	}
+	tr.capture.State = TRIGGER_ARMED
+	return tr, nil
+}
+
+// Fire triggers capture manually.
+// It returns false if trigger is already fired.
+func (tr *trigger) Fire() bool {
+	if tr.Capture().State != TRIGGER_ARMED {
+		return false
+	}
+	select {
+	case tr.manual <- 1:
+	default:
+	}
+	return true
+}
+
+// Capture returns copy of trigger capture.
+func (tr *trigger) Capture() Capture {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	c := tr.capture
+	c.Rows = make([]*SerData, len(tr.capture.Rows))
+	copy(c.Rows, tr.capture.Rows)
+	return c
+}
+
+// fired checks if trigger condition is met by sample value v
+// and returns its cause.
+func (tr *trigger) fired(v float64) (string, bool) {
+	select {
+	case <-tr.manual:
+		return "manual", true
+	default:
+	}
+	if math.IsNaN(v) {
+		return "", false
+	}
+	rising := tr.opts.Edge == "rising" || tr.opts.Edge == "any"
+	falling := tr.opts.Edge == "falling" || tr.opts.Edge == "any"
+	switch tr.opts.Mode {
+	case "level":
+		if (rising && v >= tr.opts.Level) || (falling && v <= tr.opts.Level) {
+			return "level", true
+		}
+	case "edge":
+		if math.IsNaN(tr.prev) {
+			return "", false
+		}
+		if (rising && tr.prev < tr.opts.Level && v >= tr.opts.Level) ||
+			(falling && tr.prev > tr.opts.Level && v <= tr.opts.Level) {
+			return "edge", true
+		}
+	}
+	return "", false
+}
+
+// add processes new series sample.
+// It returns true when capture is complete.
+func (tr *trigger) add(d *SerData) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	switch tr.capture.State {
+	case TRIGGER_ARMED:
+		v := d.Readings[tr.opts.Value]
+		cause, ok := tr.fired(v)
+		tr.prev = v
+		if !ok {
+			if len(tr.pre) > 0 {
+				tr.pre[tr.npre%uint(len(tr.pre))] = d
+				tr.npre++
+			}
+			return false
+		}
+
+		// freeze pre-trigger samples in order
+		n := tr.npre
+		if n > uint(len(tr.pre)) {
+			n = uint(len(tr.pre))
+		}
+		rows := make([]*SerData, 0, n+1+tr.opts.Post)
+		for i := tr.npre - n; i < tr.npre; i++ {
+			rows = append(rows, tr.pre[i%uint(len(tr.pre))])
+		}
+		rows = append(rows, d)
+		tr.pre = nil
+
+		tr.capture = Capture{TRIGGER_TRIGGERED, cause, d.Time, n, rows}
+		tr.post = tr.opts.Post
+	case TRIGGER_TRIGGERED:
+		tr.capture.Rows = append(tr.capture.Rows, d)
+		tr.post--
+	default:
+		return true
+	}
+
+	if tr.post == 0 {
+		tr.capture.State = TRIGGER_CAPTURED
+		return true
+	}
+	return false
+}
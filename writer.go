@@ -0,0 +1,205 @@
+/*
+    sdlab - STEM Lab core daemon
+    Copyright (C) 2014  Dmitry Mikhirev <mikhirev@mezon.ru>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of failed flushes after which queued rows are dropped
+const WRITE_MAX_RETRIES = 5
+
+// Number of times reading of stored and queued rows is repeated
+// if queued rows are written while they are read
+const WRITE_READ_RETRIES = 3
+
+type writeItem struct {
+	mon *Monitor
+	row *SerData
+}
+
+// writeQueue collects detections of all monitors and writes them
+// to database in one transaction per batch, so storage is not written
+// on every tick of every monitor.
+type writeQueue struct {
+	mu       sync.Mutex
+	pending  []writeItem
+	flushing []writeItem  // rows being written by flush
+	gen      uint64       // number of flushes which wrote rows
+	kick     chan struct{}
+	once     sync.Once
+
+	fmu     sync.Mutex  // serializes flushes
+	retries uint        // failed flushes of rows at front of queue
+}
+
+var writes = newWriteQueue()
+
+func newWriteQueue() *writeQueue {
+	return &writeQueue{
+		pending: make([]writeItem, 0),
+		kick:    make(chan struct{}, 1),
+	}
+}
+
+// Add queues data row of monitor. Queue is flushed when it has
+// configured number of rows or rows wait for configured latency.
+func (q *writeQueue) Add(mon *Monitor, row *SerData) {
+	q.once.Do(q.start)
+
+	q.mu.Lock()
+	q.pending = append(q.pending, writeItem{mon, row})
+	n := len(q.pending)
+	q.mu.Unlock()
+
+	if n >= int(config.Database.Batch.Rows) {
+		select {
+		case q.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *writeQueue) start() {
+	latency := time.Duration(config.Database.Batch.Latency) * time.Millisecond
+	if latency <= 0 {
+		latency = time.Second
+	}
+
+	go func() {
+		t := time.NewTicker(latency)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-q.kick:
+			}
+			q.Flush()
+		}
+	}()
+}
+
+// Flush writes all queued rows to storage. If writing fails, rows are
+// put back at front of queue to be retried by next flush, they are
+// dropped after WRITE_MAX_RETRIES failures.
+func (q *writeQueue) Flush() error {
+	q.fmu.Lock()
+	defer q.fmu.Unlock()
+
+	q.mu.Lock()
+	items := q.pending
+	q.pending = make([]writeItem, 0)
+	q.flushing = items
+	q.mu.Unlock()
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	// Group rows by monitor keeping order
+	order := make([]*Monitor, 0)
+	rows := make(map[*Monitor][]*SerData)
+	for _, it := range items {
+		if _, exists := rows[it.mon]; !exists {
+			order = append(order, it.mon)
+		}
+		rows[it.mon] = append(rows[it.mon], it.row)
+	}
+
+	batch := make([]MonitorRows, 0, len(order))
+	for _, mon := range order {
+		monDBi, err := monitorToDB(mon)
+		if err != nil {
+			return q.requeue(items, err)
+		}
+		batch = append(batch, MonitorRows{monDBi, rows[mon]})
+	}
+	_, err := store.AppendDetections(batch, true)
+	if err != nil {
+		return q.requeue(items, err)
+	}
+	q.retries = 0
+
+	q.mu.Lock()
+	q.flushing = nil
+	q.gen++
+	q.mu.Unlock()
+	return nil
+}
+
+// requeue puts items failed to write with err back at front of queue
+// or drops them if they failed too many times. It returns err.
+func (q *writeQueue) requeue(items []writeItem, err error) error {
+	q.retries++
+	if q.retries > WRITE_MAX_RETRIES {
+		logger.Print("error writing detections, dropping " + strconv.Itoa(len(items)) + " rows: " + err.Error())
+		q.retries = 0
+		q.mu.Lock()
+		q.flushing = nil
+		q.mu.Unlock()
+		return err
+	}
+	logger.Print("error writing detections, will retry: " + err.Error())
+
+	q.mu.Lock()
+	q.pending = append(items, q.pending...)
+	q.flushing = nil
+	q.mu.Unlock()
+	return err
+}
+
+// Pending returns rows of monitor which are queued or being written
+// and generation of flushes. Queue is not locked while rows are read
+// from storage, so rows written meanwhile may be found in storage too,
+// readers skip rows not newer than stored ones. Flushed reports
+// if rows were written since generation.
+func (q *writeQueue) Pending(mon *Monitor) ([]*SerData, uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	rows := make([]*SerData, 0)
+	for _, items := range [][]writeItem{q.flushing, q.pending} {
+		for _, it := range items {
+			if it.mon == mon {
+				rows = append(rows, it.row)
+			}
+		}
+	}
+	return rows, q.gen
+}
+
+// Flushed reports if queued rows were written since generation gen.
+func (q *writeQueue) Flushed(gen uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.gen != gen
+}
+
+// newerRows returns rows made after time last.
+func newerRows(rows []*SerData, last time.Time) []*SerData {
+	res := make([]*SerData, 0, len(rows))
+	for _, row := range rows {
+		if row.Time.After(last) {
+			res = append(res, row)
+		}
+	}
+	return res
+}